@@ -0,0 +1,82 @@
+package main
+
+import (
+	"math"
+	"sort"
+)
+
+// mbToGB converts megabytes to gigabytes rounded to two decimals
+func mbToGB(mb int) float64 {
+	return math.Round(float64(mb)/1024*100) / 100
+}
+
+// allocation is the memory and disk allocated to running processes: the
+// per-instance limits times the number of instances
+type allocation struct {
+	ais    int
+	memory int // MB
+	disk   int // MB
+}
+
+func (a *allocation) add(process Process) {
+	a.ais += process.Instances
+	a.memory += process.Instances * process.MemoryInMB
+	a.disk += process.Instances * process.DiskInMB
+}
+
+// applyAllocations adds the disk allocated per org and the memory and disk
+// allocated per space to result. Memory per org comes from the usage
+// summaries already; usage_summary has no disk figure.
+func applyAllocations(result *UsageResult, running []runningProcess, orgs []Organization, config *Config) {
+	skipOrgs := make(map[string]bool)
+	orgGUIDs := make(map[string]string)
+	for _, org := range orgs {
+		skipOrgs[org.GUID] = shouldSkipOrg(org.Name, config.SkipOrgs)
+		orgGUIDs[org.Name] = org.GUID
+	}
+
+	orgAllocations := make(map[string]*allocation)
+	spaceAllocations := make(map[string]map[string]*allocation) // org GUID -> space name ->
+	totalDisk, billableDisk := 0, 0
+	for _, process := range running {
+		orgGUID := process.OrgGUID
+		if orgAllocations[orgGUID] == nil {
+			orgAllocations[orgGUID] = &allocation{}
+			spaceAllocations[orgGUID] = make(map[string]*allocation)
+		}
+		if spaceAllocations[orgGUID][process.SpaceName] == nil {
+			spaceAllocations[orgGUID][process.SpaceName] = &allocation{}
+		}
+		orgAllocations[orgGUID].add(process.Process)
+		spaceAllocations[orgGUID][process.SpaceName].add(process.Process)
+
+		disk := process.Process.Instances * process.Process.DiskInMB
+		totalDisk += disk
+		if !skipOrgs[orgGUID] {
+			billableDisk += disk
+		}
+	}
+	result.TotalDiskGB = mbToGB(totalDisk)
+	result.TotalBillableDiskGB = mbToGB(billableDisk)
+
+	for i := range result.Organizations {
+		org := &result.Organizations[i]
+		guid := orgGUIDs[org.Name]
+		if orgAllocations[guid] == nil {
+			continue
+		}
+		org.DiskGB = mbToGB(orgAllocations[guid].disk)
+		org.Spaces = nil
+		for name, space := range spaceAllocations[guid] {
+			org.Spaces = append(org.Spaces, SpaceAllocation{
+				Name:     name,
+				AIs:      space.ais,
+				MemoryGB: mbToGB(space.memory),
+				DiskGB:   mbToGB(space.disk),
+			})
+		}
+		sort.Slice(org.Spaces, func(i, j int) bool {
+			return org.Spaces[i].Name < org.Spaces[j].Name
+		})
+	}
+}
@@ -0,0 +1,495 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	appUsageStateFile = "app_usage_events.json"
+	retainedPeriods   = 13 // billing periods kept in the tracker state
+)
+
+// appUsageTracker reconstructs per-process instance timelines from
+// /v3/app_usage_events and accrues AI-hours and peak instance counts per
+// billing period (calendar month, UTC) for orgs, spaces and the foundation.
+type appUsageTracker struct {
+	TrackingSince time.Time                  `json:"tracking_since"`
+	LastEventGUID string                     `json:"last_event_guid"`
+	Processes     map[string]*trackedProcess `json:"processes"` // running processes by process GUID
+	Spaces        map[string]trackedSpace    `json:"spaces"`
+	Periods       map[string]*periodTotals   `json:"periods"` // by YYYY-MM
+
+	// Running instance counts, derived from Processes
+	orgCurrent      map[string]int
+	spaceCurrent    map[string]int
+	totalCurrent    int
+	billableCurrent int
+	skipOrgs        map[string]bool // org GUIDs excluded from billable counts
+}
+
+type trackedProcess struct {
+	OrgGUID   string    `json:"org_guid"`
+	SpaceGUID string    `json:"space_guid"`
+	Instances int       `json:"instances"`
+	Since     time.Time `json:"since"` // AI-hours are accrued up to this time
+}
+
+type trackedSpace struct {
+	Name    string `json:"name"`
+	OrgGUID string `json:"org_guid"`
+}
+
+type periodTotals struct {
+	AIHours         float64            `json:"ai_hours"`
+	BillableAIHours float64            `json:"billable_ai_hours"` // outside the orgs skipped at the time, like the peaks
+	PeakAIs         int                `json:"peak_ais"`
+	BillablePeakAIs int                `json:"billable_peak_ais"`
+	OrgAIHours      map[string]float64 `json:"org_ai_hours"`
+	OrgPeaks        map[string]int     `json:"org_peaks"`
+	SpaceAIHours    map[string]float64 `json:"space_ai_hours"`
+	SpacePeaks      map[string]int     `json:"space_peaks"`
+}
+
+func newAppUsageTracker(since time.Time) *appUsageTracker {
+	t := &appUsageTracker{
+		TrackingSince: since,
+		Processes:     make(map[string]*trackedProcess),
+		Spaces:        make(map[string]trackedSpace),
+		Periods:       make(map[string]*periodTotals),
+	}
+	t.recount(nil)
+	return t
+}
+
+// loadAppUsageTracker reads the tracker state from dir. It returns nil if
+// no state has been saved yet.
+func loadAppUsageTracker(dir string) (*appUsageTracker, error) {
+	data, err := os.ReadFile(filepath.Join(dir, appUsageStateFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read app usage event state: %w", err)
+	}
+
+	t := newAppUsageTracker(time.Time{})
+	if err := json.Unmarshal(data, t); err != nil {
+		return nil, fmt.Errorf("failed to parse app usage event state: %w", err)
+	}
+	return t, nil
+}
+
+// save writes the tracker state to dir atomically
+func (t *appUsageTracker) save(dir string) error {
+	return writeStateFile(dir, appUsageStateFile, t)
+}
+
+// writeStateFile writes v as JSON to dir/name via a temporary file and rename
+func writeStateFile(dir, name string, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(dir, name+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(dir, name))
+}
+
+// recount rebuilds the running instance counts from the tracked processes
+func (t *appUsageTracker) recount(skipOrgs map[string]bool) {
+	t.skipOrgs = skipOrgs
+	t.orgCurrent = make(map[string]int)
+	t.spaceCurrent = make(map[string]int)
+	t.totalCurrent = 0
+	t.billableCurrent = 0
+	for _, p := range t.Processes {
+		t.orgCurrent[p.OrgGUID] += p.Instances
+		t.spaceCurrent[p.SpaceGUID] += p.Instances
+		t.totalCurrent += p.Instances
+		if !skipOrgs[p.OrgGUID] {
+			t.billableCurrent += p.Instances
+		}
+	}
+}
+
+// baseline seeds the tracker with the processes running now, so apps that
+// have not changed within the event retention window are accounted for
+func (t *appUsageTracker) baseline(now time.Time, spaces []Space, apps []App, processes []Process) {
+	for _, space := range spaces {
+		t.Spaces[space.GUID] = trackedSpace{Name: space.Name, OrgGUID: space.Relationships.Organization.Data.GUID}
+	}
+
+	started := make(map[string]App)
+	for _, app := range apps {
+		if app.State == "STARTED" {
+			started[app.GUID] = app
+		}
+	}
+
+	for _, process := range processes {
+		app, ok := started[guidFromHref(process.Links.App.Href)]
+		if !ok || process.Instances == 0 {
+			continue
+		}
+		spaceGUID := app.Relationships.Space.Data.GUID
+		t.setInstances(process.GUID, t.Spaces[spaceGUID].OrgGUID, spaceGUID, process.Instances, now)
+	}
+}
+
+// apply updates the timelines with a single event
+func (t *appUsageTracker) apply(event AppUsageEvent) {
+	t.LastEventGUID = event.GUID
+
+	var instances int
+	switch event.State.Current {
+	case "STARTED":
+		instances = event.InstanceCount.Current
+	case "STOPPED":
+		instances = 0
+	default:
+		// BUILDPACK_SET and task events do not change the instance count
+		return
+	}
+
+	if event.Space.GUID != "" {
+		t.Spaces[event.Space.GUID] = trackedSpace{Name: event.Space.Name, OrgGUID: event.Organization.GUID}
+	}
+	processGUID := event.Process.GUID
+	if processGUID == "" {
+		processGUID = event.App.GUID
+	}
+	t.setInstances(processGUID, event.Organization.GUID, event.Space.GUID, instances, event.CreatedAt.UTC())
+}
+
+// setInstances records that a process runs n instances from time at
+func (t *appUsageTracker) setInstances(guid, orgGUID, spaceGUID string, n int, at time.Time) {
+	p, ok := t.Processes[guid]
+	if !ok {
+		if n == 0 {
+			return
+		}
+		p = &trackedProcess{OrgGUID: orgGUID, SpaceGUID: spaceGUID, Since: at}
+		t.Processes[guid] = p
+	}
+	t.accrue(p, at)
+
+	delta := n - p.Instances
+	p.Instances = n
+	if n == 0 {
+		delete(t.Processes, guid)
+	}
+
+	t.orgCurrent[p.OrgGUID] += delta
+	t.spaceCurrent[p.SpaceGUID] += delta
+	t.totalCurrent += delta
+	if !t.skipOrgs[p.OrgGUID] {
+		t.billableCurrent += delta
+	}
+	if delta > 0 {
+		t.recordPeaks(t.period(periodKey(at)), p)
+	}
+}
+
+// accrue adds the AI-hours of p up to until, split across billing periods
+func (t *appUsageTracker) accrue(p *trackedProcess, until time.Time) {
+	from := p.Since
+	if !until.After(from) {
+		return
+	}
+	for p.Instances > 0 && from.Before(until) {
+		end := periodStart(from).AddDate(0, 1, 0)
+		if end.After(until) {
+			end = until
+		}
+		hours := end.Sub(from).Hours() * float64(p.Instances)
+		totals := t.period(periodKey(from))
+		totals.AIHours += hours
+		if !t.skipOrgs[p.OrgGUID] {
+			totals.BillableAIHours += hours
+		}
+		totals.OrgAIHours[p.OrgGUID] += hours
+		totals.SpaceAIHours[p.SpaceGUID] += hours
+		from = end
+	}
+	p.Since = until
+}
+
+// period returns the totals for key, creating them with peaks seeded from the
+// instances already running when the period starts
+func (t *appUsageTracker) period(key string) *periodTotals {
+	totals, ok := t.Periods[key]
+	if ok {
+		return totals
+	}
+	totals = &periodTotals{
+		PeakAIs:         t.totalCurrent,
+		BillablePeakAIs: t.billableCurrent,
+		OrgAIHours:      make(map[string]float64),
+		OrgPeaks:        make(map[string]int),
+		SpaceAIHours:    make(map[string]float64),
+		SpacePeaks:      make(map[string]int),
+	}
+	for guid, n := range t.orgCurrent {
+		if n > 0 {
+			totals.OrgPeaks[guid] = n
+		}
+	}
+	for guid, n := range t.spaceCurrent {
+		if n > 0 {
+			totals.SpacePeaks[guid] = n
+		}
+	}
+	t.Periods[key] = totals
+	return totals
+}
+
+// recordPeaks raises the period peaks affected by a scale-up of p
+func (t *appUsageTracker) recordPeaks(totals *periodTotals, p *trackedProcess) {
+	totals.PeakAIs = max(totals.PeakAIs, t.totalCurrent)
+	totals.BillablePeakAIs = max(totals.BillablePeakAIs, t.billableCurrent)
+	totals.OrgPeaks[p.OrgGUID] = max(totals.OrgPeaks[p.OrgGUID], t.orgCurrent[p.OrgGUID])
+	totals.SpacePeaks[p.SpaceGUID] = max(totals.SpacePeaks[p.SpaceGUID], t.spaceCurrent[p.SpaceGUID])
+}
+
+// advance accrues all running processes up to now and drops old periods
+func (t *appUsageTracker) advance(now time.Time) {
+	for _, p := range t.Processes {
+		t.accrue(p, now)
+	}
+	t.period(periodKey(now))
+
+	oldest := periodKey(periodStart(now).AddDate(0, 1-retainedPeriods, 0))
+	for key := range t.Periods {
+		if key < oldest {
+			delete(t.Periods, key)
+		}
+	}
+}
+
+// report summarizes the tracked periods. orgNames maps org GUIDs to names.
+func (t *appUsageTracker) report(orgNames map[string]string) *EventUsage {
+	usage := &EventUsage{
+		TrackingSince: t.TrackingSince,
+		LastEventGUID: t.LastEventGUID,
+		Periods:       []PeriodUsage{},
+	}
+
+	orgName := func(guid string) string {
+		if name, ok := orgNames[guid]; ok {
+			return name
+		}
+		return guid
+	}
+
+	for key, totals := range t.Periods {
+		period := PeriodUsage{
+			Period:          key,
+			AIHours:         roundHours(totals.AIHours),
+			BillableAIHours: roundHours(totals.BillableAIHours),
+			PeakAIs:         totals.PeakAIs,
+			BillablePeakAIs: totals.BillablePeakAIs,
+			Organizations:   []ScopeUsage{},
+			Spaces:          []ScopeUsage{},
+		}
+
+		for _, guid := range unionKeys(totals.OrgAIHours, totals.OrgPeaks) {
+			period.Organizations = append(period.Organizations, ScopeUsage{
+				Name:    orgName(guid),
+				AIHours: roundHours(totals.OrgAIHours[guid]),
+				PeakAIs: totals.OrgPeaks[guid],
+			})
+		}
+		for _, guid := range unionKeys(totals.SpaceAIHours, totals.SpacePeaks) {
+			space := t.Spaces[guid]
+			name := space.Name
+			if name == "" {
+				name = guid
+			}
+			period.Spaces = append(period.Spaces, ScopeUsage{
+				Name:    name,
+				Org:     orgName(space.OrgGUID),
+				AIHours: roundHours(totals.SpaceAIHours[guid]),
+				PeakAIs: totals.SpacePeaks[guid],
+			})
+		}
+
+		sort.Slice(period.Organizations, func(i, j int) bool {
+			return period.Organizations[i].Name < period.Organizations[j].Name
+		})
+		sort.Slice(period.Spaces, func(i, j int) bool {
+			a, b := period.Spaces[i], period.Spaces[j]
+			return a.Org < b.Org || (a.Org == b.Org && a.Name < b.Name)
+		})
+		usage.Periods = append(usage.Periods, period)
+	}
+
+	sort.Slice(usage.Periods, func(i, j int) bool {
+		return usage.Periods[i].Period < usage.Periods[j].Period
+	})
+	return usage
+}
+
+// collectAppUsageEvents ingests new app usage events and returns the AI
+// accounting per billing period. The first run baselines from the processes
+// running now; later runs resume after the last processed event. When that
+// event is gone the tracker baselines again, keeping the accrued periods.
+func collectAppUsageEvents(ctx context.Context, source UsageSource, orgs []Organization, config *Config) (*EventUsage, error) {
+	now := source.currentTime().UTC()
+
+	orgNames := make(map[string]string)
+	skipOrgs := make(map[string]bool)
+	for _, org := range orgs {
+		orgNames[org.GUID] = org.Name
+		if shouldSkipOrg(org.Name, config.SkipOrgs) {
+			skipOrgs[org.GUID] = true
+		}
+	}
+
+	t := source.trackers().app
+	if t == nil && config.StateDir != "" {
+		loaded, err := loadAppUsageTracker(config.StateDir)
+		if err != nil {
+			return nil, err
+		}
+		t = loaded
+	}
+
+	rebaseline := t == nil
+	if t != nil {
+		t.recount(skipOrgs)
+		events, err := source.getAppUsageEvents(ctx, t.LastEventGUID)
+		switch {
+		case isEventGap(err):
+			log.Printf("App usage events after %s are no longer available, re-baselining; usage since the last collection is not accounted: %v", t.LastEventGUID, err)
+			t.Processes = make(map[string]*trackedProcess)
+			rebaseline = true
+		case err != nil:
+			return nil, err
+		default:
+			for _, event := range events {
+				t.apply(event)
+			}
+			if config.Verbose {
+				log.Printf("App usage events: processed %d new events", len(events))
+			}
+		}
+	}
+
+	if rebaseline {
+		// Take the newest event first so nothing between it and the process listing is missed
+		latest, err := source.getLatestEventGUID(ctx, "/v3/app_usage_events")
+		if err != nil {
+			return nil, err
+		}
+		spaces, err := source.getSpaces(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get spaces: %w", err)
+		}
+		apps, err := source.getApps(ctx, "STARTED")
+		if err != nil {
+			return nil, fmt.Errorf("failed to get apps: %w", err)
+		}
+		processes, err := source.getProcesses(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get processes: %w", err)
+		}
+
+		if t == nil {
+			t = newAppUsageTracker(now)
+		}
+		t.recount(skipOrgs)
+		t.baseline(now, spaces, apps, processes)
+		t.LastEventGUID = latest
+		log.Printf("App usage events: baselined %d running processes", len(t.Processes))
+	}
+
+	t.advance(now)
+	source.trackers().app = t
+
+	if config.StateDir != "" {
+		if err := t.save(config.StateDir); err != nil {
+			log.Printf("Failed to save app usage event state: %v", err)
+		}
+	}
+
+	return t.report(orgNames), nil
+}
+
+// isEventGap reports whether err means the events after the last processed
+// one cannot be listed: the CC rejects an after_guid it no longer knows, once
+// the event has been purged by retention or the events have been reset
+func isEventGap(err error) bool {
+	var status *apiStatusError
+	if !errors.As(err, &status) {
+		return false
+	}
+	switch status.status {
+	case http.StatusBadRequest, http.StatusNotFound, http.StatusUnprocessableEntity:
+		return true
+	}
+	return false
+}
+
+// periodKey returns the billing period (YYYY-MM) containing t
+func periodKey(t time.Time) string {
+	return t.UTC().Format("2006-01")
+}
+
+// periodStart returns the first instant of the billing period containing t
+func periodStart(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
+
+// roundHours rounds to hundredths of an hour for reporting
+func roundHours(hours float64) float64 {
+	return math.Round(hours*100) / 100
+}
+
+// unionKeys returns the keys present in either map
+func unionKeys(hours map[string]float64, peaks map[string]int) []string {
+	seen := make(map[string]bool)
+	var keys []string
+	for k := range hours {
+		if !seen[k] {
+			seen[k] = true
+			keys = append(keys, k)
+		}
+	}
+	for k := range peaks {
+		if !seen[k] {
+			seen[k] = true
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+// guidFromHref returns the last path segment of a resource link
+func guidFromHref(href string) string {
+	return href[strings.LastIndex(href, "/")+1:]
+}
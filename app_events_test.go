@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// appEvent builds an app usage event for process guid of org "org-a", space "space-a"
+func appEvent(guid, state string, instances int, at time.Time) AppUsageEvent {
+	var event AppUsageEvent
+	event.GUID = guid + "-" + at.Format(time.RFC3339)
+	event.CreatedAt = at
+	event.State.Current = state
+	event.InstanceCount.Current = instances
+	event.App.GUID = guid
+	event.Process.GUID = guid
+	event.Space.GUID = "space-a"
+	event.Space.Name = "a"
+	event.Organization.GUID = "org-a"
+	return event
+}
+
+func TestAppUsageTrackerApply(t *testing.T) {
+	day := time.Date(2025, 1, 10, 0, 0, 0, 0, time.UTC)
+	tr := newAppUsageTracker(day)
+
+	tr.apply(appEvent("web", "STARTED", 2, day))
+	tr.apply(appEvent("web", "STARTED", 4, day.Add(12*time.Hour))) // scale up
+	tr.apply(appEvent("web", "STARTED", 1, day.Add(18*time.Hour))) // scale down
+	tr.apply(appEvent("web", "STOPPED", 0, day.Add(24*time.Hour)))
+	tr.apply(appEvent("web", "BUILDPACK_SET", 0, day.Add(25*time.Hour)))
+	tr.advance(day.Add(48 * time.Hour))
+
+	if len(tr.Processes) != 0 {
+		t.Errorf("%d processes still tracked after STOPPED", len(tr.Processes))
+	}
+	totals := tr.Periods["2025-01"]
+	if want := 2*12.0 + 4*6 + 1*6; totals.AIHours != want {
+		t.Errorf("AI-hours %.2f, want %.2f", totals.AIHours, want)
+	}
+	if totals.PeakAIs != 4 || totals.OrgPeaks["org-a"] != 4 || totals.SpacePeaks["space-a"] != 4 {
+		t.Errorf("peaks %d, org %d, space %d, want 4", totals.PeakAIs, totals.OrgPeaks["org-a"], totals.SpacePeaks["space-a"])
+	}
+}
+
+func TestAppUsageTrackerBillablePeaks(t *testing.T) {
+	day := time.Date(2025, 1, 10, 0, 0, 0, 0, time.UTC)
+	tr := newAppUsageTracker(day)
+	tr.recount(map[string]bool{"org-system": true})
+
+	system := appEvent("autoscaler", "STARTED", 3, day)
+	system.Organization.GUID = "org-system"
+	tr.apply(system)
+	tr.apply(appEvent("web", "STARTED", 2, day.Add(time.Hour)))
+	tr.advance(day.Add(2 * time.Hour))
+
+	totals := tr.Periods["2025-01"]
+	if totals.PeakAIs != 5 || totals.BillablePeakAIs != 2 {
+		t.Errorf("peak %d, billable peak %d; want 5 and 2", totals.PeakAIs, totals.BillablePeakAIs)
+	}
+}
+
+func TestAppUsageTrackerSkipListChange(t *testing.T) {
+	day := time.Date(2025, 1, 10, 0, 0, 0, 0, time.UTC)
+	tr := newAppUsageTracker(day)
+	tr.apply(appEvent("web", "STARTED", 2, day))
+	tr.advance(day.Add(10 * time.Hour))
+
+	// org-a is skipped from now on; its earlier hours stay billable
+	tr.recount(map[string]bool{"org-a": true})
+	tr.advance(day.Add(20 * time.Hour))
+
+	period := tr.report(nil).Periods[0]
+	if period.AIHours != 40 || period.BillableAIHours != 20 {
+		t.Errorf("AI-hours %.2f (billable %.2f), want 40 (billable 20)", period.AIHours, period.BillableAIHours)
+	}
+	if period.BillablePeakAIs != 2 {
+		t.Errorf("billable peak %d, want 2 from before org-a was skipped", period.BillablePeakAIs)
+	}
+}
+
+func TestAppUsageTrackerPeriodSplit(t *testing.T) {
+	start := time.Date(2025, 1, 31, 18, 0, 0, 0, time.UTC)
+	tr := newAppUsageTracker(start)
+	tr.apply(appEvent("web", "STARTED", 2, start))
+	tr.advance(start.Add(12 * time.Hour))
+
+	for period, want := range map[string]float64{"2025-01": 12, "2025-02": 12} {
+		if got := tr.Periods[period].AIHours; got != want {
+			t.Errorf("%s AI-hours %.2f, want %.2f", period, got, want)
+		}
+	}
+}
+
+func TestAppUsageTrackerPeakSeeding(t *testing.T) {
+	start := time.Date(2025, 1, 20, 0, 0, 0, 0, time.UTC)
+	tr := newAppUsageTracker(start)
+	tr.apply(appEvent("web", "STARTED", 3, start))
+	tr.advance(start.Add(24 * time.Hour))
+
+	// The instances running when February starts are its first peak, even
+	// though February only sees a scale-down
+	tr.apply(appEvent("web", "STARTED", 1, time.Date(2025, 2, 3, 0, 0, 0, 0, time.UTC)))
+	tr.advance(time.Date(2025, 2, 4, 0, 0, 0, 0, time.UTC))
+
+	february := tr.Periods["2025-02"]
+	if february == nil {
+		t.Fatal("no February period")
+	}
+	if february.PeakAIs != 3 || february.OrgPeaks["org-a"] != 3 {
+		t.Errorf("February peak %d, org peak %d; want 3", february.PeakAIs, february.OrgPeaks["org-a"])
+	}
+	if want := 3*24.0*2 + 1*24; february.AIHours != want {
+		t.Errorf("February AI-hours %.2f, want %.2f", february.AIHours, want)
+	}
+}
+
+func TestCollectUsageEventsAfterPurgedEvent(t *testing.T) {
+	client, config := newFakeFoundation(t)
+	config.AppUsageEvents = true
+	config.ServiceUsageEvents = true
+	if _, err := collectUsageData(context.Background(), client, config); err != nil {
+		t.Fatalf("first collection: %v", err)
+	}
+
+	// Retention purged the events the trackers resume after
+	client.events.app.LastEventGUID = "purged-app-event"
+	client.events.service.LastEventGUID = "purged-service-event"
+	result, err := collectUsageData(context.Background(), client, config)
+	if err != nil {
+		t.Fatalf("second collection: %v", err)
+	}
+	if result.AppUsageEvents == nil || result.AppUsageEvents.LastEventGUID != "app-event-1" {
+		t.Errorf("app usage events %+v, want a new baseline after app-event-1", result.AppUsageEvents)
+	}
+	if result.ServiceUsageEvents == nil || result.ServiceUsageEvents.LastEventGUID != "service-event-1" {
+		t.Errorf("service usage events %+v, want a new baseline after service-event-1", result.ServiceUsageEvents)
+	}
+	if len(client.events.app.Processes) == 0 || len(client.events.service.Instances) == 0 {
+		t.Error("re-baselined trackers track nothing")
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// appUsageEndpoint returns the base URL of the app-usage service
+func (c *CFClient) appUsageEndpoint() string {
+	if c.appUsageURL != "" {
+		return c.appUsageURL
+	}
+	return strings.Replace(c.apiEndpoint, "api.", "app-usage.", 1)
+}
+
+// resolveAppUsageEndpoint determines the app-usage service URL. In order:
+// the configured endpoint, app-usage.<system domain> with the system domain
+// taken from the login or UAA link of the CC root document (which does not
+// link the app-usage service itself), and finally api.<domain> replaced by
+// app-usage.<domain>.
+func (c *CFClient) resolveAppUsageEndpoint(ctx context.Context, configured string) {
+	c.appUsageURL, c.appUsageSource = c.discoverAppUsageEndpoint(ctx, configured)
+	log.Printf("App-usage service: %s (%s)", c.appUsageURL, c.appUsageSource)
+}
+
+func (c *CFClient) discoverAppUsageEndpoint(ctx context.Context, configured string) (string, string) {
+	if configured != "" {
+		return strings.TrimSuffix(configured, "/"), "configured"
+	}
+
+	links, err := c.getRootLinks(ctx)
+	if err != nil {
+		log.Printf("App-usage service discovery failed: %v", err)
+	}
+	for _, name := range []string{"login", "uaa"} {
+		u, err := url.Parse(links[name])
+		if err != nil || u.Host == "" || net.ParseIP(u.Hostname()) != nil {
+			continue
+		}
+		if _, domain, ok := strings.Cut(u.Host, "."); ok {
+			return u.Scheme + "://app-usage." + domain, "system domain from " + name + " link in API root"
+		}
+	}
+
+	return strings.Replace(c.apiEndpoint, "api.", "app-usage.", 1), "derived from API endpoint"
+}
+
+// checkAppUsageService reports whether the app-usage service answers with a
+// valid system report
+func (c *CFClient) checkAppUsageService(ctx context.Context) error {
+	_, err := c.getAppUsageReport(ctx)
+	return err
+}
+
+// appUsageGet fetches path from the app-usage service and decodes the JSON
+// response into v
+func (c *CFClient) appUsageGet(ctx context.Context, path string, v any) error {
+	resp, err := c.authorizedGet(ctx, c.appUsageEndpoint()+path)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		if resp.StatusCode == 404 {
+			return fmt.Errorf("app-usage service not found (not deployed in this foundation)")
+		}
+		return fmt.Errorf("app usage request %s failed with status %d", path, resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		return fmt.Errorf("failed to parse app usage response %s: %w", path, err)
+	}
+	return nil
+}
+
+func (c *CFClient) getAppUsageReport(ctx context.Context) (*AppUsageReport, error) {
+	var report AppUsageReport
+	if err := c.appUsageGet(ctx, "/system_report/app_usages", &report); err != nil {
+		return nil, err
+	}
+	return &report, nil
+}
+
+func (c *CFClient) getServiceUsageReport(ctx context.Context) (*ServiceUsageReport, error) {
+	var report ServiceUsageReport
+	if err := c.appUsageGet(ctx, "/system_report/service_usages", &report); err != nil {
+		return nil, err
+	}
+	return &report, nil
+}
+
+// getOrgAppUsages returns the app usage of an org between start and end (dates, inclusive)
+func (c *CFClient) getOrgAppUsages(ctx context.Context, orgGUID string, start, end time.Time) (*OrgAppUsages, error) {
+	var usages OrgAppUsages
+	path := fmt.Sprintf("/organizations/%s/app_usages?start=%s&end=%s", orgGUID, start.Format(time.DateOnly), end.Format(time.DateOnly))
+	if err := c.appUsageGet(ctx, path, &usages); err != nil {
+		return nil, err
+	}
+	return &usages, nil
+}
+
+// getOrgServiceUsages returns the service usage of an org between start and end (dates, inclusive)
+func (c *CFClient) getOrgServiceUsages(ctx context.Context, orgGUID string, start, end time.Time) (*OrgServiceUsages, error) {
+	var usages OrgServiceUsages
+	path := fmt.Sprintf("/organizations/%s/service_usages?start=%s&end=%s", orgGUID, start.Format(time.DateOnly), end.Format(time.DateOnly))
+	if err := c.appUsageGet(ctx, path, &usages); err != nil {
+		return nil, err
+	}
+	return &usages, nil
+}
+
+// collectAppUsageService gathers the monthly and yearly history from the
+// app-usage service, the per-service report and, when enabled, the current
+// month's usage per org
+func collectAppUsageService(ctx context.Context, source UsageSource, orgs []Organization, config *Config) (*AppUsageServiceReport, error) {
+	appReport, err := source.getAppUsageReport(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &AppUsageServiceReport{
+		ReportTime: appReport.ReportTime,
+		Monthly:    appReport.MonthlyReports,
+		Yearly:     appReport.YearlyReports,
+	}
+
+	// The service report is a separate endpoint; older app-usage releases lack it
+	if services, err := source.getServiceUsageReport(ctx); err != nil {
+		log.Printf("Service usage report not available: %v", err)
+	} else {
+		report.Services = services
+	}
+
+	if !config.AppUsageOrgReports {
+		return report, nil
+	}
+
+	now := source.currentTime().UTC()
+	start := periodStart(now)
+	for _, org := range orgs {
+		summary := OrgAppUsageSummary{
+			Name:  org.Name,
+			Year:  start.Year(),
+			Month: int(start.Month()),
+		}
+
+		appUsages, err := source.getOrgAppUsages(ctx, org.GUID, start, now)
+		if err != nil {
+			log.Printf("Failed to get app usage for org %s: %v", org.Name, err)
+			continue
+		}
+		for _, usage := range appUsages.AppUsages {
+			summary.AppInstanceHours += float64(usage.InstanceCount) * usage.DurationInSeconds / 3600
+		}
+
+		serviceUsages, err := source.getOrgServiceUsages(ctx, org.GUID, start, now)
+		if err != nil {
+			log.Printf("Failed to get service usage for org %s: %v", org.Name, err)
+			continue
+		}
+		for _, usage := range serviceUsages.ServiceUsages {
+			summary.ServiceInstanceHours += usage.DurationInSeconds / 3600
+		}
+
+		summary.AppInstanceHours = roundHours(summary.AppInstanceHours)
+		summary.ServiceInstanceHours = roundHours(summary.ServiceInstanceHours)
+		report.Organizations = append(report.Organizations, summary)
+	}
+
+	return report, nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// rootDocument answers every request with the given CC root document
+type rootDocument struct {
+	status int
+	body   string
+}
+
+func (d rootDocument) RoundTrip(r *http.Request) (*http.Response, error) {
+	return &http.Response{
+		StatusCode: d.status,
+		Header:     http.Header{"Content-Type": {"application/json"}},
+		Body:       io.NopCloser(strings.NewReader(d.body)),
+		Request:    r,
+	}, nil
+}
+
+func TestDiscoverAppUsageEndpoint(t *testing.T) {
+	tests := []struct {
+		name       string
+		configured string
+		root       rootDocument
+		want       string
+		wantSource string
+	}{
+		{
+			name:       "configured endpoint first",
+			configured: "https://usage.example.com/",
+			root:       rootDocument{200, `{"links":{"login":{"href":"https://login.sys.example.com"}}}`},
+			want:       "https://usage.example.com", wantSource: "configured",
+		},
+		{
+			name: "system domain from login link",
+			root: rootDocument{200, `{"links":{"login":{"href":"https://login.sys.example.com"},"uaa":{"href":"https://uaa.other.example.com"}}}`},
+			want: "https://app-usage.sys.example.com", wantSource: "system domain from login link in API root",
+		},
+		{
+			name: "system domain from uaa link",
+			root: rootDocument{200, `{"links":{"login":null,"uaa":{"href":"https://uaa.sys.example.com"}}}`},
+			want: "https://app-usage.sys.example.com", wantSource: "system domain from uaa link in API root",
+		},
+		{
+			name: "links to IP addresses carry no domain",
+			root: rootDocument{200, `{"links":{"login":{"href":"https://10.0.0.5:8443"},"uaa":{"href":"https://10.0.0.6"}}}`},
+			want: "https://app-usage.apps.example.com", wantSource: "derived from API endpoint",
+		},
+		{
+			name: "root without links",
+			root: rootDocument{200, `{"links":{}}`},
+			want: "https://app-usage.apps.example.com", wantSource: "derived from API endpoint",
+		},
+		{
+			name: "root unavailable",
+			root: rootDocument{503, `{}`},
+			want: "https://app-usage.apps.example.com", wantSource: "derived from API endpoint",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &CFClient{
+				apiEndpoint: "https://api.apps.example.com",
+				httpClient:  &http.Client{Transport: tt.root},
+			}
+			got, source := client.discoverAppUsageEndpoint(context.Background(), tt.configured)
+			if got != tt.want || source != tt.wantSource {
+				t.Errorf("got %s (%s), want %s (%s)", got, source, tt.want, tt.wantSource)
+			}
+		})
+	}
+}
@@ -0,0 +1,619 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Build information, set at build time with
+// -ldflags "-X main.version=... -X main.commit=... -X main.buildDate=..."
+var (
+	version   = "dev"
+	commit    = ""
+	buildDate = ""
+)
+
+// usageError reports invalid command line usage (exit status 2)
+type usageError struct {
+	err     error
+	printed bool // already written to stderr by the flag package
+}
+
+func (e *usageError) Error() string { return e.err.Error() }
+func (e *usageError) Unwrap() error { return e.err }
+
+// command is a CLI subcommand with its own flag set
+type command struct {
+	name    string
+	summary string
+	run     func(ctx context.Context, args []string) error
+}
+
+var commands []command
+
+func init() {
+	commands = []command{
+		{"report", "Collect usage data once and print it", runReportCommand},
+		{"serve", "Run as web server with Prometheus metrics endpoint", runServeCommand},
+		{"export", "Collect usage data once and write it as JSON or CSV", runExportCommand},
+		{"orphans", "List managed service instances without app bindings or service keys", runOrphansCommand},
+		{"quotas", "List orgs and spaces close to their quota limits", runQuotasCommand},
+		{"idle-apps", "List stopped apps and started apps without healthy instances", runIdleAppsCommand},
+		{"check", "Verify API connectivity, authentication and catalog access", runCheckCommand},
+		{"diff", "Compare two JSON usage reports", runDiffCommand},
+		{"config", "Show the effective configuration ('config print')", runConfigCommand},
+		{"version", "Print build information", runVersionCommand},
+	}
+}
+
+// runCommand dispatches to the named subcommand
+func runCommand(ctx context.Context, name string, args []string) error {
+	if name == "help" {
+		printUsage(os.Stdout)
+		return nil
+	}
+	for _, cmd := range commands {
+		if cmd.name == name {
+			return cmd.run(ctx, args)
+		}
+	}
+	printUsage(os.Stderr)
+	return &usageError{err: fmt.Errorf("unknown command %q", name)}
+}
+
+// printUsage writes the top-level help text
+func printUsage(w io.Writer) {
+	fmt.Fprintf(w, "Usage: tpcf-usage-service <command> [flags]\n\nCommands:\n")
+	for _, cmd := range commands {
+		fmt.Fprintf(w, "  %-10s %s\n", cmd.name, cmd.summary)
+	}
+	fmt.Fprintf(w, "\nRun 'tpcf-usage-service <command> -h' for command flags.\n")
+	fmt.Fprintf(w, "Running without a command uses the legacy flags (-server, -port, -json, ...).\n")
+}
+
+// newFlagSet creates a flag set for a subcommand with consistent help output
+func newFlagSet(name, summary string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: tpcf-usage-service %s [flags]\n\n%s\n\nFlags:\n", name, summary)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// parseCommandFlags parses args and rejects stray positional arguments
+func parseCommandFlags(fs *flag.FlagSet, args []string, maxArgs int) error {
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return err
+		}
+		return &usageError{err: err, printed: true}
+	}
+	if fs.NArg() > maxArgs {
+		return &usageError{err: fmt.Errorf("%s: unexpected argument %q", fs.Name(), fs.Arg(maxArgs))}
+	}
+	return nil
+}
+
+// cliFlags holds the flags shared across commands. Only flags that were set
+// explicitly override the environment and config file.
+type cliFlags struct {
+	fs             *flag.FlagSet
+	configFile     string
+	caCert         string
+	clientCert     string
+	clientKey      string
+	minTLSVersion  string
+	skipOrgs       string
+	recordDir      string
+	replayDir      string
+	verbose        bool
+	jsonOutput     bool
+	server         bool
+	port           int
+	refreshMinutes int
+	timeout        time.Duration
+}
+
+func newCLIFlags(fs *flag.FlagSet) *cliFlags {
+	f := &cliFlags{fs: fs}
+	fs.StringVar(&f.configFile, "config", "", "Path to YAML config file (env: TPCF_CONFIG)")
+	return f
+}
+
+// addCollectionFlags registers the flags shared by every command that collects data
+func (f *cliFlags) addCollectionFlags() {
+	f.fs.StringVar(&f.skipOrgs, "skip-orgs", "system", "Comma-separated list of orgs to skip")
+	f.fs.BoolVar(&f.verbose, "verbose", false, "Enable verbose output")
+	f.fs.StringVar(&f.recordDir, "record", "", "Record all CF API and app-usage responses (tokens scrubbed) to this directory")
+	f.fs.StringVar(&f.replayDir, "replay", "", "Serve CF API and app-usage responses from a directory written by --record instead of a foundation")
+	f.fs.DurationVar(&f.timeout, "collection-timeout", 10*time.Minute, "Abort a collection run after this long, 0 for no limit (env: TPCF_COLLECTION_TIMEOUT)")
+	f.addTLSFlags()
+}
+
+// addTLSFlags registers the flags for connecting to the CF API over TLS
+func (f *cliFlags) addTLSFlags() {
+	f.fs.StringVar(&f.caCert, "ca-cert", "", "CA certificate bundle (file or PEM) to trust for CF API and UAA connections (env: CF_CA_CERT)")
+	f.fs.StringVar(&f.clientCert, "client-cert", "", "Client certificate (file or PEM) for mutual TLS (env: CF_CLIENT_CERT)")
+	f.fs.StringVar(&f.clientKey, "client-key", "", "Client private key (file or PEM) for mutual TLS (env: CF_CLIENT_KEY)")
+	f.fs.StringVar(&f.minTLSVersion, "min-tls-version", "", "Minimum TLS version: 1.2 or 1.3 (env: CF_MIN_TLS_VERSION)")
+}
+
+// addServerFlags registers the web server flags
+func (f *cliFlags) addServerFlags() {
+	f.fs.IntVar(&f.port, "port", 8080, "Port to run web server on")
+	f.fs.IntVar(&f.refreshMinutes, "refresh-interval", 60, "Data refresh interval in minutes")
+}
+
+// addJSONFlag registers the JSON output flag
+func (f *cliFlags) addJSONFlag() {
+	f.fs.BoolVar(&f.jsonOutput, "json", false, "Output results as JSON")
+}
+
+// apply copies explicitly set flags into config
+func (f *cliFlags) apply(config *Config) {
+	f.fs.Visit(func(fl *flag.Flag) {
+		switch fl.Name {
+		case "ca-cert":
+			config.CACert = f.caCert
+		case "client-cert":
+			config.ClientCert = f.clientCert
+		case "client-key":
+			config.ClientKey = f.clientKey
+		case "min-tls-version":
+			config.MinTLSVersion = f.minTLSVersion
+		case "skip-orgs":
+			config.SkipOrgs = splitList(f.skipOrgs)
+		case "record":
+			config.RecordDir = f.recordDir
+		case "replay":
+			config.ReplayDir = f.replayDir
+		case "collection-timeout":
+			config.CollectionTimeout = f.timeout
+		case "verbose":
+			config.Verbose = f.verbose
+		case "json":
+			config.JSONOutput = f.jsonOutput
+		case "server":
+			config.ServerMode = f.server
+		case "port":
+			config.Port = f.port
+		case "refresh-interval":
+			config.RefreshInterval = time.Duration(f.refreshMinutes) * time.Minute
+		}
+	})
+}
+
+func runReportCommand(ctx context.Context, args []string) error {
+	fs := newFlagSet("report", "Collect usage data once and print it.")
+	flags := newCLIFlags(fs)
+	flags.addCollectionFlags()
+	flags.addJSONFlag()
+	if err := parseCommandFlags(fs, args, 0); err != nil {
+		return err
+	}
+	config, err := loadConfig(flags)
+	if err != nil {
+		return err
+	}
+
+	client, err := setupClient(ctx, config)
+	if err != nil {
+		return err
+	}
+	return report(ctx, client, config)
+}
+
+// report collects usage data once and prints it
+func report(ctx context.Context, client *CFClient, config *Config) error {
+	result, err := collectUsageData(ctx, client, config)
+	if err != nil {
+		return fmt.Errorf("failed to collect usage data: %w", err)
+	}
+
+	if config.JSONOutput {
+		return writeJSON(os.Stdout, result)
+	}
+	printReport(os.Stdout, result, config)
+	return nil
+}
+
+func runServeCommand(ctx context.Context, args []string) error {
+	fs := newFlagSet("serve", "Run as web server with Prometheus metrics endpoint.")
+	flags := newCLIFlags(fs)
+	flags.addCollectionFlags()
+	flags.addServerFlags()
+	if err := parseCommandFlags(fs, args, 0); err != nil {
+		return err
+	}
+	config, err := loadConfig(flags)
+	if err != nil {
+		return err
+	}
+	config.ServerMode = true
+
+	client, err := setupClient(ctx, config)
+	if err != nil {
+		return err
+	}
+	runServer(ctx, client, config, func() (*Config, error) { return loadConfig(flags) })
+	return nil
+}
+
+func runExportCommand(ctx context.Context, args []string) error {
+	var format, output string
+	fs := newFlagSet("export", "Collect usage data once and write it as JSON or CSV.")
+	flags := newCLIFlags(fs)
+	flags.addCollectionFlags()
+	fs.StringVar(&format, "format", "json", "Output format: json or csv")
+	fs.StringVar(&output, "output", "-", "File to write to ('-' for stdout)")
+	if err := parseCommandFlags(fs, args, 0); err != nil {
+		return err
+	}
+	if format != "json" && format != "csv" {
+		return &usageError{err: fmt.Errorf("export: unsupported -format %q (want json or csv)", format)}
+	}
+	config, err := loadConfig(flags)
+	if err != nil {
+		return err
+	}
+
+	client, err := setupClient(ctx, config)
+	if err != nil {
+		return err
+	}
+	result, err := collectUsageData(ctx, client, config)
+	if err != nil {
+		return fmt.Errorf("failed to collect usage data: %w", err)
+	}
+
+	w := io.Writer(os.Stdout)
+	if output != "-" {
+		f, err := os.Create(output)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+
+	if format == "csv" {
+		return writeCSV(w, result)
+	}
+	return writeJSON(w, result)
+}
+
+// writeJSON writes the usage result as indented JSON
+func writeJSON(w io.Writer, v any) error {
+	output, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal JSON: %w", err)
+	}
+	_, err = fmt.Fprintln(w, string(output))
+	return err
+}
+
+// writeCSV writes one row per organization followed by a totals row
+func writeCSV(w io.Writer, result *UsageResult) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"org", "ais", "sis", "billable_sis"})
+	for _, org := range result.Organizations {
+		cw.Write([]string{org.Name, strconv.Itoa(org.AIs), strconv.Itoa(org.SIs), strconv.Itoa(org.BillableSIs)})
+	}
+	cw.Write([]string{"TOTAL", strconv.Itoa(result.TotalAIs), strconv.Itoa(result.TotalSIs), strconv.Itoa(result.TotalBillableSIs)})
+	cw.Flush()
+	return cw.Error()
+}
+
+func runOrphansCommand(ctx context.Context, args []string) error {
+	var minAgeDays int
+	fs := newFlagSet("orphans", "List managed service instances without app bindings or service keys.")
+	flags := newCLIFlags(fs)
+	flags.addCollectionFlags()
+	flags.addJSONFlag()
+	fs.IntVar(&minAgeDays, "min-age-days", 0, "Only list instances created at least this many days ago")
+	if err := parseCommandFlags(fs, args, 0); err != nil {
+		return err
+	}
+	config, err := loadConfig(flags)
+	if err != nil {
+		return err
+	}
+
+	client, err := setupClient(ctx, config)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := withCollectionTimeout(ctx, config)
+	defer cancel()
+	result, listings, err := collectSnapshot(ctx, client, config)
+	if err != nil {
+		return fmt.Errorf("failed to collect service instances: %w", err)
+	}
+	if listings.bindingsErr != nil {
+		return fmt.Errorf("failed to detect orphaned service instances: %w", listings.bindingsErr)
+	}
+
+	orphans := filterOrphans(result.OrphanedServiceInstances, minAgeDays)
+	if config.JSONOutput {
+		return writeJSON(os.Stdout, orphans)
+	}
+	printOrphans(os.Stdout, orphans)
+	return nil
+}
+
+func runQuotasCommand(ctx context.Context, args []string) error {
+	var threshold float64
+	fs := newFlagSet("quotas", "List orgs and spaces close to their quota limits.")
+	flags := newCLIFlags(fs)
+	flags.addCollectionFlags()
+	flags.addJSONFlag()
+	fs.Float64Var(&threshold, "threshold", defaultQuotaThreshold, "Only list quotas with a resource at or above this utilization percentage")
+	if err := parseCommandFlags(fs, args, 0); err != nil {
+		return err
+	}
+	config, err := loadConfig(flags)
+	if err != nil {
+		return err
+	}
+
+	client, err := setupClient(ctx, config)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := withCollectionTimeout(ctx, config)
+	defer cancel()
+	listings, err := listFoundation(ctx, client)
+	if err != nil {
+		return err
+	}
+	quotas, err := collectQuotaUsage(ctx, client, listings, listings.runningProcesses(), config)
+	if err != nil {
+		return err
+	}
+
+	quotas = filterQuotas(quotas, threshold)
+	if config.JSONOutput {
+		return writeJSON(os.Stdout, quotas)
+	}
+	printQuotas(os.Stdout, quotas)
+	return nil
+}
+
+func runIdleAppsCommand(ctx context.Context, args []string) error {
+	var minAgeDays int
+	fs := newFlagSet("idle-apps", "List stopped apps and started apps without healthy instances, with their bound service instances.")
+	flags := newCLIFlags(fs)
+	flags.addCollectionFlags()
+	flags.addJSONFlag()
+	fs.IntVar(&minAgeDays, "min-age-days", 0, "Only list apps last updated at least this many days ago")
+	if err := parseCommandFlags(fs, args, 0); err != nil {
+		return err
+	}
+	config, err := loadConfig(flags)
+	if err != nil {
+		return err
+	}
+
+	client, err := setupClient(ctx, config)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := withCollectionTimeout(ctx, config)
+	defer cancel()
+	if err := client.loadCatalog(ctx, client); err != nil {
+		return err
+	}
+	listings, err := listFoundation(ctx, client)
+	if err != nil {
+		return err
+	}
+	apps, err := collectIdleApps(ctx, client, listings, config, client.now())
+	if err != nil {
+		return err
+	}
+
+	apps = filterIdleApps(apps, minAgeDays)
+	if config.JSONOutput {
+		return writeJSON(os.Stdout, apps)
+	}
+	printIdleApps(os.Stdout, apps)
+	return nil
+}
+
+func runCheckCommand(ctx context.Context, args []string) error {
+	fs := newFlagSet("check", "Verify API connectivity, authentication and catalog access.")
+	flags := newCLIFlags(fs)
+	fs.BoolVar(&flags.verbose, "verbose", false, "Enable verbose output")
+	flags.addTLSFlags()
+	if err := parseCommandFlags(fs, args, 0); err != nil {
+		return err
+	}
+	config, err := loadConfig(flags)
+	if err != nil {
+		return err
+	}
+
+	client, err := setupClient(ctx, config)
+	if err != nil {
+		return err
+	}
+	if err := client.loadCatalog(ctx, client); err != nil {
+		return err
+	}
+	fmt.Printf("API endpoint:      %s\n", client.apiEndpoint)
+	fmt.Printf("Authentication:    OK\n")
+	fmt.Printf("Service plans:     %d\n", len(client.servicePlans))
+	fmt.Printf("Service offerings: %d\n", len(client.serviceOfferings))
+
+	orgs, err := client.getOrganizations(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list organizations: %w", err)
+	}
+	fmt.Printf("Organizations:     %d\n", len(orgs))
+
+	fmt.Printf("App usage URL:     %s (%s)\n", client.appUsageEndpoint(), client.appUsageSource)
+	if err := client.checkAppUsageService(ctx); err != nil {
+		fmt.Printf("App usage service: unavailable (%v)\n", err)
+	} else {
+		fmt.Printf("App usage service: OK\n")
+	}
+	return nil
+}
+
+// UsageDiff describes the change between two usage reports
+type UsageDiff struct {
+	Organizations    []OrgUsageDiff `json:"organizations"`
+	TotalAIs         int            `json:"total_ais"`
+	TotalBillableAIs int            `json:"total_billable_ais"`
+	TotalSIs         int            `json:"total_sis"`
+	TotalBillableSIs int            `json:"total_billable_sis"`
+}
+
+type OrgUsageDiff struct {
+	Name        string `json:"name"`
+	AIs         int    `json:"ais"`
+	SIs         int    `json:"sis"`
+	BillableSIs int    `json:"billable_sis"`
+}
+
+func runDiffCommand(ctx context.Context, args []string) error {
+	var jsonOutput bool
+	fs := newFlagSet("diff", "Compare two JSON usage reports (as written by 'report -json' or 'export').\n\nUsage: tpcf-usage-service diff [flags] OLD.json NEW.json")
+	fs.BoolVar(&jsonOutput, "json", false, "Output the differences as JSON")
+	if err := parseCommandFlags(fs, args, 2); err != nil {
+		return err
+	}
+	if fs.NArg() != 2 {
+		return &usageError{err: fmt.Errorf("diff: expected two report files, got %d", fs.NArg())}
+	}
+
+	before, err := readUsageResult(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	after, err := readUsageResult(fs.Arg(1))
+	if err != nil {
+		return err
+	}
+
+	diff := diffUsage(before, after)
+	if jsonOutput {
+		return writeJSON(os.Stdout, diff)
+	}
+	for _, org := range diff.Organizations {
+		fmt.Printf("%s: AIs %+d, SIs %+d (Billable: %+d)\n", org.Name, org.AIs, org.SIs, org.BillableSIs)
+	}
+	fmt.Printf("Total AIs: %+d (Billable: %+d)\n", diff.TotalAIs, diff.TotalBillableAIs)
+	fmt.Printf("Total SIs: %+d (Billable: %+d)\n", diff.TotalSIs, diff.TotalBillableSIs)
+	return nil
+}
+
+// readUsageResult loads a JSON usage report from disk
+func readUsageResult(path string) (*UsageResult, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var result UsageResult
+	if err := json.Unmarshal(data, &result); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	return &result, nil
+}
+
+// diffUsage computes after - before, listing only orgs that changed
+func diffUsage(before, after *UsageResult) *UsageDiff {
+	orgs := make(map[string]*OrgUsageDiff)
+	for _, org := range after.Organizations {
+		orgs[org.Name] = &OrgUsageDiff{Name: org.Name, AIs: org.AIs, SIs: org.SIs, BillableSIs: org.BillableSIs}
+	}
+	for _, org := range before.Organizations {
+		d, ok := orgs[org.Name]
+		if !ok {
+			d = &OrgUsageDiff{Name: org.Name}
+			orgs[org.Name] = d
+		}
+		d.AIs -= org.AIs
+		d.SIs -= org.SIs
+		d.BillableSIs -= org.BillableSIs
+	}
+
+	diff := &UsageDiff{
+		Organizations:    []OrgUsageDiff{},
+		TotalAIs:         after.TotalAIs - before.TotalAIs,
+		TotalBillableAIs: after.TotalBillableAIs - before.TotalBillableAIs,
+		TotalSIs:         after.TotalSIs - before.TotalSIs,
+		TotalBillableSIs: after.TotalBillableSIs - before.TotalBillableSIs,
+	}
+	for _, d := range orgs {
+		if d.AIs != 0 || d.SIs != 0 || d.BillableSIs != 0 {
+			diff.Organizations = append(diff.Organizations, *d)
+		}
+	}
+	sort.Slice(diff.Organizations, func(i, j int) bool {
+		return diff.Organizations[i].Name < diff.Organizations[j].Name
+	})
+	return diff
+}
+
+func runVersionCommand(ctx context.Context, args []string) error {
+	fs := newFlagSet("version", "Print build information.")
+	if err := parseCommandFlags(fs, args, 0); err != nil {
+		return err
+	}
+
+	rev, date := commit, buildDate
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range info.Settings {
+			switch {
+			case setting.Key == "vcs.revision" && rev == "":
+				rev = setting.Value
+			case setting.Key == "vcs.time" && date == "":
+				date = setting.Value
+			}
+		}
+	}
+	if rev == "" {
+		rev = "unknown"
+	}
+	if date == "" {
+		date = "unknown"
+	}
+
+	fmt.Printf("tpcf-usage-service %s\n", version)
+	fmt.Printf("  commit:     %s\n", rev)
+	fmt.Printf("  built:      %s\n", date)
+	fmt.Printf("  go version: %s %s/%s\n", runtime.Version(), runtime.GOOS, runtime.GOARCH)
+	return nil
+}
+
+func runConfigCommand(ctx context.Context, args []string) error {
+	if len(args) == 0 || args[0] != "print" {
+		return &usageError{err: fmt.Errorf("config: expected subcommand 'print'")}
+	}
+
+	fs := newFlagSet("config print", "Print the effective configuration (flags > env > config file > defaults) with secrets redacted.")
+	flags := newCLIFlags(fs)
+	flags.addCollectionFlags()
+	flags.addServerFlags()
+	flags.addJSONFlag()
+	if err := parseCommandFlags(fs, args[1:], 0); err != nil {
+		return err
+	}
+	config, err := loadConfig(flags)
+	if err != nil {
+		return err
+	}
+	return printConfig(os.Stdout, config)
+}
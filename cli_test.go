@@ -0,0 +1,49 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDiffUsage(t *testing.T) {
+	tests := []struct {
+		name   string
+		before UsageResult
+		after  UsageResult
+		want   UsageDiff
+	}{
+		{
+			name:   "no change",
+			before: UsageResult{Organizations: []OrgUsage{{Name: "dev", AIs: 3, SIs: 2}}, TotalAIs: 3, TotalSIs: 2},
+			after:  UsageResult{Organizations: []OrgUsage{{Name: "dev", AIs: 3, SIs: 2}}, TotalAIs: 3, TotalSIs: 2},
+			want:   UsageDiff{Organizations: []OrgUsageDiff{}},
+		},
+		{
+			name: "changed, added and removed orgs",
+			before: UsageResult{
+				Organizations: []OrgUsage{{Name: "prod", AIs: 8, SIs: 3, BillableSIs: 2}, {Name: "dev", AIs: 3, SIs: 3, BillableSIs: 1}, {Name: "old", AIs: 2, SIs: 1}},
+				TotalAIs:      13, TotalBillableAIs: 11, TotalSIs: 7, TotalBillableSIs: 3,
+			},
+			after: UsageResult{
+				Organizations: []OrgUsage{{Name: "prod", AIs: 10, SIs: 3, BillableSIs: 3}, {Name: "dev", AIs: 3, SIs: 3, BillableSIs: 1}, {Name: "new", AIs: 1}},
+				TotalAIs:      14, TotalBillableAIs: 14, TotalSIs: 6, TotalBillableSIs: 4,
+			},
+			want: UsageDiff{
+				Organizations: []OrgUsageDiff{
+					{Name: "new", AIs: 1},
+					{Name: "old", AIs: -2, SIs: -1},
+					{Name: "prod", AIs: 2, BillableSIs: 1},
+				},
+				TotalAIs: 1, TotalBillableAIs: 3, TotalSIs: -1, TotalBillableSIs: 1,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := diffUsage(&tt.before, &tt.after)
+			if !reflect.DeepEqual(*got, tt.want) {
+				t.Errorf("diffUsage = %+v, want %+v", *got, tt.want)
+			}
+		})
+	}
+}
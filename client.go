@@ -1,7 +1,7 @@
 package main
 
 import (
-	"crypto/tls"
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
@@ -9,120 +9,213 @@ import (
 	"log"
 	"net/http"
 	"net/url"
-	"os"
+	"sort"
 	"strings"
 	"time"
 )
 
 // NewCFClient creates a new CF client with authentication
-func NewCFClient() (*CFClient, error) {
+func NewCFClient(ctx context.Context, config *Config) (*CFClient, error) {
 	// Check for SSL verification skip
-	skipSSLVerification := os.Getenv("CF_SKIP_SSL_VALIDATION") == "true"
-	
-	// Configure HTTP client with optional SSL skip
+	skipSSLVerification := config.SkipSSLValidation
+
+	// Configure HTTP client with custom CAs, client certificate and optional SSL skip
+	tlsConfig, err := newTLSConfig(config)
+	if err != nil {
+		return nil, err
+	}
 	httpClient := &http.Client{
 		Transport: &http.Transport{
-			TLSClientConfig: &tls.Config{
-				InsecureSkipVerify: skipSSLVerification,
-			},
+			TLSClientConfig: tlsConfig,
 		},
 	}
-	
+
 	if skipSSLVerification {
 		log.Printf("WARNING: SSL certificate verification is disabled")
 	}
-	
+	if (config.AppUsageEvents || config.ServiceUsageEvents) && config.StateDir == "" && config.ReplayDir == "" {
+		log.Printf("WARNING: usage event tracking is enabled without a state directory (TPCF_STATE_DIR); a restart discards the AI-hours and SI-days tracked so far")
+	}
+
 	client := &CFClient{
-		httpClient:       httpClient,
-		servicePlans:     make(map[string]ServicePlan),
-		serviceOfferings: make(map[string]ServiceOffering),
-	}
-	
-	// Check for environment variables for direct API access
-	apiEndpoint := os.Getenv("CF_API_ENDPOINT")
-	username := os.Getenv("CF_USERNAME")
-	password := os.Getenv("CF_PASSWORD")
-	
-	if apiEndpoint != "" && username != "" && password != "" {
-		if err := client.authenticateWithCredentials(apiEndpoint, username, password); err != nil {
+		httpClient: httpClient,
+		serviceCatalog: serviceCatalog{
+			servicePlans:     make(map[string]ServicePlan),
+			serviceOfferings: make(map[string]ServiceOffering),
+			serviceBrokers:   make(map[string]ServiceBroker),
+		},
+		clientID:         config.ClientID,
+		credentials:      newCredentials(config),
+		allowGuessedAuth: config.AllowGuessedAuthEndpoints,
+		now:              time.Now,
+	}
+	client.setBillableOfferings(config.BillableOfferings)
+
+	// A bundle holds a single collection recorded at a frozen time; a server
+	// would keep recording with a stale clock
+	if config.RecordDir != "" && config.ServerMode {
+		return nil, fmt.Errorf("recording is not supported in server mode; record a single report or export instead")
+	}
+
+	// A recorded bundle replaces the foundation; no credentials are needed
+	if config.ReplayDir != "" {
+		if err := client.setupReplay(config.ReplayDir); err != nil {
+			return nil, err
+		}
+		return client, nil
+	}
+
+	// Credentials for direct API access (flags, environment, secret files, service binding or config file)
+	if config.APIEndpoint != "" && client.credentials.configured() {
+		client.apiEndpoint = strings.TrimSuffix(config.APIEndpoint, "/")
+		if err := client.authenticate(ctx); err != nil {
 			return nil, fmt.Errorf("failed to authenticate with CF API: %w", err)
 		}
-		log.Printf("Using environment variable credentials with direct API calls")
+		log.Printf("Using configured credentials with direct API calls")
+		client.resolveAppUsageEndpoint(ctx, config.AppUsageEndpoint)
+
+		if config.RecordDir != "" {
+			// The report is computed at the recording time, as it will be on replay
+			recordedAt := client.now().UTC()
+			client.now = func() time.Time { return recordedAt }
+			client.recorder, err = newRecorder(config.RecordDir, bundle{
+				RecordedAt:       recordedAt,
+				APIEndpoint:      client.apiEndpoint,
+				AppUsageEndpoint: client.appUsageEndpoint(),
+				Version:          version,
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
 	} else {
-		return nil, fmt.Errorf("CF_API_ENDPOINT, CF_USERNAME, and CF_PASSWORD environment variables are required")
+		return nil, fmt.Errorf("API endpoint, username and password are required (CF_API_ENDPOINT, CF_USERNAME and CF_PASSWORD, *_FILE secrets, a bound credentials service or the config file)")
 	}
-	
+
 	return client, nil
 }
 
 // Authentication methods
-func (c *CFClient) discoverAuthEndpoint(apiEndpoint string) (string, error) {
-	infoURL := apiEndpoint + "/v2/info"
-	
-	req, err := http.NewRequest("GET", infoURL, nil)
+
+// discoverAuthEndpoint finds the OAuth token endpoint from the uaa (or login)
+// link of the v3 root document, falling back to the deprecated /v2/info
+func (c *CFClient) discoverAuthEndpoint(ctx context.Context) (string, error) {
+	links, err := c.getRootLinks(ctx)
+	if err == nil {
+		for _, name := range []string{"uaa", "login"} {
+			if href := links[name]; href != "" {
+				tokenEndpoint := href + "/oauth/token"
+				log.Printf("Discovered OAuth token endpoint from %s link: %s", name, tokenEndpoint)
+				return tokenEndpoint, nil
+			}
+		}
+		err = fmt.Errorf("no uaa or login link in API root")
+	}
+	log.Printf("OAuth endpoint discovery via API root failed: %v", err)
+
+	infoURL := c.apiEndpoint + "/v2/info"
+
+	req, err := http.NewRequestWithContext(ctx, "GET", infoURL, nil)
 	if err != nil {
 		return "", err
 	}
-	
+
 	req.Header.Set("Accept", "application/json")
-	
+
 	resp, err := c.httpClient.Do(req)
 	if err != nil {
 		return "", err
 	}
 	defer resp.Body.Close()
-	
+
 	if resp.StatusCode != http.StatusOK {
 		return "", fmt.Errorf("failed to get API info: status %d", resp.StatusCode)
 	}
-	
+
 	var info struct {
 		AuthorizationEndpoint string `json:"authorization_endpoint"`
 	}
-	
+
 	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
 		return "", err
 	}
-	
+
 	if info.AuthorizationEndpoint == "" {
 		return "", fmt.Errorf("no authorization endpoint found in API info")
 	}
-	
+
 	// Convert authorization endpoint to token endpoint
 	authEndpoint := strings.TrimSuffix(info.AuthorizationEndpoint, "/")
 	tokenEndpoint := authEndpoint + "/oauth/token"
-	
-	log.Printf("Discovered OAuth token endpoint: %s", tokenEndpoint)
+
+	log.Printf("Discovered OAuth token endpoint from /v2/info: %s", tokenEndpoint)
 	return tokenEndpoint, nil
 }
 
-func (c *CFClient) authenticateDirectly(tokenURL, username, password string) error {
-	// Standard CF client credentials - try the most common one first
-	clientID := "cf"
-	clientSecret := ""
-	
-	// Check for custom client credentials from environment
-	if envClientID := os.Getenv("CF_CLIENT_ID"); envClientID != "" {
-		clientID = envClientID
-		clientSecret = os.Getenv("CF_CLIENT_SECRET")
-		log.Printf("Using custom OAuth client credentials from environment")
+// getRootLinks returns the links of the CC API root document (GET /), which
+// needs no authentication
+func (c *CFClient) getRootLinks(ctx context.Context) (map[string]string, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", c.apiEndpoint+"/", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
 	}
-	
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to get API root: status %d", resp.StatusCode)
+	}
+
+	var root struct {
+		Links map[string]*struct {
+			Href string `json:"href"`
+		} `json:"links"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&root); err != nil {
+		return nil, fmt.Errorf("failed to parse API root: %w", err)
+	}
+
+	links := make(map[string]string)
+	for name, link := range root.Links {
+		// Links for disabled components are null
+		if link != nil && link.Href != "" {
+			links[name] = strings.TrimSuffix(link.Href, "/")
+		}
+	}
+	return links, nil
+}
+
+func (c *CFClient) authenticateDirectly(ctx context.Context, tokenURL, username, password string) error {
+	// Standard CF client credentials unless a custom client is configured
+	clientID := c.clientID
+	clientSecret := c.clientSecret
+	if clientID == "" {
+		clientID = "cf"
+	}
+	if clientID != "cf" {
+		log.Printf("Using custom OAuth client credentials")
+	}
+
 	// Prepare the request payload
 	data := url.Values{}
 	data.Set("grant_type", "password")
 	data.Set("username", username)
 	data.Set("password", password)
-	
-	req, err := http.NewRequest("POST", tokenURL, strings.NewReader(data.Encode()))
+
+	req, err := http.NewRequestWithContext(ctx, "POST", tokenURL, strings.NewReader(data.Encode()))
 	if err != nil {
 		return err
 	}
-	
+
 	// Set headers
 	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 	req.Header.Set("Accept", "application/json")
-	
+
 	// Add client credentials if we have them
 	if clientSecret != "" {
 		credentials := base64.StdEncoding.EncodeToString([]byte(clientID + ":" + clientSecret))
@@ -132,316 +225,689 @@ func (c *CFClient) authenticateDirectly(tokenURL, username, password string) err
 		credentials := base64.StdEncoding.EncodeToString([]byte(clientID + ":"))
 		req.Header.Set("Authorization", "Basic "+credentials)
 	}
-	
+
 	resp, err := c.httpClient.Do(req)
 	if err != nil {
 		return err
 	}
 	defer resp.Body.Close()
-	
+
 	if resp.StatusCode != http.StatusOK {
 		body, _ := io.ReadAll(resp.Body)
 		return fmt.Errorf("authentication failed with status %d: %s", resp.StatusCode, string(body))
 	}
-	
+
 	var tokenResp struct {
 		AccessToken string `json:"access_token"`
 	}
-	
+
 	if err := json.NewDecoder(resp.Body).Decode(&tokenResp); err != nil {
 		return err
 	}
-	
+
 	c.accessToken = tokenResp.AccessToken
 	log.Printf("Successfully authenticated via direct OAuth")
 	return nil
 }
 
-func (c *CFClient) authenticateWithCredentials(apiEndpoint, username, password string) error {
+// authenticate obtains a new access token, re-resolving the credentials so
+// that rotated secret files are used
+func (c *CFClient) authenticate(ctx context.Context) error {
+	username, password, clientSecret, err := c.credentials.resolve()
+	if err != nil {
+		return err
+	}
+	c.clientSecret = clientSecret
+	return c.authenticateWithCredentials(ctx, c.apiEndpoint, username, password)
+}
+
+func (c *CFClient) authenticateWithCredentials(ctx context.Context, apiEndpoint, username, password string) error {
 	c.apiEndpoint = strings.TrimSuffix(apiEndpoint, "/")
-	
+
+	// Reuse the endpoint found by an earlier authentication
+	if c.tokenURL != "" {
+		err := c.authenticateDirectly(ctx, c.tokenURL, username, password)
+		if err == nil {
+			return nil
+		}
+		log.Printf("Authentication at %s failed, discovering the OAuth endpoint again: %v", c.tokenURL, err)
+		c.tokenURL = ""
+	}
+
 	// Discover the OAuth endpoint
-	tokenURL, err := c.discoverAuthEndpoint(c.apiEndpoint)
+	tokenURL, err := c.discoverAuthEndpoint(ctx)
 	if err != nil {
 		log.Printf("Failed to discover OAuth endpoint: %v", err)
-		
+
+		// Guessed endpoints would receive the password, so they are opt-in
+		if !c.allowGuessedAuth {
+			return fmt.Errorf("could not discover the OAuth endpoint and guessed endpoints are not allowed (set CF_ALLOW_GUESSED_AUTH_ENDPOINTS=true to try them): %w", err)
+		}
+
 		// Try common endpoints as fallback
 		fallbackURLs := []string{
 			strings.Replace(apiEndpoint, "api.", "uaa.", 1) + "/oauth/token", // UAA endpoint
-			apiEndpoint + "/uaa/oauth/token",                                  // Newer CF/TAS
-			apiEndpoint + "/oauth/token",                                      // Older CF
+			apiEndpoint + "/uaa/oauth/token",                                 // Newer CF/TAS
+			apiEndpoint + "/oauth/token",                                     // Older CF
 		}
-		
+
 		for _, fallbackURL := range fallbackURLs {
-			log.Printf("Trying fallback endpoint: %s", fallbackURL)
-			if err := c.authenticateDirectly(fallbackURL, username, password); err == nil {
+			log.Printf("Trying guessed endpoint: %s", fallbackURL)
+			if err := c.authenticateDirectly(ctx, fallbackURL, username, password); err == nil {
+				c.tokenURL = fallbackURL
 				return nil
 			} else {
-				log.Printf("Fallback endpoint failed: %v", err)
+				log.Printf("Guessed endpoint failed: %v", err)
 			}
 		}
-		
+
 		return fmt.Errorf("authentication failed at all endpoints")
 	}
-	
+
 	// Try the discovered endpoint
-	return c.authenticateDirectly(tokenURL, username, password)
+	if err := c.authenticateDirectly(ctx, tokenURL, username, password); err != nil {
+		return err
+	}
+	c.tokenURL = tokenURL
+	return nil
 }
 
 // API call methods
-func (c *CFClient) apiCall(endpoint string) ([]byte, error) {
-	return c.directAPICall(endpoint)
+func (c *CFClient) apiCall(ctx context.Context, endpoint string) ([]byte, error) {
+	return c.directAPICall(ctx, endpoint)
 }
 
-func (c *CFClient) directAPICall(endpoint string) ([]byte, error) {
-	url := c.apiEndpoint + endpoint
-	
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		return nil, err
+// authorizedGet issues a GET with the current access token. When the token
+// has expired it re-authenticates once and retries.
+func (c *CFClient) authorizedGet(ctx context.Context, url string) (*http.Response, error) {
+	if c.replay != nil || c.recorder != nil {
+		service, path, err := c.splitServiceURL(url)
+		if err != nil {
+			return nil, err
+		}
+		if c.replay != nil {
+			return c.replay.response(service, path)
+		}
+		resp, err := c.get(ctx, url)
+		if err != nil {
+			return nil, err
+		}
+		return c.recorder.record(service, path, c.accessToken, resp)
 	}
-	
-	req.Header.Set("Authorization", "Bearer "+c.accessToken)
-	req.Header.Set("Accept", "application/json")
-	
-	resp, err := c.httpClient.Do(req)
+	return c.get(ctx, url)
+}
+
+// get performs an authorized GET against the foundation
+func (c *CFClient) get(ctx context.Context, url string) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		req.Header.Set("Authorization", "Bearer "+c.accessToken)
+		req.Header.Set("Accept", "application/json")
+
+		resp, err := c.httpClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusUnauthorized || attempt > 0 {
+			return resp, nil
+		}
+		resp.Body.Close()
+
+		log.Printf("Access token rejected, re-authenticating...")
+		if err := c.authenticate(ctx); err != nil {
+			return nil, fmt.Errorf("re-authentication failed: %w", err)
+		}
+	}
+}
+
+func (c *CFClient) directAPICall(ctx context.Context, endpoint string) ([]byte, error) {
+	resp, err := c.authorizedGet(ctx, c.apiEndpoint+endpoint)
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
-	
+
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("API call failed with status %d", resp.StatusCode)
+		return nil, &apiStatusError{status: resp.StatusCode}
 	}
-	
+
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
 		return nil, err
 	}
-	
+
 	return body, nil
 }
 
+// apiStatusError is a CF API response with a status other than 200 OK
+type apiStatusError struct {
+	status int
+}
+
+func (e *apiStatusError) Error() string {
+	return fmt.Sprintf("API call failed with status %d", e.status)
+}
+
 // CF API resource methods
-func (c *CFClient) loadAllPages(url string) ([]json.RawMessage, error) {
-	var allResources []json.RawMessage
-	
-	for url != "" && url != "null" {
-		data, err := c.apiCall(url)
+func (c *CFClient) getOrganizations(ctx context.Context) ([]Organization, error) {
+	return collectResources(listResources[Organization](ctx, c, "/v3/organizations?per_page=1000"))
+}
+
+func (c *CFClient) getSpaces(ctx context.Context) ([]Space, error) {
+	return collectResources(listResources[Space](ctx, c, "/v3/spaces?per_page=5000"))
+}
+
+func (c *CFClient) getApps(ctx context.Context, states string) ([]App, error) {
+	endpoint := "/v3/apps?per_page=5000"
+	if states != "" {
+		endpoint += "&states=" + states
+	}
+	return collectResources(listResources[App](ctx, c, endpoint))
+}
+
+func (c *CFClient) getProcesses(ctx context.Context) ([]Process, error) {
+	return collectResources(listResources[Process](ctx, c, "/v3/processes?per_page=5000"))
+}
+
+// getAppUsageEvents returns the app usage events after afterGUID in
+// chronological order (all retained events when afterGUID is empty)
+func (c *CFClient) getAppUsageEvents(ctx context.Context, afterGUID string) ([]AppUsageEvent, error) {
+	endpoint := "/v3/app_usage_events?order_by=created_at&per_page=5000"
+	if afterGUID != "" {
+		endpoint += "&after_guid=" + url.QueryEscape(afterGUID)
+	}
+	events, err := collectResources(listResources[AppUsageEvent](ctx, c, endpoint))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load app usage events: %w", err)
+	}
+	return events, nil
+}
+
+// getLatestEventGUID returns the GUID of the most recent event of a usage
+// events endpoint, or "" if there are none
+func (c *CFClient) getLatestEventGUID(ctx context.Context, endpoint string) (string, error) {
+	type event struct {
+		GUID string `json:"guid"`
+	}
+	for latest, err := range listResources[event](ctx, c, endpoint+"?order_by=-created_at&per_page=1") {
 		if err != nil {
-			return nil, err
+			return "", fmt.Errorf("failed to load latest event: %w", err)
 		}
-		
-		var resp CFResponse
-		if err := json.Unmarshal(data, &resp); err != nil {
-			return nil, fmt.Errorf("failed to parse response: %w", err)
-		}
-		
-		allResources = append(allResources, resp.Resources...)
-		
-		if resp.Pagination.Next.Href == "" {
-			break
-		}
-		
-		// Strip domain prefix for API compatibility
-		url = resp.Pagination.Next.Href
-		if strings.Contains(url, "://") {
-			parts := strings.Split(url, "/")
-			if len(parts) >= 4 {
-				url = "/" + strings.Join(parts[3:], "/")
-			}
+		return latest.GUID, nil
+	}
+	return "", nil
+}
+
+// getServiceUsageEvents returns the service usage events after afterGUID in
+// chronological order (all retained events when afterGUID is empty)
+func (c *CFClient) getServiceUsageEvents(ctx context.Context, afterGUID string) ([]ServiceUsageEvent, error) {
+	endpoint := "/v3/service_usage_events?order_by=created_at&per_page=5000"
+	if afterGUID != "" {
+		endpoint += "&after_guid=" + url.QueryEscape(afterGUID)
+	}
+	events, err := collectResources(listResources[ServiceUsageEvent](ctx, c, endpoint))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load service usage events: %w", err)
+	}
+	return events, nil
+}
+
+// serviceOffering resolves the offering of a service plan from the catalog
+func (c *serviceCatalog) serviceOffering(planGUID string) ServiceOffering {
+	plan, exists := c.servicePlans[planGUID]
+	if !exists {
+		return ServiceOffering{}
+	}
+	return c.serviceOfferings[plan.Relationships.ServiceOffering.Data.GUID]
+}
+
+// serviceBroker resolves the broker of a service offering from the catalog
+func (c *serviceCatalog) serviceBroker(offering ServiceOffering) ServiceBroker {
+	return c.serviceBrokers[offering.Relationships.ServiceBroker.Data.GUID]
+}
+
+// isSpaceScopedBroker reports whether the named broker is space-scoped
+func (c *serviceCatalog) isSpaceScopedBroker(name string) bool {
+	for _, broker := range c.serviceBrokers {
+		if broker.Name == name {
+			return broker.spaceScoped()
 		}
 	}
-	
-	return allResources, nil
+	return false
+}
+
+// isOfferingBillable reports whether the named offering of the named broker is
+// in the billable catalog. A "broker:offering" entry matches that broker only;
+// a plain offering name matches the offering of any broker that is not
+// space-scoped, so a space-scoped broker reusing a billable name does not count.
+func (c *serviceCatalog) isOfferingBillable(broker, offering string) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if broker != "" && c.billableOfferings[broker+":"+offering] {
+		return true
+	}
+	return c.billableOfferings[offering] && !c.isSpaceScopedBroker(broker)
+}
+
+func (c *CFClient) getServicePlans(ctx context.Context) ([]ServicePlan, error) {
+	return collectResources(listResources[ServicePlan](ctx, c, "/v3/service_plans?per_page=1000"))
+}
+
+func (c *CFClient) getServiceOfferings(ctx context.Context) ([]ServiceOffering, error) {
+	return collectResources(listResources[ServiceOffering](ctx, c, "/v3/service_offerings?per_page=1000"))
+}
+
+func (c *CFClient) getServiceBrokers(ctx context.Context) ([]ServiceBroker, error) {
+	return collectResources(listResources[ServiceBroker](ctx, c, "/v3/service_brokers?per_page=1000"))
 }
 
-func (c *CFClient) getOrganizations() ([]Organization, error) {
-	resources, err := c.loadAllPages("/v3/organizations?per_page=1000")
+func (c *CFClient) getServicePlan(ctx context.Context, guid string) (*ServicePlan, error) {
+	data, err := c.apiCall(ctx, "/v3/service_plans/"+url.PathEscape(guid))
 	if err != nil {
 		return nil, err
 	}
-	
-	var orgs []Organization
-	for _, resource := range resources {
-		var org Organization
-		if err := json.Unmarshal(resource, &org); err != nil {
-			return nil, fmt.Errorf("failed to parse organization: %w", err)
-		}
-		orgs = append(orgs, org)
+	var plan ServicePlan
+	if err := json.Unmarshal(data, &plan); err != nil {
+		return nil, fmt.Errorf("failed to parse service plan: %w", err)
 	}
-	
-	return orgs, nil
+	return &plan, nil
 }
 
-func (c *CFClient) loadServicePlans() error {
-	resources, err := c.loadAllPages("/v3/service_plans?per_page=1000")
+func (c *CFClient) getServiceOffering(ctx context.Context, guid string) (*ServiceOffering, error) {
+	data, err := c.apiCall(ctx, "/v3/service_offerings/"+url.PathEscape(guid))
 	if err != nil {
-		return fmt.Errorf("failed to load service plans: %w", err)
+		return nil, err
 	}
-	
-	for _, resource := range resources {
-		var plan ServicePlan
-		if err := json.Unmarshal(resource, &plan); err != nil {
-			return fmt.Errorf("failed to parse service plan: %w", err)
-		}
-		c.servicePlans[plan.GUID] = plan
+	var offering ServiceOffering
+	if err := json.Unmarshal(data, &offering); err != nil {
+		return nil, fmt.Errorf("failed to parse service offering: %w", err)
 	}
-	
-	return nil
+	return &offering, nil
 }
 
-func (c *CFClient) loadServiceOfferings() error {
-	resources, err := c.loadAllPages("/v3/service_offerings?per_page=1000")
+// loadCatalog replaces the catalog with all service plans, offerings and
+// brokers from source. The previous catalog is kept if any listing fails.
+func (c *serviceCatalog) loadCatalog(ctx context.Context, source UsageSource) error {
+	plans, err := source.getServicePlans(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to load service plans: %w", err)
+	}
+	offerings, err := source.getServiceOfferings(ctx)
 	if err != nil {
 		return fmt.Errorf("failed to load service offerings: %w", err)
 	}
-	
-	for _, resource := range resources {
-		var offering ServiceOffering
-		if err := json.Unmarshal(resource, &offering); err != nil {
-			return fmt.Errorf("failed to parse service offering: %w", err)
-		}
-		c.serviceOfferings[offering.GUID] = offering
+
+	// Without brokers, offerings of space-scoped brokers would pass for global ones
+	brokers, err := source.getServiceBrokers(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to load service brokers: %w", err)
 	}
-	
+
+	// Fresh maps drop plans, offerings and brokers deleted since the last load
+	c.servicePlans = make(map[string]ServicePlan, len(plans))
+	c.serviceOfferings = make(map[string]ServiceOffering, len(offerings))
+	c.serviceBrokers = make(map[string]ServiceBroker, len(brokers))
+	c.add(plans, offerings)
+	c.addBrokers(brokers)
 	return nil
 }
 
-func (c *CFClient) getServiceInstances(orgGUID string) ([]ServiceInstance, error) {
-	endpoint := fmt.Sprintf("/v3/service_instances?organization_guids=%s&per_page=1000", orgGUID)
-	resources, err := c.loadAllPages(endpoint)
-	if err != nil {
-		return nil, fmt.Errorf("failed to load service instances: %w", err)
+// addBrokers merges brokers into the catalog, keeping entries already present
+func (c *serviceCatalog) addBrokers(brokers []ServiceBroker) {
+	for _, broker := range brokers {
+		if _, exists := c.serviceBrokers[broker.GUID]; !exists {
+			c.serviceBrokers[broker.GUID] = broker
+		}
 	}
-	
-	var instances []ServiceInstance
-	for _, resource := range resources {
-		var instance ServiceInstance
-		if err := json.Unmarshal(resource, &instance); err != nil {
-			return nil, fmt.Errorf("failed to parse service instance: %w", err)
+}
+
+// resolveUnknownPlans looks up the plans of instances that are missing from
+// the catalog, and their offerings, one request each. Lookups that fail are
+// logged and leave the plan unknown.
+func (c *serviceCatalog) resolveUnknownPlans(ctx context.Context, source UsageSource, instances []ServiceInstance) {
+	tried := make(map[string]bool)
+	for _, instance := range instances {
+		planGUID := instance.Relationships.ServicePlan.Data.GUID
+		if _, known := c.servicePlans[planGUID]; known || planGUID == "" || tried[planGUID] {
+			continue
 		}
-		instances = append(instances, instance)
+		tried[planGUID] = true
+
+		plan, err := source.getServicePlan(ctx, planGUID)
+		if err != nil {
+			log.Printf("Failed to resolve service plan %s of service instance %s: %v", planGUID, instance.Name, err)
+			continue
+		}
+		c.servicePlans[plan.GUID] = *plan
+
+		offeringGUID := plan.Relationships.ServiceOffering.Data.GUID
+		if _, known := c.serviceOfferings[offeringGUID]; known || offeringGUID == "" {
+			continue
+		}
+		offering, err := source.getServiceOffering(ctx, offeringGUID)
+		if err != nil {
+			log.Printf("Failed to resolve service offering %s of plan %s: %v", offeringGUID, plan.Name, err)
+			continue
+		}
+		c.serviceOfferings[offering.GUID] = *offering
 	}
-	
-	return instances, nil
 }
 
-func (c *CFClient) isServiceInstanceBillable(instance ServiceInstance) (bool, string) {
+// add merges plans and offerings into the catalog. Entries already present
+// are kept, as they come from the complete listings.
+func (c *serviceCatalog) add(plans []ServicePlan, offerings []ServiceOffering) {
+	for _, plan := range plans {
+		if _, exists := c.servicePlans[plan.GUID]; !exists {
+			c.servicePlans[plan.GUID] = plan
+		}
+	}
+	for _, offering := range offerings {
+		if _, exists := c.serviceOfferings[offering.GUID]; !exists {
+			c.serviceOfferings[offering.GUID] = offering
+		}
+	}
+}
+
+// isShareable reports whether the offering of instance allows sharing
+func (c *serviceCatalog) isShareable(instance ServiceInstance) bool {
+	plan, exists := c.servicePlans[instance.Relationships.ServicePlan.Data.GUID]
+	if !exists {
+		return false
+	}
+	return c.serviceOfferings[plan.Relationships.ServiceOffering.Data.GUID].Shareable
+}
+
+// Offering names reported for instances whose offering cannot be determined
+const (
+	userProvidedOffering = "user-provided"
+	unknownPlan          = "unknown-plan"
+	unknownOffering      = "unknown-offering"
+)
+
+// isServiceInstanceBillable reports whether instance is billable and names its offering
+func (c *serviceCatalog) isServiceInstanceBillable(instance ServiceInstance) (bool, string) {
+	if instance.Type == "user-provided" {
+		return false, userProvidedOffering
+	}
+
 	planGUID := instance.Relationships.ServicePlan.Data.GUID
 	plan, exists := c.servicePlans[planGUID]
 	if !exists {
-		return false, "unknown-plan"
+		return false, unknownPlan
 	}
-	
+
 	offeringGUID := plan.Relationships.ServiceOffering.Data.GUID
 	offering, exists := c.serviceOfferings[offeringGUID]
 	if !exists {
-		return false, "unknown-offering"
-	}
-	
-	// Billable service offerings
-	billableOfferings := map[string]bool{
-		"p.mysql":      true,
-		"p-mysql":      true,
-		"p.rabbitmq":   true,
-		"p-rabbitmq":   true,
-		"p.redis":      true,
-		"p-redis":      true,
-		"postgres":     true,
-		"genai":        true,
-		"genai-service": true,
-	}
-	
-	return billableOfferings[offering.Name], offering.Name
-}
-
-func (c *CFClient) getUsageSummary(orgGUID string) (*UsageSummary, error) {
+		return false, unknownOffering
+	}
+
+	// Billable service offerings come from the configured catalog
+	return c.isOfferingBillable(c.serviceBroker(offering).Name, offering.Name), offering.Name
+}
+
+// setBillableOfferings replaces the catalog of billable offering names
+func (c *serviceCatalog) setBillableOfferings(names []string) {
+	billable := make(map[string]bool, len(names))
+	for _, name := range names {
+		billable[name] = true
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.billableOfferings = billable
+}
+
+func (c *CFClient) getUsageSummary(ctx context.Context, orgGUID string) (*UsageSummary, error) {
 	endpoint := fmt.Sprintf("/v3/organizations/%s/usage_summary", orgGUID)
-	data, err := c.apiCall(endpoint)
+	data, err := c.apiCall(ctx, endpoint)
 	if err != nil {
 		return nil, err
 	}
-	
+
 	var summary UsageSummary
 	if err := json.Unmarshal(data, &summary); err != nil {
 		return nil, fmt.Errorf("failed to parse usage summary: %w", err)
 	}
-	
+
 	return &summary, nil
 }
 
-func (c *CFClient) getAppUsageReport() (*AppUsageReport, error) {
-	// The app-usage endpoint needs to be constructed from the API endpoint
-	// Replace api.sys.domain with app-usage.sys.domain
-	appUsageEndpoint := strings.Replace(c.apiEndpoint, "api.", "app-usage.", 1)
-	reportURL := appUsageEndpoint + "/system_report/app_usages"
-	
-	req, err := http.NewRequest("GET", reportURL, nil)
-	if err != nil {
-		return nil, err
+// withCollectionTimeout bounds a collection run by the configured timeout
+func withCollectionTimeout(ctx context.Context, config *Config) (context.Context, context.CancelFunc) {
+	if config.CollectionTimeout > 0 {
+		return context.WithTimeout(ctx, config.CollectionTimeout)
 	}
-	
-	req.Header.Set("Authorization", "Bearer "+c.accessToken)
-	req.Header.Set("Accept", "application/json")
-	
-	resp, err := c.httpClient.Do(req)
+	return context.WithCancel(ctx)
+}
+
+// Usage data collection
+func collectUsageData(ctx context.Context, source UsageSource, config *Config) (*UsageResult, error) {
+	ctx, cancel := withCollectionTimeout(ctx, config)
+	defer cancel()
+
+	result, listings, err := collectSnapshot(ctx, source, config)
 	if err != nil {
 		return nil, err
 	}
-	defer resp.Body.Close()
-	
-	if resp.StatusCode != http.StatusOK {
-		if resp.StatusCode == 404 {
-			return nil, fmt.Errorf("app-usage service not found (not deployed in this foundation)")
+	orgs := listings.orgs
+
+	orgGUIDs := make(map[string]string)
+	for _, org := range orgs {
+		orgGUIDs[org.Name] = org.GUID
+	}
+
+	// AIs by isolation segment and by stack, the disk and per-space
+	// allocations, quota use, sidecars, idle apps and running tasks; a
+	// failure only drops these breakdowns
+	if err := listings.loadWorkloads(ctx, source); err != nil {
+		log.Printf("Failed to list apps and processes for the AI breakdowns: %v", err)
+	} else {
+		running := listings.runningProcesses()
+		if result.IsolationSegments, err = collectIsolationSegmentUsage(ctx, source, orgs, running, config); err != nil {
+			log.Printf("Failed to attribute application instances to isolation segments: %v", err)
+		}
+
+		var orgStacks map[string][]StackUsage
+		result.Stacks, orgStacks = collectStackUsage(running, orgs, config)
+		for i := range result.Organizations {
+			result.Organizations[i].Stacks = orgStacks[orgGUIDs[result.Organizations[i].Name]]
+		}
+		applyAllocations(result, running, orgs, config)
+		if result.Quotas, err = collectQuotaUsage(ctx, source, listings, running, config); err != nil {
+			log.Printf("Failed to measure quota utilization: %v", err)
+		}
+
+		if config.Sidecars {
+			total, orgSidecars, err := collectSidecarInstances(ctx, source, running)
+			if err != nil {
+				log.Printf("Failed to count sidecars: %v", err)
+			} else {
+				result.TotalSidecarInstances = total
+				for i := range result.Organizations {
+					result.Organizations[i].SidecarInstances = orgSidecars[orgGUIDs[result.Organizations[i].Name]]
+				}
+			}
+		}
+
+		// Stopped and unhealthy apps for cleanup campaigns
+		if config.IdleApps {
+			if result.IdleApps, err = collectIdleApps(ctx, source, listings, config, source.currentTime()); err != nil {
+				log.Printf("Failed to find idle apps: %v", err)
+			}
+		}
+
+		// Running tasks are not in started_instances and are reported apart
+		if tasks, orgTasks, err := collectTaskUsage(ctx, source, listings, source.currentTime()); err != nil {
+			log.Printf("Failed to collect running tasks: %v", err)
+		} else {
+			result.Tasks = tasks
+			for i := range result.Organizations {
+				result.Organizations[i].Tasks = orgTasks[orgGUIDs[result.Organizations[i].Name]]
+			}
 		}
-		return nil, fmt.Errorf("app usage report request failed with status %d", resp.StatusCode)
 	}
-	
-	body, err := io.ReadAll(resp.Body)
+
+	// Fetch monthly max billable AIs and the usage history from the app-usage service
+	appUsageService, err := collectAppUsageService(ctx, source, orgs, config)
 	if err != nil {
-		return nil, err
+		if config.Verbose {
+			log.Printf("App usage report not available (this is normal if app-usage service is not deployed): %v", err)
+		}
+		// Continue without monthly/yearly max data - this is expected in many foundations
+	} else {
+		// Get current month's max instances
+		currentTime := source.currentTime()
+		currentMonth := int(currentTime.Month())
+		currentYear := currentTime.Year()
+
+		for _, monthlyReport := range appUsageService.Monthly {
+			if monthlyReport.Month == currentMonth && monthlyReport.Year == currentYear {
+				result.MonthlyMaxBillableAIs = monthlyReport.MaximumAppInstances
+				break
+			}
+		}
+
+		// Get current year's max instances
+		for _, yearlyReport := range appUsageService.Yearly {
+			if yearlyReport.Year == currentYear {
+				result.YearlyMaxBillableAIs = yearlyReport.MaximumAppInstances
+				break
+			}
+		}
+
+		if config.Verbose {
+			log.Printf("Monthly max billable AIs: %d, Yearly max billable AIs: %d", result.MonthlyMaxBillableAIs, result.YearlyMaxBillableAIs)
+		}
+		result.AppUsageService = appUsageService
+	}
+
+	// Exact AI-hours and peaks from app usage events
+	if config.AppUsageEvents {
+		if result.AppUsageEvents, err = collectAppUsageEvents(ctx, source, orgs, config); err != nil {
+			log.Printf("Failed to process app usage events: %v", err)
+		}
 	}
-	
-	var report AppUsageReport
-	if err := json.Unmarshal(body, &report); err != nil {
-		return nil, fmt.Errorf("failed to parse app usage report: %w", err)
+
+	// SI-days and peak billable SIs from service usage events
+	if config.ServiceUsageEvents {
+		if result.ServiceUsageEvents, err = collectServiceUsageEvents(ctx, source, orgs, config); err != nil {
+			log.Printf("Failed to process service usage events: %v", err)
+		}
 	}
-	
-	return &report, nil
+
+	// Optional parts log their failures; a cancelled collection must not pass as complete
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("collection aborted: %w", err)
+	}
+
+	return result, nil
 }
 
-// Usage data collection
-func collectUsageData(client *CFClient, config *Config) (*UsageResult, error) {
-	orgs, err := client.getOrganizations()
+// collectSnapshot counts the current AIs and SIs per org from source, using
+// the catalog of source to decide which service instances are billable. It
+// returns the orgs, service instances and bindings it listed for reuse.
+func collectSnapshot(ctx context.Context, source UsageSource, config *Config) (*UsageResult, *foundationListings, error) {
+	catalog := source.catalog()
+	orgs, err := source.getOrganizations(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get organizations: %w", err)
+		return nil, nil, fmt.Errorf("failed to get organizations: %w", err)
 	}
-	
-	totalAIs := 0              // Includes ALL orgs (including system)
-	totalBillableAIs := 0      // Excludes system org
+
+	totalAIs := 0         // Includes ALL orgs (including system)
+	totalBillableAIs := 0 // Excludes system org
 	totalSIs := 0
 	totalBillableSIs := 0
+	totalUnknownPlanSIs := 0
+	totalMemoryMB := 0
+	totalBillableMemoryMB := 0
 	var orgUsages []OrgUsage
-	
+
+	// Reload the catalog on every collection so tiles and plans added since
+	// startup are recognised; a failed reload keeps the previous catalog
+	if config.Verbose {
+		fmt.Println("Loading service plans and offerings...")
+	}
+	if err := catalog.loadCatalog(ctx, source); err != nil {
+		if len(catalog.servicePlans) == 0 {
+			return nil, nil, err
+		}
+		log.Printf("Failed to refresh service catalog, using the previous one: %v", err)
+	}
+
+	// One foundation-wide listing instead of a query per org; the plans and
+	// offerings returned with it keep the catalog current
+	listing, err := source.listServiceInstances(ctx, "")
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get service instances: %w", err)
+	}
+	catalog.add(listing.Plans, listing.Offerings)
+	catalog.addBrokers(listing.Brokers)
+	catalog.resolveUnknownPlans(ctx, source, listing.Instances)
+	if err := listing.resolveSharing(ctx, source, catalog); err != nil {
+		return nil, nil, err
+	}
+	instancesByOrg := listing.byOrg()
+	instanceCounts := listing.countByOrg()
+
+	// Managed instances without bindings or keys; a failure only drops the list
+	orgNames := make(map[string]string)
+	skipOrgs := make(map[string]bool)
+	for _, org := range orgs {
+		orgNames[org.GUID] = org.Name
+		skipOrgs[org.GUID] = shouldSkipOrg(org.Name, config.SkipOrgs)
+	}
+	var orphans []OrphanedServiceInstance
+	orphanCounts := make(map[string]int)
+	listings := &foundationListings{orgs: orgs, instances: listing}
+	if listings.bindings, err = source.getServiceCredentialBindings(ctx); err != nil {
+		listings.bindingsErr = err
+		log.Printf("Failed to detect orphaned service instances: %v", err)
+	} else {
+		orphans = findOrphanedServiceInstances(listing, listings.bindings, catalog, orgNames, skipOrgs, source.currentTime())
+		for _, orphan := range orphans {
+			orphanCounts[orphan.Org]++
+		}
+	}
+	totalManagedSIs, totalUserProvidedSIs, totalSharedSIs := 0, 0, 0
+	offeringUsage := make(map[string]*OfferingUsage) // by offering GUID
+
 	for _, org := range orgs {
+		if err := ctx.Err(); err != nil {
+			return nil, nil, fmt.Errorf("collection aborted: %w", err)
+		}
 		if config.Verbose {
 			fmt.Printf("Processing %s...\n", org.Name)
 		}
-		
-		summary, err := client.getUsageSummary(org.GUID)
+
+		summary, err := source.getUsageSummary(ctx, org.GUID)
 		if err != nil {
 			log.Printf("Failed to get usage summary for org %s: %v", org.Name, err)
 			continue
 		}
-		
+
 		ais := summary.UsageSummary.StartedInstances
-		sis := summary.UsageSummary.ServiceInstances
-		
+		counts := instanceCounts[org.GUID]
+		if counts == nil {
+			counts = &serviceInstanceCounts{}
+		}
+
+		// The usage summary also counts instances shared into the org; they
+		// belong to the org owning them
+		sis := max(summary.UsageSummary.ServiceInstances-counts.sharedIn, 0)
+
 		// Always count AIs for total (including system org)
 		totalAIs += ais
 		totalSIs += sis
-		
+		totalMemoryMB += summary.UsageSummary.MemoryInMB
+		totalManagedSIs += counts.managed
+		totalUserProvidedSIs += counts.userProvided
+		totalSharedSIs += counts.shared
+
 		// Skip further processing for organizations in skip list
 		if shouldSkipOrg(org.Name, config.SkipOrgs) {
 			if config.Verbose {
@@ -449,19 +915,35 @@ func collectUsageData(client *CFClient, config *Config) (*UsageResult, error) {
 			}
 			continue
 		}
-		
+
 		// Count billable AIs (excludes system org)
 		totalBillableAIs += ais
-		
-		instances, err := client.getServiceInstances(org.GUID)
-		if err != nil {
-			log.Printf("Failed to get service instances for org %s: %v", org.Name, err)
-			continue
-		}
-		
+		totalBillableMemoryMB += summary.UsageSummary.MemoryInMB
+
 		billableSIs := 0
-		for _, instance := range instances {
-			if billable, offeringName := client.isServiceInstanceBillable(instance); billable {
+		unknownPlanSIs := 0
+		for _, instance := range instancesByOrg[org.GUID] {
+			billable, offeringName := catalog.isServiceInstanceBillable(instance)
+			if offeringName == unknownPlan || offeringName == unknownOffering {
+				unknownPlanSIs++
+			}
+
+			if offering := catalog.serviceOffering(instance.Relationships.ServicePlan.Data.GUID); offering.GUID != "" {
+				usage := offeringUsage[offering.GUID]
+				if usage == nil {
+					broker := catalog.serviceBroker(offering)
+					usage = &OfferingUsage{
+						Broker:      broker.Name,
+						Offering:    offering.Name,
+						SpaceScoped: broker.spaceScoped(),
+						Billable:    billable,
+					}
+					offeringUsage[offering.GUID] = usage
+				}
+				usage.Instances++
+			}
+
+			if billable {
 				billableSIs++
 				if config.Verbose {
 					fmt.Printf("  Billable SI: %s (%s)\n", instance.Name, offeringName)
@@ -470,61 +952,56 @@ func collectUsageData(client *CFClient, config *Config) (*UsageResult, error) {
 				fmt.Printf("  Non-billable SI: %s (%s)\n", instance.Name, offeringName)
 			}
 		}
-		
+
 		totalBillableSIs += billableSIs
-		
+		totalUnknownPlanSIs += unknownPlanSIs
+
 		orgUsages = append(orgUsages, OrgUsage{
-			Name:       org.Name,
-			AIs:        ais,
-			SIs:        sis,
-			BillableSIs: billableSIs,
+			Name:            org.Name,
+			AIs:             ais,
+			SIs:             sis,
+			BillableSIs:     billableSIs,
+			UnknownPlanSIs:  unknownPlanSIs,
+			ManagedSIs:      counts.managed,
+			UserProvidedSIs: counts.userProvided,
+			OrphanedSIs:     orphanCounts[org.Name],
+			SharedSIs:       counts.shared,
+			SharedInSIs:     counts.sharedIn,
+			MemoryGB:        mbToGB(summary.UsageSummary.MemoryInMB),
 		})
 	}
-	
-	// Fetch monthly max billable AIs from app usage report
-	monthlyMaxBillableAIs := 0
-	yearlyMaxBillableAIs := 0
-	
-	if appReport, err := client.getAppUsageReport(); err != nil {
-		if config.Verbose {
-			log.Printf("App usage report not available (this is normal if app-usage service is not deployed): %v", err)
-		}
-		// Continue without monthly/yearly max data - this is expected in many foundations
-	} else {
-		// Get current month's max instances
-		currentTime := time.Now()
-		currentMonth := int(currentTime.Month())
-		currentYear := currentTime.Year()
-		
-		for _, monthlyReport := range appReport.MonthlyReports {
-			if monthlyReport.Month == currentMonth && monthlyReport.Year == currentYear {
-				monthlyMaxBillableAIs = monthlyReport.MaximumAppInstances
-				break
-			}
-		}
-		
-		// Get current year's max instances
-		for _, yearlyReport := range appReport.YearlyReports {
-			if yearlyReport.Year == currentYear {
-				yearlyMaxBillableAIs = yearlyReport.MaximumAppInstances
-				break
-			}
-		}
-		
-		if config.Verbose {
-			log.Printf("Monthly max billable AIs: %d, Yearly max billable AIs: %d", monthlyMaxBillableAIs, yearlyMaxBillableAIs)
-		}
+
+	// These instances are counted as not billable, which may undercount
+	if totalUnknownPlanSIs > 0 {
+		log.Printf("Warning: %d service instances have a plan or offering missing from the catalog", totalUnknownPlanSIs)
 	}
-	
+
+	var offerings []OfferingUsage
+	for _, usage := range offeringUsage {
+		offerings = append(offerings, *usage)
+	}
+	sort.Slice(offerings, func(i, j int) bool {
+		if offerings[i].Broker != offerings[j].Broker {
+			return offerings[i].Broker < offerings[j].Broker
+		}
+		return offerings[i].Offering < offerings[j].Offering
+	})
+
 	return &UsageResult{
-		Organizations:         orgUsages,
-		TotalAIs:             totalAIs,
-		TotalBillableAIs:     totalBillableAIs,
-		TotalSIs:             totalSIs,
-		TotalBillableSIs:     totalBillableSIs,
-		MonthlyMaxBillableAIs: monthlyMaxBillableAIs,
-		YearlyMaxBillableAIs:  yearlyMaxBillableAIs,
-	}, nil
+		Organizations:            orgUsages,
+		ServiceOfferings:         offerings,
+		OrphanedServiceInstances: orphans,
+		TotalAIs:                 totalAIs,
+		TotalBillableAIs:         totalBillableAIs,
+		TotalSIs:                 totalSIs,
+		TotalBillableSIs:         totalBillableSIs,
+		TotalUnknownPlanSIs:      totalUnknownPlanSIs,
+		TotalManagedSIs:          totalManagedSIs,
+		TotalUserProvidedSIs:     totalUserProvidedSIs,
+		TotalSharedSIs:           totalSharedSIs,
+		TotalMemoryGB:            mbToGB(totalMemoryMB),
+		TotalBillableMemoryGB:    mbToGB(totalBillableMemoryMB),
+	}, listings, nil
 }
 
 // Helper functions
@@ -535,4 +1012,4 @@ func shouldSkipOrg(orgName string, skipList []string) bool {
 		}
 	}
 	return false
-}
\ No newline at end of file
+}
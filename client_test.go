@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"tpcf-usage-service/internal/fakecc"
+)
+
+func TestDiscoverAuthEndpoint(t *testing.T) {
+	uaa := startFakeFoundation(t)
+	tests := []struct {
+		name  string
+		links map[string]any
+		want  func(cc string) string
+	}{
+		{
+			name: "uaa link",
+			links: map[string]any{
+				"uaa":   map[string]string{"href": uaa.URL},
+				"login": map[string]string{"href": "https://login.example.com"},
+			},
+			want: func(string) string { return uaa.URL + "/oauth/token" },
+		},
+		{
+			name:  "login link when uaa is null",
+			links: map[string]any{"uaa": nil, "login": map[string]string{"href": uaa.URL + "/"}},
+			want:  func(string) string { return uaa.URL + "/oauth/token" },
+		},
+		{
+			name:  "v2 info without root links",
+			links: map[string]any{},
+			want:  func(cc string) string { return cc + "/oauth/token" },
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cc := startFakeFoundation(t)
+			cc.RootLinks = tt.links
+			client, _ := newFakeClient(t, cc)
+			if want := tt.want(cc.URL); client.tokenURL != want {
+				t.Errorf("token URL %s, want %s", client.tokenURL, want)
+			}
+		})
+	}
+}
+
+func TestGuessedAuthEndpoints(t *testing.T) {
+	tests := []struct {
+		name    string
+		allow   bool
+		wantErr string
+	}{
+		{name: "refused by default", wantErr: "guessed endpoints are not allowed"},
+		{name: "allowed", allow: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cc := startFakeFoundation(t)
+			cc.Failures = map[string]int{"/": 404, "/v2/info": 404}
+			config := defaultConfig()
+			config.APIEndpoint = cc.URL
+			config.Username = fakecc.Username
+			config.Password = fakecc.Password
+			config.AllowGuessedAuthEndpoints = tt.allow
+
+			client, err := NewCFClient(context.Background(), config)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error %v, want %q", err, tt.wantErr)
+				}
+				// The password must not be sent anywhere undiscovered
+				if hits := cc.Hits("/oauth/token") + cc.Hits("/uaa/oauth/token"); hits != 0 {
+					t.Errorf("%d token requests to guessed endpoints", hits)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("NewCFClient: %v", err)
+			}
+			if want := cc.URL + "/oauth/token"; client.tokenURL != want {
+				t.Errorf("token URL %s, want %s", client.tokenURL, want)
+			}
+		})
+	}
+}
+
+func TestReauthenticateWithCachedTokenURL(t *testing.T) {
+	cc := startFakeFoundation(t)
+	client, _ := newFakeClient(t, cc)
+	rootHits, infoHits := cc.Hits("/"), cc.Hits("/v2/info")
+
+	// An expired token is renewed at the known endpoint without discovery
+	cc.RevokeToken()
+	if _, err := client.getOrganizations(context.Background()); err != nil {
+		t.Fatalf("getOrganizations after the token expired: %v", err)
+	}
+	if hits := cc.Hits("/oauth/token"); hits != 2 {
+		t.Errorf("%d token requests, want 2", hits)
+	}
+	if cc.Hits("/") != rootHits || cc.Hits("/v2/info") != infoHits {
+		t.Errorf("OAuth endpoint discovered again: %d root and %d /v2/info requests, want %d and %d",
+			cc.Hits("/"), cc.Hits("/v2/info"), rootHits, infoHits)
+	}
+}
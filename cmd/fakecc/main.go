@@ -0,0 +1,39 @@
+// Command fakecc runs the fake Cloud Controller, UAA and app-usage service
+// from internal/fakecc for offline runs against fixture data:
+//
+//	go run ./cmd/fakecc -fixtures internal/fakecc/testdata/foundation
+//	CF_API_ENDPOINT=http://127.0.0.1:9999 CF_USERNAME=admin CF_PASSWORD=admin ./tpcf-usage-service report
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"tpcf-usage-service/internal/fakecc"
+)
+
+func main() {
+	fixtures := flag.String("fixtures", "internal/fakecc/testdata/foundation", "Directory with the fixture files")
+	addr := flag.String("addr", "127.0.0.1:9999", "Listen address")
+	pageSize := flag.Int("page-size", 50, "Maximum results per page")
+	flag.Parse()
+
+	foundation, err := fakecc.Load(*fixtures)
+	if err != nil {
+		log.Fatalf("Failed to load fixtures: %v", err)
+	}
+	server, err := fakecc.Listen(foundation, *addr)
+	if err != nil {
+		log.Fatalf("Failed to listen: %v", err)
+	}
+	server.PageSize = *pageSize
+	defer server.Close()
+
+	log.Printf("Fake foundation from %s listening on %s (user %s, password %s)", *fixtures, server.URL, fakecc.Username, fakecc.Password)
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	<-sigChan
+}
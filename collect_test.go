@@ -0,0 +1,421 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+
+	"tpcf-usage-service/internal/fakecc"
+)
+
+// startFakeFoundation starts the fake Cloud Controller on the fixture
+// foundation, after applying edits to the fixtures
+func startFakeFoundation(t *testing.T, edits ...func(*fakecc.Foundation)) *fakecc.Server {
+	t.Helper()
+	foundation, err := fakecc.Load("internal/fakecc/testdata/foundation")
+	if err != nil {
+		t.Fatalf("failed to load fixtures: %v", err)
+	}
+	for _, edit := range edits {
+		edit(foundation)
+	}
+	server := fakecc.New(foundation)
+	server.PageSize = 2 // exercise pagination on every listing
+	t.Cleanup(server.Close)
+	return server
+}
+
+// newFakeClient returns a client logged in to server with the default configuration
+func newFakeClient(t *testing.T, server *fakecc.Server) (*CFClient, *Config) {
+	t.Helper()
+	config := defaultConfig()
+	config.APIEndpoint = server.URL
+	config.Username = fakecc.Username
+	config.Password = fakecc.Password
+	client, err := NewCFClient(context.Background(), config)
+	if err != nil {
+		t.Fatalf("failed to log in to the fake foundation: %v", err)
+	}
+	return client, config
+}
+
+// newFakeFoundation returns a client logged in to a fake fixture foundation
+func newFakeFoundation(t *testing.T) (*CFClient, *Config) {
+	t.Helper()
+	return newFakeClient(t, startFakeFoundation(t))
+}
+
+func TestCollectUsageData(t *testing.T) {
+	client, config := newFakeFoundation(t)
+	result, err := collectUsageData(context.Background(), client, config)
+	if err != nil {
+		t.Fatalf("collectUsageData: %v", err)
+	}
+
+	totals := []struct {
+		name      string
+		got, want int
+	}{
+		{"TotalAIs", result.TotalAIs, 13},
+		{"TotalBillableAIs", result.TotalBillableAIs, 11},
+		{"TotalSIs", result.TotalSIs, 7},
+		{"TotalBillableSIs", result.TotalBillableSIs, 3},
+		{"TotalManagedSIs", result.TotalManagedSIs, 6},
+		{"TotalUserProvidedSIs", result.TotalUserProvidedSIs, 1},
+		{"TotalSharedSIs", result.TotalSharedSIs, 1},
+		{"orphaned SIs", len(result.OrphanedServiceInstances), 3},
+	}
+	for _, total := range totals {
+		if total.got != total.want {
+			t.Errorf("%s = %d, want %d", total.name, total.got, total.want)
+		}
+	}
+
+	// The system org only counts towards the totals
+	want := map[string]struct{ ais, sis, billableSIs int }{
+		"dev":  {3, 3, 1},
+		"prod": {8, 3, 2},
+	}
+	if len(result.Organizations) != len(want) {
+		t.Fatalf("got %d orgs, want %d", len(result.Organizations), len(want))
+	}
+	for _, org := range result.Organizations {
+		w, ok := want[org.Name]
+		if !ok {
+			t.Errorf("unexpected org %s", org.Name)
+			continue
+		}
+		if org.AIs != w.ais || org.SIs != w.sis || org.BillableSIs != w.billableSIs {
+			t.Errorf("org %s: AIs %d, SIs %d, billable SIs %d; want %d, %d, %d",
+				org.Name, org.AIs, org.SIs, org.BillableSIs, w.ais, w.sis, w.billableSIs)
+		}
+	}
+
+	// app-worker runs only its worker process; the stopped app-legacy is left out
+	wantStacks := []StackUsage{
+		{Stack: "cflinuxfs4", Lifecycle: "buildpack", AIs: 5, BillableAIs: 3},
+		{Stack: "cflinuxfs4", Lifecycle: "cnb", AIs: 2, BillableAIs: 2},
+		{Stack: "none", Lifecycle: "docker", AIs: 4, BillableAIs: 4},
+		{Stack: "windows", Lifecycle: "buildpack", AIs: 2, BillableAIs: 2},
+	}
+	if !slices.Equal(result.Stacks, wantStacks) {
+		t.Errorf("stacks %+v, want %+v", result.Stacks, wantStacks)
+	}
+	wantOrgStacks := map[string][]StackUsage{
+		"dev": {{Stack: "cflinuxfs4", Lifecycle: "buildpack", AIs: 3}},
+		"prod": {
+			{Stack: "cflinuxfs4", Lifecycle: "cnb", AIs: 2},
+			{Stack: "none", Lifecycle: "docker", AIs: 4},
+			{Stack: "windows", Lifecycle: "buildpack", AIs: 2},
+		},
+	}
+	for _, org := range result.Organizations {
+		if !slices.Equal(org.Stacks, wantOrgStacks[org.Name]) {
+			t.Errorf("org %s: stacks %+v, want %+v", org.Name, org.Stacks, wantOrgStacks[org.Name])
+		}
+	}
+
+	// Instances times the per-instance limits of the running processes
+	if result.TotalDiskGB != 23 || result.TotalBillableDiskGB != 21 {
+		t.Errorf("disk %.2f GB (billable %.2f), want 23 (billable 21)", result.TotalDiskGB, result.TotalBillableDiskGB)
+	}
+	wantDisk := map[string]float64{"dev": 3, "prod": 18}
+	wantSpaces := map[string][]SpaceAllocation{
+		"dev": {{Name: "dev", AIs: 3, MemoryGB: 1.5, DiskGB: 3}},
+		"prod": {
+			{Name: "batch", AIs: 2, MemoryGB: 4, DiskGB: 2},
+			{Name: "prod", AIs: 6, MemoryGB: 8, DiskGB: 16},
+		},
+	}
+	for _, org := range result.Organizations {
+		if org.DiskGB != wantDisk[org.Name] {
+			t.Errorf("org %s: disk %.2f GB, want %.2f", org.Name, org.DiskGB, wantDisk[org.Name])
+		}
+		if !slices.Equal(org.Spaces, wantSpaces[org.Name]) {
+			t.Errorf("org %s: spaces %+v, want %+v", org.Name, org.Spaces, wantSpaces[org.Name])
+		}
+	}
+}
+
+func TestCollectUsageDataSkipOrgs(t *testing.T) {
+	client, config := newFakeFoundation(t)
+	config.SkipOrgs = []string{"system", "dev"}
+	result, err := collectUsageData(context.Background(), client, config)
+	if err != nil {
+		t.Fatalf("collectUsageData: %v", err)
+	}
+	if result.TotalAIs != 13 || result.TotalBillableAIs != 8 {
+		t.Errorf("AIs %d (billable %d), want 13 (billable 8)", result.TotalAIs, result.TotalBillableAIs)
+	}
+	if result.TotalBillableSIs != 2 {
+		t.Errorf("billable SIs %d, want 2", result.TotalBillableSIs)
+	}
+}
+
+func TestCollectUsageDataBillableOfferings(t *testing.T) {
+	client, config := newFakeFoundation(t)
+	client.setBillableOfferings([]string{"p.redis"})
+	result, err := collectUsageData(context.Background(), client, config)
+	if err != nil {
+		t.Fatalf("collectUsageData: %v", err)
+	}
+	if result.TotalBillableSIs != 1 {
+		t.Errorf("billable SIs %d, want 1 (api-cache only)", result.TotalBillableSIs)
+	}
+}
+
+func TestCollectUsageDataUnknownPlans(t *testing.T) {
+	instance := func(guid, plan, space string) map[string]any {
+		return map[string]any{
+			"guid": guid, "name": guid, "type": "managed", "created_at": "2025-06-01T00:00:00Z",
+			"relationships": map[string]any{
+				"service_plan": map[string]any{"data": map[string]any{"guid": plan}},
+				"space":        map[string]any{"data": map[string]any{"guid": space}},
+			},
+		}
+	}
+	server := startFakeFoundation(t, func(f *fakecc.Foundation) {
+		// A plan left out of the listings, such as one from a space-scoped broker,
+		// and a plan that no longer exists at all
+		f.Lists["service_plans"] = append(f.Lists["service_plans"], map[string]any{
+			"guid": "plan-mysql-large", "name": "db-large", "unlisted": true,
+			"relationships": map[string]any{"service_offering": map[string]any{"data": map[string]any{"guid": "offering-mysql"}}},
+		})
+		f.Lists["service_instances"] = append(f.Lists["service_instances"],
+			instance("si-prod-large", "plan-mysql-large", "space-prod"),
+			instance("si-dev-retired", "plan-retired", "space-dev"))
+	})
+	client, config := newFakeClient(t, server)
+	result, err := collectUsageData(context.Background(), client, config)
+	if err != nil {
+		t.Fatalf("collectUsageData: %v", err)
+	}
+
+	// The unlisted plan is resolved by GUID and billable; the retired one stays unknown
+	if result.TotalManagedSIs != 8 || result.TotalBillableSIs != 4 || result.TotalUnknownPlanSIs != 1 {
+		t.Errorf("managed SIs %d, billable %d, unknown plans %d; want 8, 4, 1",
+			result.TotalManagedSIs, result.TotalBillableSIs, result.TotalUnknownPlanSIs)
+	}
+	for _, org := range result.Organizations {
+		want := map[string]int{"dev": 1, "prod": 0}[org.Name]
+		if org.UnknownPlanSIs != want {
+			t.Errorf("org %s: %d SIs with unknown plans, want %d", org.Name, org.UnknownPlanSIs, want)
+		}
+	}
+	for _, path := range []string{"/v3/service_plans/plan-mysql-large", "/v3/service_plans/plan-retired"} {
+		if hits := server.Hits(path); hits != 1 {
+			t.Errorf("%d requests to %s, want 1", hits, path)
+		}
+	}
+}
+
+func TestCollectQuotaUsage(t *testing.T) {
+	client, config := newFakeFoundation(t)
+	result, err := collectUsageData(context.Background(), client, config)
+	if err != nil {
+		t.Fatalf("collectUsageData: %v", err)
+	}
+
+	// The system org is skipped; dev and prod have org quotas, prod/batch a space quota
+	if len(result.Quotas) != 3 {
+		t.Fatalf("got %d quota usages, want 3: %+v", len(result.Quotas), result.Quotas)
+	}
+	prod := result.Quotas[1]
+	if prod.Org != "prod" || prod.Space != "" || prod.Quota != "prod" {
+		t.Fatalf("second quota usage is %s/%s (%s), want the prod org quota", prod.Org, prod.Space, prod.Quota)
+	}
+	want := map[string]int{
+		quotaAppInstances:     8,
+		quotaMemoryMB:         12288,
+		quotaServiceInstances: 2, // user-provided instances do not count
+		quotaRoutes:           3,
+	}
+	for _, resource := range prod.Resources {
+		if resource.Used != want[resource.Resource] {
+			t.Errorf("prod %s used %d, want %d", resource.Resource, resource.Used, want[resource.Resource])
+		}
+	}
+	if prod.MaxUtilization != 80 {
+		t.Errorf("prod max utilization %.2f, want 80", prod.MaxUtilization)
+	}
+}
+
+func TestCollectTaskUsage(t *testing.T) {
+	client, config := newFakeFoundation(t)
+	result, err := collectUsageData(context.Background(), client, config)
+	if err != nil {
+		t.Fatalf("collectUsageData: %v", err)
+	}
+
+	// app-legacy is stopped; its task still counts
+	if result.Tasks == nil || result.Tasks.Running != 2 || result.Tasks.MemoryGB != 1.5 {
+		t.Fatalf("tasks %+v, want 2 running with 1.5 GB", result.Tasks)
+	}
+	for _, org := range result.Organizations {
+		running := 0
+		if org.Tasks != nil {
+			running = org.Tasks.Running
+		}
+		if want := map[string]int{"prod": 2}[org.Name]; running != want {
+			t.Errorf("org %s runs %d tasks, want %d", org.Name, running, want)
+		}
+	}
+}
+
+func TestCollectTaskUsageWithoutApps(t *testing.T) {
+	server := startFakeFoundation(t)
+	server.Failures = map[string]int{"/v3/apps": 503}
+	client, config := newFakeClient(t, server)
+	result, err := collectUsageData(context.Background(), client, config)
+	if err != nil {
+		t.Fatalf("collectUsageData: %v", err)
+	}
+
+	// Without the apps the tasks cannot be attributed to orgs
+	if result.Tasks != nil {
+		t.Errorf("tasks %+v reported without the app listing", result.Tasks)
+	}
+	for _, org := range result.Organizations {
+		if org.Tasks != nil {
+			t.Errorf("org %s runs %+v tasks without the app listing", org.Name, org.Tasks)
+		}
+	}
+}
+
+func TestCollectIdleApps(t *testing.T) {
+	client, config := newFakeFoundation(t)
+	config.IdleApps = true
+	result, err := collectUsageData(context.Background(), client, config)
+	if err != nil {
+		t.Fatalf("collectUsageData: %v", err)
+	}
+
+	want := map[string]string{
+		"api":    idleCrashing,
+		"worker": idleNoRunningInstances,
+		"legacy": idleStopped,
+	}
+	if len(result.IdleApps) != len(want) {
+		t.Fatalf("got %d idle apps, want %d: %+v", len(result.IdleApps), len(want), result.IdleApps)
+	}
+	for _, app := range result.IdleApps {
+		if app.Reason != want[app.Name] {
+			t.Errorf("app %s idle as %q, want %q", app.Name, app.Reason, want[app.Name])
+		}
+	}
+}
+
+func TestCollectIdleAppsStatsFailure(t *testing.T) {
+	server := startFakeFoundation(t)
+	server.Failures = map[string]int{"/v3/processes/app-api/stats": 503}
+	client, config := newFakeClient(t, server)
+	config.IdleApps = true
+	result, err := collectUsageData(context.Background(), client, config)
+	if err != nil {
+		t.Fatalf("collectUsageData: %v", err)
+	}
+
+	// api is left out; the other idle apps are still reported
+	var names []string
+	for _, app := range result.IdleApps {
+		names = append(names, app.Name)
+	}
+	if len(names) != 2 || names[0] != "worker" || names[1] != "legacy" {
+		t.Errorf("idle apps %v, want [worker legacy]", names)
+	}
+}
+
+func TestCollectIsolationSegmentUsage(t *testing.T) {
+	tests := []struct {
+		name string
+		edit func(*fakecc.Foundation)
+		want map[string]int // segment -> AIs
+	}{
+		{
+			name: "segments",
+			edit: func(*fakecc.Foundation) {},
+			// prod runs on prod-cells by default, except the batch space assigned to shared
+			want: map[string]int{"prod-cells": 6, "shared": 7},
+		},
+		{
+			name: "shared only",
+			edit: func(f *fakecc.Foundation) { f.Lists["isolation_segments"] = nil },
+			want: map[string]int{"shared": 13},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, config := newFakeClient(t, startFakeFoundation(t, tt.edit))
+			result, err := collectUsageData(context.Background(), client, config)
+			if err != nil {
+				t.Fatalf("collectUsageData: %v", err)
+			}
+
+			ais, billableAIs := 0, 0
+			for _, segment := range result.IsolationSegments {
+				if segment.AIs != tt.want[segment.Name] {
+					t.Errorf("segment %s has %d AIs, want %d", segment.Name, segment.AIs, tt.want[segment.Name])
+				}
+				ais += segment.AIs
+				billableAIs += segment.BillableAIs
+			}
+			if len(result.IsolationSegments) != len(tt.want) {
+				t.Errorf("got %d segments, want %d", len(result.IsolationSegments), len(tt.want))
+			}
+			if ais != result.TotalAIs || billableAIs != result.TotalBillableAIs {
+				t.Errorf("segments sum to %d AIs (billable %d), totals are %d (billable %d)",
+					ais, billableAIs, result.TotalAIs, result.TotalBillableAIs)
+			}
+		})
+	}
+}
+
+func TestCollectUsageDataBrokerFailure(t *testing.T) {
+	server := startFakeFoundation(t)
+	server.Failures = map[string]int{"/v3/service_brokers": 500}
+	client, config := newFakeClient(t, server)
+
+	// Without brokers the space-scoped postgres would be billed as the global one
+	if _, err := collectUsageData(context.Background(), client, config); err == nil {
+		t.Fatal("collectUsageData succeeded without service brokers")
+	}
+}
+
+func TestCollectUsageDataSharingFailure(t *testing.T) {
+	server := startFakeFoundation(t)
+	server.Failures = map[string]int{"/v3/service_instances/si-prod-db/relationships/shared_spaces": 503}
+	client, config := newFakeClient(t, server)
+
+	// Counting api-db as not shared would put it in dev's SIs as well
+	if _, err := collectUsageData(context.Background(), client, config); err == nil {
+		t.Fatal("collectUsageData succeeded without the shared spaces of api-db")
+	}
+}
+
+func TestOrphansBindingsFailure(t *testing.T) {
+	server := startFakeFoundation(t)
+	server.Failures = map[string]int{"/v3/service_credential_bindings": 503}
+	client, config := newFakeClient(t, server)
+
+	result, listings, err := collectSnapshot(context.Background(), client, config)
+	if err != nil {
+		t.Fatalf("collectSnapshot: %v", err)
+	}
+	if listings.bindingsErr == nil {
+		t.Error("no bindings error after the credential bindings failed")
+	}
+	if result.OrphanedServiceInstances != nil {
+		t.Errorf("orphans %v without credential bindings, want none reported", result.OrphanedServiceInstances)
+	}
+
+	// The endpoint must not serve an empty list as if nothing were orphaned
+	cached := &CachedData{}
+	cached.Set(result)
+	rec := httptest.NewRecorder()
+	orphansHandler(cached)(rec, httptest.NewRequest(http.MethodGet, "/orphans", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("GET /orphans status %d, want 503: %s", rec.Code, rec.Body)
+	}
+}
@@ -0,0 +1,477 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// defaultBillableOfferings are the service offerings counted as billable SIs
+var defaultBillableOfferings = []string{
+	"p.mysql",
+	"p-mysql",
+	"p.rabbitmq",
+	"p-rabbitmq",
+	"p.redis",
+	"p-redis",
+	"postgres",
+	"genai",
+	"genai-service",
+}
+
+const redacted = "<redacted>"
+
+// fileConfig mirrors the layout of the YAML configuration file
+type fileConfig struct {
+	API struct {
+		Endpoint          string `yaml:"endpoint,omitempty"`
+		SkipSSLValidation bool   `yaml:"skip_ssl_validation"`
+		CACert            string `yaml:"ca_cert,omitempty"`
+		ClientCert        string `yaml:"client_cert,omitempty"`
+		ClientKey         string `yaml:"client_key,omitempty"`
+		MinTLSVersion     string `yaml:"min_tls_version,omitempty"`
+	} `yaml:"api"`
+	Auth struct {
+		Username     string `yaml:"username,omitempty"`
+		Password     string `yaml:"password,omitempty"`
+		ClientID     string `yaml:"client_id,omitempty"`
+		ClientSecret string `yaml:"client_secret,omitempty"`
+
+		UsernameFile     string `yaml:"username_file,omitempty"`
+		PasswordFile     string `yaml:"password_file,omitempty"`
+		ClientSecretFile string `yaml:"client_secret_file,omitempty"`
+		ServiceBinding   string `yaml:"service_binding,omitempty"`
+
+		AllowGuessedEndpoints bool `yaml:"allow_guessed_endpoints"`
+	} `yaml:"auth"`
+	SkipOrgs          []string `yaml:"skip_orgs"`
+	BillableOfferings []string `yaml:"billable_offerings"`
+	CollectionTimeout string   `yaml:"collection_timeout,omitempty"`
+	Server            struct {
+		Port            int    `yaml:"port,omitempty"`
+		RefreshInterval string `yaml:"refresh_interval,omitempty"`
+		AdminToken      string `yaml:"admin_token,omitempty"`
+	} `yaml:"server"`
+	AppUsageService struct {
+		Endpoint   string `yaml:"endpoint,omitempty"`
+		OrgReports bool   `yaml:"org_reports"`
+	} `yaml:"app_usage_service"`
+	Workloads struct {
+		Sidecars bool `yaml:"sidecars"`
+		IdleApps bool `yaml:"idle_apps"`
+	} `yaml:"workloads"`
+	Events struct {
+		AppUsage     bool   `yaml:"app_usage"`
+		ServiceUsage bool   `yaml:"service_usage"`
+		StateDir     string `yaml:"state_dir,omitempty"`
+	} `yaml:"events"`
+	Output struct {
+		JSON    bool `yaml:"json"`
+		Verbose bool `yaml:"verbose"`
+	} `yaml:"output"`
+}
+
+// defaultConfig returns the built-in configuration defaults
+func defaultConfig() *Config {
+	return &Config{
+		ClientID:          "cf",
+		SkipOrgs:          []string{"system"},
+		BillableOfferings: append([]string(nil), defaultBillableOfferings...),
+		Port:              8080,
+		RefreshInterval:   60 * time.Minute,
+		CollectionTimeout: 10 * time.Minute,
+	}
+}
+
+// loadConfig builds the effective configuration.
+// Precedence is flags > environment > service binding > config file > defaults.
+func loadConfig(flags *cliFlags) (*Config, error) {
+	config := defaultConfig()
+
+	path := os.Getenv("TPCF_CONFIG")
+	if flags != nil && flags.configFile != "" {
+		path = flags.configFile
+	}
+	if path != "" {
+		if err := applyConfigFile(config, path); err != nil {
+			return nil, err
+		}
+		config.ConfigFile = path
+	}
+
+	if v := os.Getenv("TPCF_CREDENTIALS_SERVICE"); v != "" {
+		config.CredentialsService = v
+	}
+	if err := applyServiceBinding(config); err != nil {
+		return nil, err
+	}
+
+	if err := applyEnv(config); err != nil {
+		return nil, err
+	}
+	if flags != nil {
+		flags.apply(config)
+	}
+
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// applyConfigFile overlays the values set in a YAML config file
+func applyConfigFile(config *Config, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	var fc fileConfig
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&fc); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+
+	if fc.API.Endpoint != "" {
+		config.APIEndpoint = fc.API.Endpoint
+	}
+	if fc.API.SkipSSLValidation {
+		config.SkipSSLValidation = true
+	}
+	if fc.API.CACert != "" {
+		config.CACert = fc.API.CACert
+	}
+	if fc.API.ClientCert != "" {
+		config.ClientCert = fc.API.ClientCert
+	}
+	if fc.API.ClientKey != "" {
+		config.ClientKey = fc.API.ClientKey
+	}
+	if fc.API.MinTLSVersion != "" {
+		config.MinTLSVersion = fc.API.MinTLSVersion
+	}
+	if fc.Auth.Username != "" {
+		config.Username = fc.Auth.Username
+	}
+	if fc.Auth.Password != "" {
+		config.Password = fc.Auth.Password
+	}
+	if fc.Auth.ClientID != "" {
+		config.ClientID = fc.Auth.ClientID
+	}
+	if fc.Auth.ClientSecret != "" {
+		config.ClientSecret = fc.Auth.ClientSecret
+	}
+	if fc.Auth.UsernameFile != "" {
+		config.UsernameFile = fc.Auth.UsernameFile
+	}
+	if fc.Auth.PasswordFile != "" {
+		config.PasswordFile = fc.Auth.PasswordFile
+	}
+	if fc.Auth.ClientSecretFile != "" {
+		config.ClientSecretFile = fc.Auth.ClientSecretFile
+	}
+	if fc.Auth.ServiceBinding != "" {
+		config.CredentialsService = fc.Auth.ServiceBinding
+	}
+	if fc.Auth.AllowGuessedEndpoints {
+		config.AllowGuessedAuthEndpoints = true
+	}
+	if fc.SkipOrgs != nil {
+		config.SkipOrgs = fc.SkipOrgs
+	}
+	if fc.BillableOfferings != nil {
+		config.BillableOfferings = fc.BillableOfferings
+	}
+	if fc.CollectionTimeout != "" {
+		timeout, err := parseInterval(fc.CollectionTimeout)
+		if err != nil {
+			return fmt.Errorf("config file %s: collection_timeout: %w", path, err)
+		}
+		config.CollectionTimeout = timeout
+	}
+	if fc.Server.Port != 0 {
+		config.Port = fc.Server.Port
+	}
+	if fc.Server.RefreshInterval != "" {
+		interval, err := parseInterval(fc.Server.RefreshInterval)
+		if err != nil {
+			return fmt.Errorf("config file %s: server.refresh_interval: %w", path, err)
+		}
+		config.RefreshInterval = interval
+	}
+	if fc.Server.AdminToken != "" {
+		config.AdminToken = fc.Server.AdminToken
+	}
+	if fc.AppUsageService.Endpoint != "" {
+		config.AppUsageEndpoint = fc.AppUsageService.Endpoint
+	}
+	if fc.AppUsageService.OrgReports {
+		config.AppUsageOrgReports = true
+	}
+	if fc.Workloads.Sidecars {
+		config.Sidecars = true
+	}
+	if fc.Workloads.IdleApps {
+		config.IdleApps = true
+	}
+	if fc.Events.AppUsage {
+		config.AppUsageEvents = true
+	}
+	if fc.Events.ServiceUsage {
+		config.ServiceUsageEvents = true
+	}
+	if fc.Events.StateDir != "" {
+		config.StateDir = fc.Events.StateDir
+	}
+	if fc.Output.JSON {
+		config.JSONOutput = true
+	}
+	if fc.Output.Verbose {
+		config.Verbose = true
+	}
+	return nil
+}
+
+// applyEnv overlays the values set in environment variables
+func applyEnv(config *Config) error {
+	setString := func(name string, dst *string) {
+		if v := os.Getenv(name); v != "" {
+			*dst = v
+		}
+	}
+	setString("CF_API_ENDPOINT", &config.APIEndpoint)
+	setString("CF_USERNAME", &config.Username)
+	setString("CF_PASSWORD", &config.Password)
+	if v := os.Getenv("CF_CLIENT_ID"); v != "" {
+		// A custom client ID never inherits the secret configured for another client
+		config.ClientID = v
+		config.ClientSecret = os.Getenv("CF_CLIENT_SECRET")
+	} else {
+		setString("CF_CLIENT_SECRET", &config.ClientSecret)
+	}
+	setString("CF_USERNAME_FILE", &config.UsernameFile)
+	setString("CF_PASSWORD_FILE", &config.PasswordFile)
+	setString("CF_CLIENT_SECRET_FILE", &config.ClientSecretFile)
+	if v := os.Getenv("CF_ALLOW_GUESSED_AUTH_ENDPOINTS"); v != "" {
+		config.AllowGuessedAuthEndpoints = v == "true"
+	}
+	if v := os.Getenv("CF_SKIP_SSL_VALIDATION"); v != "" {
+		config.SkipSSLValidation = v == "true"
+	}
+	setString("CF_CA_CERT", &config.CACert)
+	setString("CF_CLIENT_CERT", &config.ClientCert)
+	setString("CF_CLIENT_KEY", &config.ClientKey)
+	setString("CF_MIN_TLS_VERSION", &config.MinTLSVersion)
+
+	if v, ok := os.LookupEnv("TPCF_SKIP_ORGS"); ok {
+		config.SkipOrgs = splitList(v)
+	}
+	if v := os.Getenv("TPCF_BILLABLE_OFFERINGS"); v != "" {
+		config.BillableOfferings = splitList(v)
+	}
+
+	if v := os.Getenv("TPCF_COLLECTION_TIMEOUT"); v != "" {
+		timeout, err := parseInterval(v)
+		if err != nil {
+			return fmt.Errorf("invalid TPCF_COLLECTION_TIMEOUT: %w", err)
+		}
+		config.CollectionTimeout = timeout
+	}
+
+	if os.Getenv("TPCF_SERVER_MODE") == "true" {
+		config.ServerMode = true
+	}
+	if v := os.Getenv("PORT"); v != "" {
+		port, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("invalid PORT %q: %w", v, err)
+		}
+		config.Port = port
+	}
+	if v := os.Getenv("TPCF_REFRESH_INTERVAL"); v != "" {
+		interval, err := parseInterval(v)
+		if err != nil {
+			return fmt.Errorf("invalid TPCF_REFRESH_INTERVAL: %w", err)
+		}
+		config.RefreshInterval = interval
+	}
+	setString("TPCF_ADMIN_TOKEN", &config.AdminToken)
+
+	setString("APP_USAGE_ENDPOINT", &config.AppUsageEndpoint)
+	if v := os.Getenv("TPCF_APP_USAGE_ORG_REPORTS"); v != "" {
+		config.AppUsageOrgReports = v == "true"
+	}
+	if v := os.Getenv("TPCF_SIDECARS"); v != "" {
+		config.Sidecars = v == "true"
+	}
+	if v := os.Getenv("TPCF_IDLE_APPS"); v != "" {
+		config.IdleApps = v == "true"
+	}
+	if v := os.Getenv("TPCF_APP_USAGE_EVENTS"); v != "" {
+		config.AppUsageEvents = v == "true"
+	}
+	if v := os.Getenv("TPCF_SERVICE_USAGE_EVENTS"); v != "" {
+		config.ServiceUsageEvents = v == "true"
+	}
+	setString("TPCF_STATE_DIR", &config.StateDir)
+
+	if os.Getenv("TPCF_VERBOSE") == "true" {
+		config.Verbose = true
+	}
+	if os.Getenv("TPCF_JSON_OUTPUT") == "true" {
+		config.JSONOutput = true
+	}
+	return nil
+}
+
+// parseInterval accepts a Go duration ("30m", "2h") or a plain number of minutes
+func parseInterval(value string) (time.Duration, error) {
+	if minutes, err := strconv.Atoi(value); err == nil {
+		return time.Duration(minutes) * time.Minute, nil
+	}
+	interval, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("%q is neither a duration nor a number of minutes", value)
+	}
+	return interval, nil
+}
+
+// validate checks the configuration for values that can never work
+func (c *Config) validate() error {
+	var problems []string
+
+	if c.APIEndpoint != "" {
+		u, err := url.Parse(c.APIEndpoint)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			problems = append(problems, fmt.Sprintf("api endpoint %q must be an http(s) URL", c.APIEndpoint))
+		}
+	}
+	if c.AppUsageEndpoint != "" {
+		u, err := url.Parse(c.AppUsageEndpoint)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			problems = append(problems, fmt.Sprintf("app-usage endpoint %q must be an http(s) URL", c.AppUsageEndpoint))
+		}
+	}
+	if (c.ClientSecret != "" || c.ClientSecretFile != "") && c.ClientID == "" {
+		problems = append(problems, "client secret set without a client ID")
+	}
+	if (c.ClientCert == "") != (c.ClientKey == "") {
+		problems = append(problems, "client certificate and client key must be set together")
+	}
+	if _, ok := tlsVersions[c.MinTLSVersion]; c.MinTLSVersion != "" && !ok {
+		problems = append(problems, fmt.Sprintf("unsupported minimum TLS version %q (want 1.2 or 1.3)", c.MinTLSVersion))
+	}
+	for _, path := range []string{c.UsernameFile, c.PasswordFile, c.ClientSecretFile} {
+		if path == "" {
+			continue
+		}
+		if _, err := os.Stat(path); err != nil {
+			problems = append(problems, fmt.Sprintf("secret file: %v", err))
+		}
+	}
+	if c.RecordDir != "" && c.ReplayDir != "" {
+		problems = append(problems, "record and replay cannot be combined")
+	}
+	if c.CollectionTimeout < 0 {
+		problems = append(problems, fmt.Sprintf("collection timeout %v must not be negative", c.CollectionTimeout))
+	}
+	if c.Port < 1 || c.Port > 65535 {
+		problems = append(problems, fmt.Sprintf("port %d out of range", c.Port))
+	}
+	if c.RefreshInterval <= 0 {
+		problems = append(problems, fmt.Sprintf("refresh interval %v must be positive", c.RefreshInterval))
+	}
+	for _, name := range c.SkipOrgs {
+		if name == "" {
+			problems = append(problems, "skip orgs contains an empty name")
+			break
+		}
+	}
+	for _, name := range c.BillableOfferings {
+		if name == "" {
+			problems = append(problems, "billable offerings contains an empty name")
+			break
+		}
+		if broker, offering, qualified := strings.Cut(name, ":"); qualified && (broker == "" || offering == "") {
+			problems = append(problems, fmt.Sprintf("billable offering %q must be an offering name or broker:offering", name))
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid configuration: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// printConfig writes the effective configuration as YAML with secrets redacted
+func printConfig(w io.Writer, config *Config) error {
+	var fc fileConfig
+	fc.API.Endpoint = config.APIEndpoint
+	fc.API.SkipSSLValidation = config.SkipSSLValidation
+	fc.API.CACert = describePEM(config.CACert)
+	fc.API.ClientCert = describePEM(config.ClientCert)
+	if strings.HasPrefix(strings.TrimSpace(config.ClientKey), "-----BEGIN") {
+		fc.API.ClientKey = redacted
+	} else {
+		fc.API.ClientKey = config.ClientKey
+	}
+	fc.API.MinTLSVersion = config.MinTLSVersion
+	fc.Auth.Username = config.Username
+	fc.Auth.ClientID = config.ClientID
+	if config.Password != "" {
+		fc.Auth.Password = redacted
+	}
+	if config.ClientSecret != "" {
+		fc.Auth.ClientSecret = redacted
+	}
+	fc.Auth.UsernameFile = config.UsernameFile
+	fc.Auth.PasswordFile = config.PasswordFile
+	fc.Auth.ClientSecretFile = config.ClientSecretFile
+	fc.Auth.ServiceBinding = config.CredentialsService
+	fc.Auth.AllowGuessedEndpoints = config.AllowGuessedAuthEndpoints
+	fc.SkipOrgs = config.SkipOrgs
+	fc.BillableOfferings = config.BillableOfferings
+	fc.CollectionTimeout = config.CollectionTimeout.String()
+	fc.Server.Port = config.Port
+	fc.Server.RefreshInterval = config.RefreshInterval.String()
+	if config.AdminToken != "" {
+		fc.Server.AdminToken = redacted
+	}
+	fc.AppUsageService.Endpoint = config.AppUsageEndpoint
+	fc.AppUsageService.OrgReports = config.AppUsageOrgReports
+	fc.Workloads.Sidecars = config.Sidecars
+	fc.Workloads.IdleApps = config.IdleApps
+	fc.Events.AppUsage = config.AppUsageEvents
+	fc.Events.ServiceUsage = config.ServiceUsageEvents
+	fc.Events.StateDir = config.StateDir
+	fc.Output.JSON = config.JSONOutput
+	fc.Output.Verbose = config.Verbose
+
+	if config.ConfigFile != "" {
+		fmt.Fprintf(w, "# loaded from %s\n", config.ConfigFile)
+	}
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(&fc); err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+// describePEM shows file paths as-is and summarizes inline PEM data
+func describePEM(value string) string {
+	if strings.HasPrefix(strings.TrimSpace(value), "-----BEGIN") {
+		return "<inline PEM>"
+	}
+	return value
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestApplyServiceBinding(t *testing.T) {
+	tests := []struct {
+		name         string
+		vcap         string
+		service      string // TPCF_CREDENTIALS_SERVICE
+		wantEndpoint string
+		wantUsername string
+		wantPassword string
+		wantErr      string
+	}{
+		{name: "not on Cloud Foundry"},
+		{name: "named service without VCAP_SERVICES", service: "cf-creds", wantErr: "VCAP_SERVICES is not set"},
+		{name: "invalid VCAP_SERVICES", vcap: `{`, wantErr: "failed to parse VCAP_SERVICES"},
+		{
+			name:         "single user-provided binding",
+			vcap:         `{"user-provided":[{"name":"cf-creds","label":"user-provided","credentials":{"api_endpoint":"https://api.binding.example.com","username":"binding-user","password":"binding-pass"}}]}`,
+			wantEndpoint: "https://api.binding.example.com", wantUsername: "binding-user", wantPassword: "binding-pass",
+		},
+		{
+			name:         "CF_* keys in a CredHub binding",
+			vcap:         `{"credhub":[{"name":"cf-creds","label":"credhub","credentials":{"CF_USERNAME":"credhub-user","CF_PASSWORD":"credhub-pass"}}]}`,
+			wantUsername: "credhub-user", wantPassword: "credhub-pass",
+		},
+		{
+			name: "other service types are ignored",
+			vcap: `{"p.mysql":[{"name":"db","label":"p.mysql","credentials":{"username":"db-user","password":"db-pass"}}]}`,
+		},
+		{
+			name:    "several matching bindings",
+			vcap:    `{"user-provided":[{"name":"creds-a","label":"user-provided","credentials":{"api_endpoint":"https://api.a.example.com","password":"a"}},{"name":"creds-b","label":"user-provided","credentials":{"api_endpoint":"https://api.b.example.com","password":"b"}}]}`,
+			wantErr: "several bound services carry credentials (creds-a, creds-b)",
+		},
+		{
+			name:    "several matching bindings across labels",
+			vcap:    `{"user-provided":[{"name":"creds-a","label":"user-provided","credentials":{"CF_PASSWORD":"a"}}],"credhub":[{"name":"creds-b","label":"credhub","credentials":{"CF_CLIENT_SECRET":"b"}}]}`,
+			wantErr: "select one with TPCF_CREDENTIALS_SERVICE",
+		},
+		{
+			name:         "several matching bindings, one selected by name",
+			vcap:         `{"user-provided":[{"name":"creds-a","label":"user-provided","credentials":{"username":"a","password":"a"}},{"name":"creds-b","label":"user-provided","credentials":{"username":"b","password":"b"}}]}`,
+			service:      "creds-b",
+			wantUsername: "b", wantPassword: "b",
+		},
+		{
+			name: "unrelated user-provided service",
+			vcap: `{"user-provided":[{"name":"orders-db","label":"user-provided","credentials":{"uri":"postgres://db.example.com/orders","username":"orders","password":"db-pass"}}]}`,
+		},
+		{
+			name:         "unrelated user-provided service next to the CF credentials",
+			vcap:         `{"user-provided":[{"name":"orders-db","label":"user-provided","credentials":{"username":"orders","password":"db-pass"}},{"name":"cf-creds","label":"user-provided","credentials":{"api_endpoint":"https://api.binding.example.com","username":"binding-user","password":"binding-pass"}}]}`,
+			wantEndpoint: "https://api.binding.example.com", wantUsername: "binding-user", wantPassword: "binding-pass",
+		},
+		{
+			name:         "unrelated service selected by name",
+			vcap:         `{"user-provided":[{"name":"orders-db","label":"user-provided","credentials":{"username":"orders","password":"db-pass"}}]}`,
+			service:      "orders-db",
+			wantUsername: "orders", wantPassword: "db-pass",
+		},
+		{
+			name:    "named service not bound",
+			vcap:    `{"user-provided":[{"name":"creds-a","label":"user-provided","credentials":{"password":"a"}}]}`,
+			service: "creds-b",
+			wantErr: `credentials service "creds-b" is not bound`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("VCAP_SERVICES", tt.vcap)
+			config := defaultConfig()
+			config.CredentialsService = tt.service
+
+			err := applyServiceBinding(config)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("applyServiceBinding: %v", err)
+			}
+			if config.APIEndpoint != tt.wantEndpoint || config.Username != tt.wantUsername || config.Password != tt.wantPassword {
+				t.Errorf("endpoint %q, username %q, password %q; want %q, %q, %q",
+					config.APIEndpoint, config.Username, config.Password, tt.wantEndpoint, tt.wantUsername, tt.wantPassword)
+			}
+		})
+	}
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "config.yml")
+	err := os.WriteFile(file, []byte(`api:
+  endpoint: https://api.file.example.com
+  min_tls_version: "1.2"
+auth:
+  username: file-user
+skip_orgs: [file-org]
+`), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	binding := `{"user-provided":[{"name":"cf-creds","label":"user-provided","credentials":{"api_endpoint":"https://api.binding.example.com","username":"binding-user","password":"binding-pass"}}]}`
+
+	tests := []struct {
+		name         string
+		file         bool
+		binding      bool
+		env          map[string]string
+		flags        []string
+		wantEndpoint string
+		wantUsername string
+		wantSkipOrgs []string
+		wantTLS      string
+	}{
+		{
+			name:         "defaults",
+			wantSkipOrgs: []string{"system"},
+		},
+		{
+			name: "config file over defaults", file: true,
+			wantEndpoint: "https://api.file.example.com", wantUsername: "file-user", wantSkipOrgs: []string{"file-org"}, wantTLS: "1.2",
+		},
+		{
+			name: "service binding over config file", file: true, binding: true,
+			wantEndpoint: "https://api.binding.example.com", wantUsername: "binding-user", wantSkipOrgs: []string{"file-org"}, wantTLS: "1.2",
+		},
+		{
+			name: "environment over service binding", file: true, binding: true,
+			env:          map[string]string{"CF_API_ENDPOINT": "https://api.env.example.com", "TPCF_SKIP_ORGS": "env-org", "CF_MIN_TLS_VERSION": "1.3"},
+			wantEndpoint: "https://api.env.example.com", wantUsername: "binding-user", wantSkipOrgs: []string{"env-org"}, wantTLS: "1.3",
+		},
+		{
+			name: "flags over environment", file: true, binding: true,
+			env:          map[string]string{"CF_API_ENDPOINT": "https://api.env.example.com", "TPCF_SKIP_ORGS": "env-org", "CF_MIN_TLS_VERSION": "1.3"},
+			flags:        []string{"--skip-orgs", "flag-org,other-org", "--min-tls-version", "1.2"},
+			wantEndpoint: "https://api.env.example.com", wantUsername: "binding-user", wantSkipOrgs: []string{"flag-org", "other-org"}, wantTLS: "1.2",
+		},
+		{
+			name: "unset flags keep lower layers", file: true,
+			env:          map[string]string{"TPCF_SKIP_ORGS": "env-org"},
+			flags:        []string{"--verbose"},
+			wantEndpoint: "https://api.file.example.com", wantUsername: "file-user", wantSkipOrgs: []string{"env-org"}, wantTLS: "1.2",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, key := range []string{"CF_API_ENDPOINT", "CF_USERNAME", "CF_MIN_TLS_VERSION", "TPCF_CONFIG", "TPCF_CREDENTIALS_SERVICE"} {
+				t.Setenv(key, "")
+			}
+			// An empty TPCF_SKIP_ORGS clears the skip list, so it must be unset
+			t.Setenv("TPCF_SKIP_ORGS", "")
+			os.Unsetenv("TPCF_SKIP_ORGS")
+			for key, value := range tt.env {
+				t.Setenv(key, value)
+			}
+			if tt.binding {
+				t.Setenv("VCAP_SERVICES", binding)
+			} else {
+				t.Setenv("VCAP_SERVICES", "")
+			}
+
+			flags := newCLIFlags(flag.NewFlagSet("report", flag.ContinueOnError))
+			flags.addCollectionFlags()
+			args := tt.flags
+			if tt.file {
+				args = append([]string{"--config", file}, args...)
+			}
+			if err := flags.fs.Parse(args); err != nil {
+				t.Fatal(err)
+			}
+
+			config, err := loadConfig(flags)
+			if err != nil {
+				t.Fatalf("loadConfig: %v", err)
+			}
+			if config.APIEndpoint != tt.wantEndpoint || config.Username != tt.wantUsername || config.MinTLSVersion != tt.wantTLS {
+				t.Errorf("endpoint %q, username %q, TLS %q; want %q, %q, %q",
+					config.APIEndpoint, config.Username, config.MinTLSVersion, tt.wantEndpoint, tt.wantUsername, tt.wantTLS)
+			}
+			if !slices.Equal(config.SkipOrgs, tt.wantSkipOrgs) {
+				t.Errorf("skip orgs %v, want %v", config.SkipOrgs, tt.wantSkipOrgs)
+			}
+		})
+	}
+}
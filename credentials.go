@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+// credentials resolves the secrets used to authenticate. File-backed values
+// are re-read on every authentication so rotated secrets are picked up
+// without a restart.
+type credentials struct {
+	username         string
+	password         string
+	clientSecret     string
+	usernameFile     string
+	passwordFile     string
+	clientSecretFile string
+}
+
+func newCredentials(config *Config) *credentials {
+	return &credentials{
+		username:         config.Username,
+		password:         config.Password,
+		clientSecret:     config.ClientSecret,
+		usernameFile:     config.UsernameFile,
+		passwordFile:     config.PasswordFile,
+		clientSecretFile: config.ClientSecretFile,
+	}
+}
+
+// configured reports whether a username and password are available
+func (c *credentials) configured() bool {
+	return (c.username != "" || c.usernameFile != "") && (c.password != "" || c.passwordFile != "")
+}
+
+// resolve returns the current username, password and client secret.
+// A file, when set, takes precedence over the plain value.
+func (c *credentials) resolve() (username, password, clientSecret string, err error) {
+	if username, err = secretValue(c.username, c.usernameFile); err != nil {
+		return "", "", "", err
+	}
+	if password, err = secretValue(c.password, c.passwordFile); err != nil {
+		return "", "", "", err
+	}
+	if clientSecret, err = secretValue(c.clientSecret, c.clientSecretFile); err != nil {
+		return "", "", "", err
+	}
+	return username, password, clientSecret, nil
+}
+
+// secretValue reads path if set, otherwise returns value
+func secretValue(value, path string) (string, error) {
+	if path == "" {
+		return value, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read secret file: %w", err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// vcapService is a single service binding in VCAP_SERVICES
+type vcapService struct {
+	Name        string         `json:"name"`
+	Label       string         `json:"label"`
+	Credentials map[string]any `json:"credentials"`
+}
+
+// credentialLabels are the service labels that may carry CF credentials
+var credentialLabels = map[string]bool{
+	"user-provided": true,
+	"credhub":       true,
+}
+
+// applyServiceBinding overlays credentials from a bound user-provided or
+// CredHub service instance when running on Cloud Foundry. The binding is
+// selected by name when config.CredentialsService is set, otherwise the
+// single candidate marked as CF credentials and carrying a password or
+// client secret is used. Unrelated services, e.g. a user-provided database,
+// are never picked up automatically.
+func applyServiceBinding(config *Config) error {
+	raw := os.Getenv("VCAP_SERVICES")
+	if raw == "" {
+		if config.CredentialsService != "" {
+			return fmt.Errorf("credentials service %q configured but VCAP_SERVICES is not set", config.CredentialsService)
+		}
+		return nil
+	}
+
+	var services map[string][]vcapService
+	if err := json.Unmarshal([]byte(raw), &services); err != nil {
+		return fmt.Errorf("failed to parse VCAP_SERVICES: %w", err)
+	}
+
+	var candidates []vcapService
+	for _, bindings := range services {
+		for _, binding := range bindings {
+			if config.CredentialsService != "" {
+				if binding.Name == config.CredentialsService {
+					candidates = append(candidates, binding)
+				}
+				continue
+			}
+			if credentialLabels[binding.Label] && hasCFMarker(binding) &&
+				(bindingValue(binding, "password") != "" || bindingValue(binding, "client_secret") != "") {
+				candidates = append(candidates, binding)
+			}
+		}
+	}
+
+	switch {
+	case len(candidates) == 0 && config.CredentialsService != "":
+		return fmt.Errorf("credentials service %q is not bound to this app", config.CredentialsService)
+	case len(candidates) == 0:
+		return nil
+	case len(candidates) > 1:
+		names := make([]string, len(candidates))
+		for i, c := range candidates {
+			names[i] = c.Name
+		}
+		return fmt.Errorf("several bound services carry credentials (%s); select one with TPCF_CREDENTIALS_SERVICE", strings.Join(names, ", "))
+	}
+
+	binding := candidates[0]
+	setString := func(key string, dst *string) {
+		if v := bindingValue(binding, key); v != "" {
+			*dst = v
+		}
+	}
+	setString("api_endpoint", &config.APIEndpoint)
+	setString("username", &config.Username)
+	setString("password", &config.Password)
+	setString("client_id", &config.ClientID)
+	setString("client_secret", &config.ClientSecret)
+	log.Printf("Using credentials from bound service %q (%s)", binding.Name, binding.Label)
+	return nil
+}
+
+// hasCFMarker reports whether a binding is meant for the CF API: it carries
+// an api_endpoint or any CF_* key
+func hasCFMarker(binding vcapService) bool {
+	if _, ok := binding.Credentials["api_endpoint"]; ok {
+		return true
+	}
+	for key := range binding.Credentials {
+		if strings.HasPrefix(key, "CF_") {
+			return true
+		}
+	}
+	return false
+}
+
+// bindingValue looks up a credential by its snake_case key or the matching
+// CF_* environment variable name (e.g. "password" or "CF_PASSWORD")
+func bindingValue(binding vcapService, key string) string {
+	for _, k := range []string{key, "CF_" + strings.ToUpper(key)} {
+		if v, ok := binding.Credentials[k].(string); ok && v != "" {
+			return v
+		}
+	}
+	return ""
+}
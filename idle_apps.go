@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"sort"
+	"text/tabwriter"
+	"time"
+)
+
+// Reasons an app is reported as idle
+const (
+	idleStopped            = "stopped"
+	idleScaledToZero       = "scaled_to_zero"
+	idleNoRunningInstances = "no_running_instances"
+	idleCrashing           = "crashing"
+)
+
+// getProcessStats returns the state of every desired instance of a process
+func (c *CFClient) getProcessStats(ctx context.Context, guid string) (*ProcessStats, error) {
+	data, err := c.apiCall(ctx, "/v3/processes/"+url.PathEscape(guid)+"/stats")
+	if err != nil {
+		return nil, err
+	}
+	var stats ProcessStats
+	if err := json.Unmarshal(data, &stats); err != nil {
+		return nil, fmt.Errorf("failed to parse process stats: %w", err)
+	}
+	return &stats, nil
+}
+
+// collectIdleApps finds the stopped apps and the started apps that are
+// scaled to zero, have no running instance or have crashed instances, with
+// the service instances bound to them. Skipped orgs are left out. Only the
+// started processes with instances cost a stats request each; an app whose
+// stats cannot be read, e.g. while it is being deleted, is logged and left out.
+func collectIdleApps(ctx context.Context, source UsageSource, listings *foundationListings, config *Config, now time.Time) ([]IdleApp, error) {
+	if listings.bindingsErr != nil {
+		return nil, listings.bindingsErr
+	}
+	catalog := source.catalog()
+
+	orgNames := make(map[string]string)
+	for _, org := range listings.orgs {
+		if !shouldSkipOrg(org.Name, config.SkipOrgs) {
+			orgNames[org.GUID] = org.Name
+		}
+	}
+	spacesByGUID := listings.spacesByGUID()
+	appProcesses := make(map[string][]Process)
+	for _, process := range listings.processes {
+		app := guidFromHref(process.Links.App.Href)
+		appProcesses[app] = append(appProcesses[app], process)
+	}
+	instances := make(map[string]ServiceInstance)
+	for _, instance := range listings.instances.Instances {
+		instances[instance.GUID] = instance
+	}
+	bound := make(map[string][]BoundServiceInstance) // app GUID ->
+	for _, binding := range listings.bindings {
+		instance, ok := instances[binding.Relationships.ServiceInstance.Data.GUID]
+		if binding.Type != "app" || !ok {
+			continue
+		}
+		billable, _ := catalog.isServiceInstanceBillable(instance)
+		app := binding.Relationships.App.Data.GUID
+		bound[app] = append(bound[app], BoundServiceInstance{
+			Name:     instance.Name,
+			Offering: catalog.serviceOffering(instance.Relationships.ServicePlan.Data.GUID).Name,
+			Billable: billable,
+		})
+	}
+
+	idle := []IdleApp{}
+apps:
+	for _, app := range listings.apps {
+		space := spacesByGUID[app.Relationships.Space.Data.GUID]
+		orgName, ok := orgNames[space.Relationships.Organization.Data.GUID]
+		if !ok {
+			continue
+		}
+
+		entry := IdleApp{
+			GUID:             app.GUID,
+			Name:             app.Name,
+			Org:              orgName,
+			Space:            space.Name,
+			State:            app.State,
+			ServiceInstances: bound[app.GUID],
+			UpdatedAt:        app.UpdatedAt,
+		}
+		if !app.UpdatedAt.IsZero() {
+			entry.AgeDays = int(now.Sub(app.UpdatedAt).Hours() / 24)
+		}
+		for _, process := range appProcesses[app.GUID] {
+			entry.Instances += process.Instances
+		}
+
+		switch {
+		case app.State == "STOPPED":
+			entry.Reason = idleStopped
+		case app.State != "STARTED":
+			continue
+		case entry.Instances == 0:
+			entry.Reason = idleScaledToZero
+		default:
+			for _, process := range appProcesses[app.GUID] {
+				if process.Instances == 0 {
+					continue
+				}
+				stats, err := source.getProcessStats(ctx, process.GUID)
+				if err != nil {
+					log.Printf("Failed to get stats of app %s, leaving it out of the idle apps: %v", app.Name, err)
+					continue apps
+				}
+				for _, instance := range stats.Resources {
+					switch instance.State {
+					case "RUNNING":
+						entry.RunningInstances++
+					case "CRASHED":
+						entry.CrashedInstances++
+					}
+				}
+			}
+			switch {
+			case entry.RunningInstances == 0:
+				entry.Reason = idleNoRunningInstances
+			case entry.CrashedInstances > 0:
+				entry.Reason = idleCrashing
+			default:
+				continue
+			}
+		}
+		idle = append(idle, entry)
+	}
+
+	sort.Slice(idle, func(i, j int) bool {
+		if idle[i].Org != idle[j].Org {
+			return idle[i].Org < idle[j].Org
+		}
+		if idle[i].Space != idle[j].Space {
+			return idle[i].Space < idle[j].Space
+		}
+		return idle[i].Name < idle[j].Name
+	})
+	return idle, nil
+}
+
+// billableServiceInstances returns how many of the instances bound to app are billable
+func (a IdleApp) billableServiceInstances() int {
+	billable := 0
+	for _, instance := range a.ServiceInstances {
+		if instance.Billable {
+			billable++
+		}
+	}
+	return billable
+}
+
+// filterIdleApps returns the idle apps last updated at least minAgeDays ago
+func filterIdleApps(apps []IdleApp, minAgeDays int) []IdleApp {
+	filtered := []IdleApp{}
+	for _, app := range apps {
+		if app.AgeDays >= minAgeDays {
+			filtered = append(filtered, app)
+		}
+	}
+	return filtered
+}
+
+// printIdleApps writes idle apps as a table
+func printIdleApps(w io.Writer, apps []IdleApp) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ORG\tSPACE\tAPP\tREASON\tRUNNING\tCRASHED\tBOUND SIS\tBILLABLE SIS\tLAST UPDATE\tAGE (DAYS)")
+	for _, app := range apps {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d/%d\t%d\t%d\t%d\t%s\t%d\n",
+			app.Org, app.Space, app.Name, app.Reason, app.RunningInstances, app.Instances, app.CrashedInstances,
+			len(app.ServiceInstances), app.billableServiceInstances(), app.UpdatedAt.Format(time.DateOnly), app.AgeDays)
+	}
+	tw.Flush()
+	fmt.Fprintf(w, "\n%d idle apps\n", len(apps))
+}
@@ -0,0 +1,543 @@
+// Package fakecc is an in-process fake of the Cloud Controller v3 API, UAA
+// and the app-usage service, serving a foundation described by fixture files.
+// It lets the usage collection run end-to-end without a real foundation.
+//
+// A fixture directory holds one JSON file per resource list:
+//
+//	organizations.json, spaces.json, apps.json, processes.json,
+//	service_brokers.json, service_plans.json, service_offerings.json,
+//	service_instances.json, service_credential_bindings.json,
+//	isolation_segments.json, organization_quotas.json, space_quotas.json,
+//	routes.json, tasks.json, sidecars.json, app_usage_events.json,
+//	service_usage_events.json
+//
+// plus usage_summaries.json (org GUID to usage_summary object),
+// service_instance_shares.json (service instance GUID to the GUIDs of the
+// spaces it is shared into), isolation_segment_spaces.json (segment GUID to
+// the GUIDs of its spaces), isolation_segment_organizations.json (segment GUID
+// to the GUIDs of its entitled orgs), default_isolation_segments.json (org
+// GUID to segment GUID), process_stats.json (process GUID to instance stats; other
+// processes report all instances running) and, when the app-usage service should exist,
+// app_usage_report.json and service_usage_report.json. Missing list files
+// serve empty lists. List requests with fields[...] parameters get the
+// related resources in included. Resources with "unlisted": true are only
+// served by GUID, never in lists or included.
+package fakecc
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Token is the access token issued for valid credentials
+const Token = "fake-access-token"
+
+// Default credentials accepted by the fake UAA
+const (
+	Username = "admin"
+	Password = "admin"
+)
+
+// lists are the resource lists served under /v3
+var lists = []string{
+	"organizations",
+	"spaces",
+	"apps",
+	"processes",
+	"service_brokers",
+	"service_plans",
+	"service_offerings",
+	"service_instances",
+	"service_credential_bindings",
+	"isolation_segments",
+	"organization_quotas",
+	"space_quotas",
+	"routes",
+	"tasks",
+	"sidecars",
+	"app_usage_events",
+	"service_usage_events",
+}
+
+// Foundation is the fixture data served by the fake
+type Foundation struct {
+	Lists          map[string][]map[string]any
+	UsageSummaries map[string]json.RawMessage
+	Shares         map[string][]string         // service instance GUID -> shared space GUIDs
+	SegmentSpaces  map[string][]string         // isolation segment GUID -> assigned space GUIDs
+	SegmentOrgs    map[string][]string         // isolation segment GUID -> entitled org GUIDs
+	OrgSegments    map[string]string           // org GUID -> default isolation segment GUID
+	ProcessStats   map[string][]map[string]any // process GUID -> instance stats
+	AppUsageReport json.RawMessage             // nil: app-usage service not deployed
+	ServiceReport  json.RawMessage
+}
+
+// Load reads the fixture files in dir
+func Load(dir string) (*Foundation, error) {
+	f := &Foundation{Lists: make(map[string][]map[string]any)}
+	for _, name := range lists {
+		var resources []map[string]any
+		if err := readFixture(dir, name+".json", &resources); err != nil {
+			return nil, err
+		}
+		f.Lists[name] = resources
+	}
+	if err := readFixture(dir, "usage_summaries.json", &f.UsageSummaries); err != nil {
+		return nil, err
+	}
+	if err := readFixture(dir, "service_instance_shares.json", &f.Shares); err != nil {
+		return nil, err
+	}
+	if err := readFixture(dir, "isolation_segment_spaces.json", &f.SegmentSpaces); err != nil {
+		return nil, err
+	}
+	if err := readFixture(dir, "isolation_segment_organizations.json", &f.SegmentOrgs); err != nil {
+		return nil, err
+	}
+	if err := readFixture(dir, "default_isolation_segments.json", &f.OrgSegments); err != nil {
+		return nil, err
+	}
+	if err := readFixture(dir, "process_stats.json", &f.ProcessStats); err != nil {
+		return nil, err
+	}
+	if err := readFixture(dir, "app_usage_report.json", &f.AppUsageReport); err != nil {
+		return nil, err
+	}
+	if err := readFixture(dir, "service_usage_report.json", &f.ServiceReport); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// readFixture decodes dir/name into v, leaving v untouched if the file is missing
+func readFixture(dir, name string, v any) error {
+	data, err := os.ReadFile(filepath.Join(dir, name))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("fixture %s: %w", name, err)
+	}
+	return nil
+}
+
+// Server is a running fake foundation. The same URL serves the CC API, UAA
+// and the app-usage service.
+type Server struct {
+	*httptest.Server
+	Foundation *Foundation
+
+	// PageSize caps per_page so that pagination is exercised
+	PageSize int
+
+	// Failures maps request paths to the error status served instead, to
+	// exercise error handling
+	Failures map[string]int
+
+	// Stalls maps request paths to the number of requests answered before
+	// the next ones hang until the client gives up, to exercise timeouts
+	Stalls map[string]int
+
+	// RootLinks replaces the links of the API root document; a nil value
+	// serves a null link
+	RootLinks map[string]any
+
+	mu      sync.Mutex
+	hits    map[string]int // requests by path
+	revoked bool           // the issued token is rejected until a new one is requested
+}
+
+// Hits returns how many requests were made for path
+func (s *Server) Hits(path string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.hits[path]
+}
+
+// RevokeToken makes the API reject the issued token, as after its expiry,
+// until the client requests a new one
+func (s *Server) RevokeToken() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.revoked = true
+}
+
+// New starts a fake foundation serving f on a random local port
+func New(f *Foundation) *Server {
+	s := &Server{Foundation: f, PageSize: 50}
+	s.Server = httptest.NewServer(s)
+	return s
+}
+
+// Listen starts a fake foundation serving f on addr, e.g. "127.0.0.1:9999"
+func Listen(f *Foundation, addr string) (*Server, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{Foundation: f, PageSize: 50}
+	s.Server = httptest.NewUnstartedServer(s)
+	s.Server.Listener.Close()
+	s.Server.Listener = l
+	s.Start()
+	return s, nil
+}
+
+// ServeHTTP implements the fake API
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.Path
+	s.mu.Lock()
+	if s.hits == nil {
+		s.hits = make(map[string]int)
+	}
+	s.hits[path]++
+	hits, revoked := s.hits[path], s.revoked
+	s.mu.Unlock()
+
+	if answered, ok := s.Stalls[path]; ok && hits > answered {
+		<-r.Context().Done()
+		return
+	}
+
+	if status, ok := s.Failures[path]; ok {
+		s.writeError(w, status, "Injected failure")
+		return
+	}
+
+	switch {
+	case path == "/" || path == "":
+		links := s.RootLinks
+		if links == nil {
+			links = map[string]any{
+				"self":                map[string]string{"href": s.URL},
+				"cloud_controller_v3": map[string]string{"href": s.URL + "/v3"},
+				"uaa":                 map[string]string{"href": s.URL},
+				"login":               map[string]string{"href": s.URL},
+			}
+		}
+		s.writeJSON(w, http.StatusOK, map[string]any{"links": links})
+		return
+	case path == "/v2/info":
+		s.writeJSON(w, http.StatusOK, map[string]string{"authorization_endpoint": s.URL})
+		return
+	case path == "/oauth/token" && r.Method == http.MethodPost:
+		s.token(w, r)
+		return
+	}
+
+	if r.Header.Get("Authorization") != "Bearer "+Token || revoked {
+		s.writeError(w, http.StatusUnauthorized, "Invalid auth token")
+		return
+	}
+
+	switch {
+	case strings.HasPrefix(path, "/v3/organizations/") && strings.HasSuffix(path, "/usage_summary"):
+		guid := strings.TrimSuffix(strings.TrimPrefix(path, "/v3/organizations/"), "/usage_summary")
+		summary, ok := s.Foundation.UsageSummaries[guid]
+		if !ok {
+			s.writeError(w, http.StatusNotFound, "Organization not found")
+			return
+		}
+		s.writeJSON(w, http.StatusOK, map[string]json.RawMessage{"usage_summary": summary})
+	case strings.HasPrefix(path, "/v3/service_instances/") && strings.HasSuffix(path, "/relationships/shared_spaces"):
+		guid := strings.TrimSuffix(strings.TrimPrefix(path, "/v3/service_instances/"), "/relationships/shared_spaces")
+		s.sharedSpaces(w, r, guid)
+	case strings.HasPrefix(path, "/v3/isolation_segments/") && strings.HasSuffix(path, "/relationships/spaces"):
+		guid := strings.TrimSuffix(strings.TrimPrefix(path, "/v3/isolation_segments/"), "/relationships/spaces")
+		s.segmentRelationship(w, guid, s.Foundation.SegmentSpaces)
+	case strings.HasPrefix(path, "/v3/isolation_segments/") && strings.HasSuffix(path, "/relationships/organizations"):
+		guid := strings.TrimSuffix(strings.TrimPrefix(path, "/v3/isolation_segments/"), "/relationships/organizations")
+		s.segmentRelationship(w, guid, s.Foundation.SegmentOrgs)
+	case strings.HasPrefix(path, "/v3/organizations/") && strings.HasSuffix(path, "/relationships/default_isolation_segment"):
+		guid := strings.TrimSuffix(strings.TrimPrefix(path, "/v3/organizations/"), "/relationships/default_isolation_segment")
+		if !s.exists("organizations", guid) {
+			s.writeError(w, http.StatusNotFound, "Organization not found")
+			return
+		}
+		var data any
+		if segment, ok := s.Foundation.OrgSegments[guid]; ok {
+			data = map[string]string{"guid": segment}
+		}
+		s.writeJSON(w, http.StatusOK, map[string]any{"data": data})
+	case strings.HasPrefix(path, "/v3/processes/") && strings.HasSuffix(path, "/stats"):
+		guid := strings.TrimSuffix(strings.TrimPrefix(path, "/v3/processes/"), "/stats")
+		s.processStats(w, guid)
+	case strings.HasPrefix(path, "/v3/apps/") && strings.HasSuffix(path, "/sidecars"):
+		guid := strings.TrimSuffix(strings.TrimPrefix(path, "/v3/apps/"), "/sidecars")
+		if !s.exists("apps", guid) {
+			s.writeError(w, http.StatusNotFound, "App not found")
+			return
+		}
+		sidecars := []map[string]any{}
+		for _, sidecar := range s.Foundation.Lists["sidecars"] {
+			if relationship(sidecar, "app") == guid {
+				sidecars = append(sidecars, sidecar)
+			}
+		}
+		s.list(w, r, sidecars)
+	case strings.HasPrefix(path, "/v3/"):
+		name, guid, single := strings.Cut(strings.TrimPrefix(path, "/v3/"), "/")
+		resources, ok := s.Foundation.Lists[name]
+		if !ok {
+			s.writeError(w, http.StatusNotFound, "Unknown request")
+			return
+		}
+		if !single {
+			s.list(w, r, resources)
+			return
+		}
+		i := slices.IndexFunc(resources, func(res map[string]any) bool { return res["guid"] == guid })
+		if i < 0 {
+			s.writeError(w, http.StatusNotFound, "Resource not found")
+			return
+		}
+		s.writeJSON(w, http.StatusOK, resources[i])
+	case path == "/system_report/app_usages" && s.Foundation.AppUsageReport != nil:
+		s.writeJSON(w, http.StatusOK, s.Foundation.AppUsageReport)
+	case path == "/system_report/service_usages" && s.Foundation.ServiceReport != nil:
+		s.writeJSON(w, http.StatusOK, s.Foundation.ServiceReport)
+	default:
+		s.writeError(w, http.StatusNotFound, "Unknown request")
+	}
+}
+
+// sharedSpaces serves the shared_spaces relationship of a service instance
+func (s *Server) sharedSpaces(w http.ResponseWriter, r *http.Request, guid string) {
+	if !s.exists("service_instances", guid) {
+		s.writeError(w, http.StatusNotFound, "Service instance not found")
+		return
+	}
+	data := []map[string]string{}
+	var spaces []map[string]any
+	for _, spaceGUID := range s.Foundation.Shares[guid] {
+		data = append(data, map[string]string{"guid": spaceGUID})
+		for _, space := range s.Foundation.Lists["spaces"] {
+			if space["guid"] == spaceGUID {
+				spaces = append(spaces, space)
+			}
+		}
+	}
+	body := map[string]any{"data": data}
+	if r.URL.Query().Has("fields[space]") {
+		body["included"] = map[string]any{"spaces": spaces}
+	}
+	s.writeJSON(w, http.StatusOK, body)
+}
+
+// segmentRelationship serves a to-many relationship of an isolation segment
+func (s *Server) segmentRelationship(w http.ResponseWriter, guid string, related map[string][]string) {
+	if !s.exists("isolation_segments", guid) {
+		s.writeError(w, http.StatusNotFound, "Isolation segment not found")
+		return
+	}
+	data := []map[string]string{}
+	for _, relatedGUID := range related[guid] {
+		data = append(data, map[string]string{"guid": relatedGUID})
+	}
+	s.writeJSON(w, http.StatusOK, map[string]any{"data": data})
+}
+
+// processStats serves the stats of a process: the fixture entries when there
+// are any, else every desired instance running
+func (s *Server) processStats(w http.ResponseWriter, guid string) {
+	i := slices.IndexFunc(s.Foundation.Lists["processes"], func(res map[string]any) bool { return res["guid"] == guid })
+	if i < 0 {
+		s.writeError(w, http.StatusNotFound, "Process not found")
+		return
+	}
+	stats, ok := s.Foundation.ProcessStats[guid]
+	if !ok {
+		process := s.Foundation.Lists["processes"][i]
+		instances, _ := process["instances"].(float64)
+		stats = []map[string]any{}
+		for index := range int(instances) {
+			stats = append(stats, map[string]any{"type": process["type"], "index": index, "state": "RUNNING"})
+		}
+	}
+	s.writeJSON(w, http.StatusOK, map[string]any{"resources": stats})
+}
+
+// exists reports whether the list name has a resource with guid
+func (s *Server) exists(name, guid string) bool {
+	return slices.ContainsFunc(s.Foundation.Lists[name], func(res map[string]any) bool { return res["guid"] == guid })
+}
+
+// token implements the UAA password grant
+func (s *Server) token(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil || r.PostForm.Get("grant_type") != "password" {
+		s.writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_request"})
+		return
+	}
+	if r.PostForm.Get("username") != Username || r.PostForm.Get("password") != Password {
+		s.writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized", "error_description": "Bad credentials"})
+		return
+	}
+	s.mu.Lock()
+	s.revoked = false
+	s.mu.Unlock()
+	s.writeJSON(w, http.StatusOK, map[string]any{
+		"access_token": Token,
+		"token_type":   "bearer",
+		"expires_in":   3600,
+	})
+}
+
+// list serves a paginated resource list with the filters the service uses
+func (s *Server) list(w http.ResponseWriter, r *http.Request, resources []map[string]any) {
+	query := r.URL.Query()
+	resources = s.filter(resources, query)
+
+	if query.Get("order_by") == "-created_at" {
+		resources = slices.Clone(resources)
+		slices.Reverse(resources)
+	}
+	if after := query.Get("after_guid"); after != "" {
+		i := slices.IndexFunc(resources, func(res map[string]any) bool { return res["guid"] == after })
+		if i < 0 {
+			s.writeError(w, http.StatusBadRequest, "after_guid not found")
+			return
+		}
+		resources = resources[i+1:]
+	}
+
+	perPage, _ := strconv.Atoi(query.Get("per_page"))
+	if perPage <= 0 || perPage > s.PageSize {
+		perPage = s.PageSize
+	}
+	page, _ := strconv.Atoi(query.Get("page"))
+	if page < 1 {
+		page = 1
+	}
+	start := min((page-1)*perPage, len(resources))
+	end := min(start+perPage, len(resources))
+
+	pagination := map[string]any{"total_results": len(resources), "next": nil}
+	if end < len(resources) {
+		next := *r.URL
+		q := next.Query()
+		q.Set("page", strconv.Itoa(page+1))
+		next.RawQuery = q.Encode()
+		pagination["next"] = map[string]string{"href": s.URL + next.RequestURI()}
+	}
+
+	body := map[string]any{
+		"pagination": pagination,
+		"resources":  resources[start:end],
+	}
+	if included := s.included(resources[start:end], query); included != nil {
+		body["included"] = included
+	}
+	s.writeJSON(w, http.StatusOK, body)
+}
+
+// included resolves the fields[...] parameters of a list request, e.g.
+// fields[space.organization], to the related resources of page. Resources are
+// returned whole; the fake does not trim them to the requested fields.
+func (s *Server) included(page []map[string]any, query url.Values) map[string][]map[string]any {
+	var included map[string][]map[string]any
+	for key := range query {
+		path, ok := strings.CutPrefix(key, "fields[")
+		if !ok {
+			continue
+		}
+		path = strings.TrimSuffix(path, "]")
+		if included == nil {
+			included = make(map[string][]map[string]any)
+		}
+
+		// Follow the relationship chain one hop at a time
+		current := page
+		var list string
+		for _, name := range strings.Split(path, ".") {
+			list = name + "s"
+			var next []map[string]any
+			for _, res := range current {
+				guid := relationship(res, name)
+				i := slices.IndexFunc(s.Foundation.Lists[list], func(r map[string]any) bool { return r["guid"] == guid && r["unlisted"] != true })
+				if i >= 0 && !slices.ContainsFunc(next, func(r map[string]any) bool { return r["guid"] == guid }) {
+					next = append(next, s.Foundation.Lists[list][i])
+				}
+			}
+			current = next
+		}
+		if current == nil {
+			current = []map[string]any{}
+		}
+		included[list] = current
+	}
+	return included
+}
+
+// filter applies the organization_guids, states and type query parameters
+func (s *Server) filter(resources []map[string]any, query url.Values) []map[string]any {
+	var orgs, states []string
+	if v := query.Get("organization_guids"); v != "" {
+		orgs = strings.Split(v, ",")
+	}
+	if v := query.Get("states"); v != "" {
+		states = strings.Split(v, ",")
+	}
+	instanceType := query.Get("type")
+
+	out := []map[string]any{}
+	for _, res := range resources {
+		if res["unlisted"] == true {
+			continue
+		}
+		if states != nil && !slices.Contains(states, fmt.Sprint(res["state"])) {
+			continue
+		}
+		if instanceType != "" && res["type"] != nil && res["type"] != instanceType {
+			continue
+		}
+		if orgs != nil && !slices.Contains(orgs, s.orgOf(res)) {
+			continue
+		}
+		out = append(out, res)
+	}
+	return out
+}
+
+// orgOf returns the org GUID of a space-scoped resource
+func (s *Server) orgOf(res map[string]any) string {
+	spaceGUID := relationship(res, "space")
+	for _, space := range s.Foundation.Lists["spaces"] {
+		if space["guid"] == spaceGUID {
+			return relationship(space, "organization")
+		}
+	}
+	return ""
+}
+
+// relationship returns relationships.<name>.data.guid of a resource
+func relationship(res map[string]any, name string) string {
+	rels, _ := res["relationships"].(map[string]any)
+	rel, _ := rels[name].(map[string]any)
+	data, _ := rel["data"].(map[string]any)
+	guid, _ := data["guid"].(string)
+	return guid
+}
+
+func (s *Server) writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func (s *Server) writeError(w http.ResponseWriter, status int, detail string) {
+	s.writeJSON(w, status, map[string]any{"errors": []map[string]any{{"detail": detail, "code": status}}})
+}
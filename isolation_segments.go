@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sort"
+)
+
+// sharedSegmentName is the name CF gives the segment of the shared Diego
+// cells, where apps run unless their space or org is assigned elsewhere
+const sharedSegmentName = "shared"
+
+func (c *CFClient) getIsolationSegments(ctx context.Context) ([]IsolationSegment, error) {
+	return collectResources(listResources[IsolationSegment](ctx, c, "/v3/isolation_segments?per_page=5000"))
+}
+
+// getIsolationSegmentSpaces returns the GUIDs of the spaces assigned to an isolation segment
+func (c *CFClient) getIsolationSegmentSpaces(ctx context.Context, guid string) ([]string, error) {
+	return c.getRelationshipGUIDs(ctx, "/v3/isolation_segments/"+url.PathEscape(guid)+"/relationships/spaces")
+}
+
+// getIsolationSegmentOrganizations returns the GUIDs of the orgs entitled to an isolation segment
+func (c *CFClient) getIsolationSegmentOrganizations(ctx context.Context, guid string) ([]string, error) {
+	return c.getRelationshipGUIDs(ctx, "/v3/isolation_segments/"+url.PathEscape(guid)+"/relationships/organizations")
+}
+
+// getRelationshipGUIDs returns the GUIDs listed by a to-many relationship endpoint
+func (c *CFClient) getRelationshipGUIDs(ctx context.Context, endpoint string) ([]string, error) {
+	data, err := c.apiCall(ctx, endpoint)
+	if err != nil {
+		return nil, err
+	}
+	var relationship ToManyRelationship
+	if err := json.Unmarshal(data, &relationship); err != nil {
+		return nil, fmt.Errorf("failed to parse relationship %s: %w", endpoint, err)
+	}
+	var guids []string
+	for _, related := range relationship.Data {
+		guids = append(guids, related.GUID)
+	}
+	return guids, nil
+}
+
+// getDefaultIsolationSegment returns the GUID of an org's default isolation
+// segment, or "" if the org has none
+func (c *CFClient) getDefaultIsolationSegment(ctx context.Context, orgGUID string) (string, error) {
+	data, err := c.apiCall(ctx, "/v3/organizations/"+url.PathEscape(orgGUID)+"/relationships/default_isolation_segment")
+	if err != nil {
+		return "", err
+	}
+	var segment ToOneRelationship
+	if err := json.Unmarshal(data, &segment); err != nil {
+		return "", fmt.Errorf("failed to parse default isolation segment: %w", err)
+	}
+	if segment.Data == nil {
+		return "", nil
+	}
+	return segment.Data.GUID, nil
+}
+
+// collectIsolationSegmentUsage attributes the AIs of started apps to the
+// isolation segment they run on: the segment assigned to their space, else
+// the default segment of their org, else the shared segment. A foundation
+// with only the shared segment needs no further requests. Otherwise every
+// segment costs a request for its spaces, and every segment other than shared
+// one for its entitled orgs; the CC has no bulk listing of default segments,
+// so only the orgs entitled to such a segment are asked for theirs.
+func collectIsolationSegmentUsage(ctx context.Context, source UsageSource, orgs []Organization, running []runningProcess, config *Config) ([]IsolationSegmentUsage, error) {
+	segments, err := source.getIsolationSegments(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get isolation segments: %w", err)
+	}
+
+	usage := map[string]*IsolationSegmentUsage{sharedSegmentName: {Name: sharedSegmentName}}
+	segmentNames := make(map[string]string)  // segment GUID -> name
+	spaceSegments := make(map[string]string) // space GUID -> segment name
+	entitled := make(map[string]bool)        // org GUIDs entitled to a segment other than shared
+	for _, segment := range segments {
+		segmentNames[segment.GUID] = segment.Name
+		usage[segment.Name] = &IsolationSegmentUsage{Name: segment.Name}
+	}
+	for _, segment := range segments {
+		// Without other segments everything runs on the shared cells
+		if len(usage) == 1 {
+			break
+		}
+
+		// A space assigned to shared overrides the default segment of its org too
+		spaces, err := source.getIsolationSegmentSpaces(ctx, segment.GUID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get spaces of isolation segment %s: %w", segment.Name, err)
+		}
+		for _, space := range spaces {
+			spaceSegments[space] = segment.Name
+		}
+		if segment.Name == sharedSegmentName {
+			continue
+		}
+		entitledOrgs, err := source.getIsolationSegmentOrganizations(ctx, segment.GUID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get organizations of isolation segment %s: %w", segment.Name, err)
+		}
+		for _, org := range entitledOrgs {
+			entitled[org] = true
+		}
+	}
+
+	// A default segment must be one the org is entitled to
+	orgSegments := make(map[string]string) // org GUID -> default segment name
+	skipOrgs := make(map[string]bool)
+	for _, org := range orgs {
+		skipOrgs[org.GUID] = shouldSkipOrg(org.Name, config.SkipOrgs)
+		if !entitled[org.GUID] {
+			continue
+		}
+		guid, err := source.getDefaultIsolationSegment(ctx, org.GUID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get default isolation segment of org %s: %w", org.Name, err)
+		}
+		if guid != "" {
+			orgSegments[org.GUID] = segmentNames[guid]
+		}
+	}
+
+	for _, process := range running {
+		name := spaceSegments[process.SpaceGUID]
+		if name == "" {
+			name = orgSegments[process.OrgGUID]
+		}
+		if usage[name] == nil {
+			name = sharedSegmentName
+		}
+		usage[name].AIs += process.Process.Instances
+		if !skipOrgs[process.OrgGUID] {
+			usage[name].BillableAIs += process.Process.Instances
+		}
+	}
+
+	var report []IsolationSegmentUsage
+	for _, segment := range usage {
+		report = append(report, *segment)
+	}
+	sort.Slice(report, func(i, j int) bool {
+		return report[i].Name < report[j].Name
+	})
+	return report, nil
+}
@@ -1,105 +1,281 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"os"
-	"strconv"
+	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 )
 
-// parseFlags parses command line flags and returns configuration
-func parseFlags() *Config {
-	config := &Config{}
-	
-	var skipOrgs string
-	var refreshMinutes int
-	flag.StringVar(&skipOrgs, "skip-orgs", "system", "Comma-separated list of orgs to skip")
-	flag.BoolVar(&config.Verbose, "verbose", false, "Enable verbose output")
-	flag.BoolVar(&config.JSONOutput, "json", false, "Output results as JSON")
-	flag.BoolVar(&config.ServerMode, "server", false, "Run as web server with Prometheus metrics endpoint")
-	flag.IntVar(&config.Port, "port", 8080, "Port to run web server on (only used with -server)")
-	flag.IntVar(&refreshMinutes, "refresh-interval", 60, "Data refresh interval in minutes for server mode (default: 60)")
-	flag.Parse()
-	
-	config.RefreshInterval = time.Duration(refreshMinutes) * time.Minute
-	
-	if skipOrgs != "" {
-		config.SkipOrgs = strings.Split(skipOrgs, ",")
-		for i := range config.SkipOrgs {
-			config.SkipOrgs[i] = strings.TrimSpace(config.SkipOrgs[i])
-		}
+// Flags that only make sense for one of the two legacy (flag-only) modes
+var (
+	serverOnlyFlags = []string{"port", "refresh-interval"}
+	cliOnlyFlags    = []string{"json"}
+)
+
+// parseFlags parses the legacy flat command line flags and returns configuration
+func parseFlags(args []string) (*Config, error) {
+	fs := flag.NewFlagSet("tpcf-usage-service", flag.ContinueOnError)
+	fs.Usage = func() { printUsage(fs.Output()) }
+
+	flags := newCLIFlags(fs)
+	flags.addCollectionFlags()
+	flags.addJSONFlag()
+	fs.BoolVar(&flags.server, "server", false, "Run as web server with Prometheus metrics endpoint")
+	fs.IntVar(&flags.port, "port", 8080, "Port to run web server on (only used with -server)")
+	fs.IntVar(&flags.refreshMinutes, "refresh-interval", 60, "Data refresh interval in minutes for server mode (default: 60)")
+	if err := parseCommandFlags(fs, args, 0); err != nil {
+		return nil, err
+	}
+
+	config, err := loadConfig(flags)
+	if err != nil {
+		return nil, err
+	}
+
+	invalid := cliOnlyFlags
+	mode := "server mode"
+	if !config.ServerMode {
+		invalid = serverOnlyFlags
+		mode = "CLI mode"
 	}
-	
-	return config
+	if err := rejectFlags(fs, invalid, mode); err != nil {
+		return nil, err
+	}
+
+	return config, nil
 }
 
-func main() {
-	config := parseFlags()
-	
-	// Override config with environment variables for CF deployment
-	if os.Getenv("TPCF_SERVER_MODE") == "true" {
-		config.ServerMode = true
-	}
-	if os.Getenv("TPCF_VERBOSE") == "true" {
-		config.Verbose = true
-	}
-	if portStr := os.Getenv("PORT"); portStr != "" {
-		if port, err := strconv.Atoi(portStr); err == nil {
-			config.Port = port
+// rejectFlags returns an error if any of the named flags was set explicitly
+func rejectFlags(fs *flag.FlagSet, names []string, mode string) error {
+	var set []string
+	fs.Visit(func(f *flag.Flag) {
+		for _, name := range names {
+			if f.Name == name {
+				set = append(set, "-"+name)
+			}
 		}
+	})
+	if len(set) > 0 {
+		return &usageError{err: fmt.Errorf("%s not supported in %s", strings.Join(set, ", "), mode)}
 	}
-	
-	client, err := NewCFClient()
+	return nil
+}
+
+// splitList splits a comma-separated list, trimming whitespace around entries
+func splitList(value string) []string {
+	if value == "" {
+		return nil
+	}
+	items := strings.Split(value, ",")
+	for i := range items {
+		items[i] = strings.TrimSpace(items[i])
+	}
+	return items
+}
+
+// setupClient authenticates against the CF API. The service catalog is
+// loaded by every collection.
+func setupClient(ctx context.Context, config *Config) (*CFClient, error) {
+	client, err := NewCFClient(ctx, config)
 	if err != nil {
-		log.Fatalf("Failed to create CF client: %v", err)
+		return nil, fmt.Errorf("failed to create CF client: %w", err)
 	}
-	
-	// Load service plans and offerings for billable service instance detection
+
+	// Startup diagnostic for the optional app-usage service
+	if config.ServerMode || config.Verbose {
+		if err := client.checkAppUsageService(ctx); err != nil {
+			log.Printf("App-usage service at %s is not reachable: %v", client.appUsageEndpoint(), err)
+		} else {
+			log.Printf("App-usage service at %s is reachable", client.appUsageEndpoint())
+		}
+	}
+
+	return client, nil
+}
+
+// printReport writes the human readable usage report
+func printReport(w io.Writer, result *UsageResult, config *Config) {
+	for _, org := range result.Organizations {
+		fmt.Fprintf(w, "Processing %s...\n", org.Name)
+		fmt.Fprintf(w, "AIs: %d\n", org.AIs)
+		fmt.Fprintf(w, "Memory: %.2f GB, Disk: %.2f GB\n", org.MemoryGB, org.DiskGB)
+		fmt.Fprintf(w, "SIs: %d (Billable: %d)\n", org.SIs, org.BillableSIs)
+		if config.Verbose {
+			fmt.Fprintf(w, "SIs by type: %d managed, %d user-provided, %d shared out, %d shared in\n",
+				org.ManagedSIs, org.UserProvidedSIs, org.SharedSIs, org.SharedInSIs)
+			for _, stack := range org.Stacks {
+				fmt.Fprintf(w, "AIs on %s (%s): %d\n", stack.Stack, stack.Lifecycle, stack.AIs)
+			}
+			if org.Tasks != nil {
+				fmt.Fprintf(w, "Running tasks: %d, %.2f GB memory, %.2f hours so far\n", org.Tasks.Running, org.Tasks.MemoryGB, org.Tasks.Hours)
+			}
+			if org.SidecarInstances > 0 {
+				fmt.Fprintf(w, "Sidecar instances: %d\n", org.SidecarInstances)
+			}
+			for _, space := range org.Spaces {
+				fmt.Fprintf(w, "Space %s: %d AIs, %.2f GB memory, %.2f GB disk\n", space.Name, space.AIs, space.MemoryGB, space.DiskGB)
+			}
+		}
+		fmt.Fprintln(w)
+	}
+	fmt.Fprintf(w, "Total AIs: %d (Billable: %d)\n", result.TotalAIs, result.TotalBillableAIs)
+	fmt.Fprintf(w, "Total SIs: %d (Billable: %d)\n", result.TotalSIs, result.TotalBillableSIs)
+	fmt.Fprintf(w, "Total Memory: %.2f GB (Billable: %.2f GB)\n", result.TotalMemoryGB, result.TotalBillableMemoryGB)
+	fmt.Fprintf(w, "Total Disk: %.2f GB (Billable: %.2f GB)\n", result.TotalDiskGB, result.TotalBillableDiskGB)
 	if config.Verbose {
-		fmt.Println("Loading service plans and offerings...")
+		fmt.Fprintf(w, "Total SIs by type: %d managed, %d user-provided (%d shared)\n",
+			result.TotalManagedSIs, result.TotalUserProvidedSIs, result.TotalSharedSIs)
 	}
-	if err := client.loadServicePlans(); err != nil {
-		log.Fatalf("Failed to load service plans: %v", err)
+	// A single stack is not worth a line unless asked for
+	if len(result.Stacks) > 1 || config.Verbose {
+		for _, stack := range result.Stacks {
+			fmt.Fprintf(w, "AIs on %s (%s): %d (Billable: %d)\n", stack.Stack, stack.Lifecycle, stack.AIs, stack.BillableAIs)
+		}
 	}
-	if err := client.loadServiceOfferings(); err != nil {
-		log.Fatalf("Failed to load service offerings: %v", err)
+	// Only the shared segment is not worth a line unless asked for
+	if len(result.IsolationSegments) > 1 || config.Verbose {
+		for _, segment := range result.IsolationSegments {
+			fmt.Fprintf(w, "Isolation segment %s: %d AIs (Billable: %d)\n", segment.Name, segment.AIs, segment.BillableAIs)
+		}
 	}
-	
-	if config.ServerMode {
-		runServer(client, config)
-		return
+	spaceScopedSIs := 0
+	for _, offering := range result.ServiceOfferings {
+		if config.Verbose {
+			fmt.Fprintf(w, "Offering %s (broker %s): %d SIs, billable: %t\n",
+				offering.Offering, offering.Broker, offering.Instances, offering.Billable)
+		}
+		if offering.SpaceScoped {
+			spaceScopedSIs += offering.Instances
+		}
 	}
-	
-	// CLI mode - collect and display data once
-	result, err := collectUsageData(client, config)
-	if err != nil {
-		log.Fatalf("Failed to collect usage data: %v", err)
+	if spaceScopedSIs > 0 {
+		fmt.Fprintf(w, "SIs from space-scoped brokers: %d (billable only when listed as broker:offering)\n", spaceScopedSIs)
 	}
-	
-	if config.JSONOutput {
-		output, err := json.MarshalIndent(result, "", "  ")
-		if err != nil {
-			log.Fatalf("Failed to marshal JSON: %v", err)
+	if orphans := result.OrphanedServiceInstances; len(orphans) > 0 {
+		billable := 0
+		for _, orphan := range orphans {
+			if orphan.Billable {
+				billable++
+			}
 		}
-		fmt.Println(string(output))
-	} else {
-		for _, org := range result.Organizations {
-			fmt.Printf("Processing %s...\n", org.Name)
-			fmt.Printf("AIs: %d\n", org.AIs)
-			fmt.Printf("SIs: %d (Billable: %d)\n", org.SIs, org.BillableSIs)
-			fmt.Println()
+		fmt.Fprintf(w, "Orphaned SIs (no bindings or keys): %d (Billable: %d), see the orphans command\n", len(orphans), billable)
+	}
+	if tasks := result.Tasks; tasks != nil && tasks.Running > 0 {
+		fmt.Fprintf(w, "Running tasks: %d, %.2f GB memory, %.2f hours so far (longest %.2f hours)\n",
+			tasks.Running, tasks.MemoryGB, tasks.Hours, tasks.LongestHours)
+	}
+	if result.TotalSidecarInstances > 0 {
+		fmt.Fprintf(w, "Sidecar instances: %d\n", result.TotalSidecarInstances)
+	}
+	if config.IdleApps {
+		stopped, unhealthy, billable := 0, 0, 0
+		for _, app := range result.IdleApps {
+			if app.Reason == idleStopped {
+				stopped++
+				if app.billableServiceInstances() > 0 {
+					billable++
+				}
+			} else {
+				unhealthy++
+			}
 		}
-		fmt.Printf("Total AIs: %d (Billable: %d)\n", result.TotalAIs, result.TotalBillableAIs)
-		fmt.Printf("Total SIs: %d (Billable: %d)\n", result.TotalSIs, result.TotalBillableSIs)
-		if result.MonthlyMaxBillableAIs > 0 || result.YearlyMaxBillableAIs > 0 {
-			fmt.Printf("Monthly Max Billable AIs: %d\n", result.MonthlyMaxBillableAIs)
-			fmt.Printf("Yearly Max Billable AIs: %d\n", result.YearlyMaxBillableAIs)
-		} else if config.Verbose {
-			fmt.Printf("Monthly/Yearly max data: Not available (app-usage service not deployed)\n")
+		fmt.Fprintf(w, "Idle apps: %d stopped (%d with billable SIs bound), %d started without healthy instances, see the idle-apps command\n",
+			stopped, billable, unhealthy)
+	}
+	if quotas := filterQuotas(result.Quotas, defaultQuotaThreshold); len(quotas) > 0 {
+		fmt.Fprintf(w, "Quotas at %d%% or more: %d, see the quotas command\n", defaultQuotaThreshold, len(quotas))
+	}
+	if result.TotalUnknownPlanSIs > 0 {
+		fmt.Fprintf(w, "SIs with unknown plans: %d (counted as not billable)\n", result.TotalUnknownPlanSIs)
+	}
+	if result.AppUsageService != nil {
+		fmt.Fprintf(w, "Monthly Max Billable AIs: %d\n", result.MonthlyMaxBillableAIs)
+		fmt.Fprintf(w, "Yearly Max Billable AIs: %d\n", result.YearlyMaxBillableAIs)
+	} else if config.Verbose {
+		fmt.Fprintf(w, "Monthly/Yearly max data: Not available (app-usage service not deployed)\n")
+	}
+	if report := result.AppUsageService; report != nil && config.Verbose {
+		for _, month := range report.Monthly {
+			fmt.Fprintf(w, "App usage %d-%02d: avg %.2f, max %d, %.2f AI-hours\n",
+				month.Year, month.Month, month.AverageAppInstances, month.MaximumAppInstances, month.AppInstanceHours)
+		}
+		for _, year := range report.Yearly {
+			fmt.Fprintf(w, "App usage %d: avg %.2f, max %d, %.2f AI-hours\n",
+				year.Year, year.AverageAppInstances, year.MaximumAppInstances, year.AppInstanceHours)
+		}
+	}
+	if report := result.AppUsageService; report != nil {
+		for _, org := range report.Organizations {
+			fmt.Fprintf(w, "Org %s %d-%02d: %.2f AI-hours, %.2f SI-hours (app-usage service)\n",
+				org.Name, org.Year, org.Month, org.AppInstanceHours, org.ServiceInstanceHours)
+		}
+	}
+	if usage := result.AppUsageEvents; usage != nil && len(usage.Periods) > 0 {
+		current := usage.Periods[len(usage.Periods)-1]
+		fmt.Fprintf(w, "AI-hours %s: %.2f (Billable: %.2f) from app usage events since %s\n",
+			current.Period, current.AIHours, current.BillableAIHours, usage.TrackingSince.Format(time.RFC3339))
+		fmt.Fprintf(w, "Peak AIs %s: %d (Billable: %d)\n", current.Period, current.PeakAIs, current.BillablePeakAIs)
+	}
+	if usage := result.ServiceUsageEvents; usage != nil && len(usage.Periods) > 0 {
+		current := usage.Periods[len(usage.Periods)-1]
+		fmt.Fprintf(w, "SI-days %s: %.2f (Billable: %.2f) from service usage events since %s\n",
+			current.Period, current.SIDays, current.BillableSIDays, usage.TrackingSince.Format(time.RFC3339))
+		fmt.Fprintf(w, "Peak billable SIs %s: %d\n", current.Period, current.BillablePeakSIs)
+	}
+}
+
+// runLegacy keeps the original flag-only invocation working
+func runLegacy(ctx context.Context, args []string) error {
+	config, err := parseFlags(args)
+	if err != nil {
+		return err
+	}
+
+	client, err := setupClient(ctx, config)
+	if err != nil {
+		return err
+	}
+
+	if config.ServerMode {
+		runServer(ctx, client, config, func() (*Config, error) { return parseFlags(args) })
+		return nil
+	}
+
+	// CLI mode - collect and display data once
+	return report(ctx, client, config)
+}
+
+func main() {
+	args := os.Args[1:]
+
+	// Interrupts cancel in-flight collections; server mode shuts down
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	var err error
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		err = runCommand(ctx, args[0], args[1:])
+	} else {
+		err = runLegacy(ctx, args)
+	}
+
+	var uerr *usageError
+	switch {
+	case err == nil, errors.Is(err, flag.ErrHelp):
+	case errors.As(err, &uerr):
+		if !uerr.printed {
+			fmt.Fprintln(os.Stderr, "Error:", uerr)
 		}
+		os.Exit(2)
+	default:
+		log.Fatalf("%v", err)
 	}
-}
\ No newline at end of file
+}
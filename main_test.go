@@ -0,0 +1,30 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestPrintReportAppUsageMaxima(t *testing.T) {
+	tests := []struct {
+		name   string
+		result UsageResult
+		want   string
+	}{
+		{"no app-usage service", UsageResult{}, "Monthly/Yearly max data: Not available"},
+		{"idle foundation", UsageResult{AppUsageService: &AppUsageServiceReport{}}, "Monthly Max Billable AIs: 0\nYearly Max Billable AIs: 0\n"},
+		{"usage", UsageResult{AppUsageService: &AppUsageServiceReport{}, MonthlyMaxBillableAIs: 12, YearlyMaxBillableAIs: 20}, "Monthly Max Billable AIs: 12\nYearly Max Billable AIs: 20\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := defaultConfig()
+			config.Verbose = true
+			var out bytes.Buffer
+			printReport(&out, &tt.result, config)
+			if !strings.Contains(out.String(), tt.want) {
+				t.Errorf("report does not contain %q:\n%s", tt.want, out.String())
+			}
+		})
+	}
+}
@@ -8,50 +8,531 @@ import (
 // formatPrometheusMetrics formats usage results as Prometheus metrics
 func formatPrometheusMetrics(result *UsageResult) string {
 	var metrics strings.Builder
-	
+
 	// Total metrics
 	metrics.WriteString("# HELP cf_total_application_instances Total number of application instances across all organizations (includes system)\n")
 	metrics.WriteString("# TYPE cf_total_application_instances gauge\n")
 	metrics.WriteString(fmt.Sprintf("cf_total_application_instances %d\n", result.TotalAIs))
-	
+
 	metrics.WriteString("# HELP cf_total_billable_application_instances Total number of billable application instances (excludes system org)\n")
 	metrics.WriteString("# TYPE cf_total_billable_application_instances gauge\n")
 	metrics.WriteString(fmt.Sprintf("cf_total_billable_application_instances %d\n", result.TotalBillableAIs))
-	
+
 	metrics.WriteString("# HELP cf_total_service_instances Total number of service instances across all organizations\n")
 	metrics.WriteString("# TYPE cf_total_service_instances gauge\n")
 	metrics.WriteString(fmt.Sprintf("cf_total_service_instances %d\n", result.TotalSIs))
-	
+
 	metrics.WriteString("# HELP cf_total_billable_service_instances Total number of billable service instances across all organizations\n")
 	metrics.WriteString("# TYPE cf_total_billable_service_instances gauge\n")
 	metrics.WriteString(fmt.Sprintf("cf_total_billable_service_instances %d\n", result.TotalBillableSIs))
-	
+
+	metrics.WriteString("# HELP cf_total_memory_allocated_gb Memory allocated to started application instances across all organizations, in GB\n")
+	metrics.WriteString("# TYPE cf_total_memory_allocated_gb gauge\n")
+	metrics.WriteString(fmt.Sprintf("cf_total_memory_allocated_gb %.2f\n", result.TotalMemoryGB))
+
+	metrics.WriteString("# HELP cf_total_billable_memory_allocated_gb Memory allocated to billable application instances (excludes skipped orgs), in GB\n")
+	metrics.WriteString("# TYPE cf_total_billable_memory_allocated_gb gauge\n")
+	metrics.WriteString(fmt.Sprintf("cf_total_billable_memory_allocated_gb %.2f\n", result.TotalBillableMemoryGB))
+
+	metrics.WriteString("# HELP cf_total_disk_allocated_gb Disk allocated to running application instances across all organizations, in GB\n")
+	metrics.WriteString("# TYPE cf_total_disk_allocated_gb gauge\n")
+	metrics.WriteString(fmt.Sprintf("cf_total_disk_allocated_gb %.2f\n", result.TotalDiskGB))
+
+	metrics.WriteString("# HELP cf_total_billable_disk_allocated_gb Disk allocated to billable application instances (excludes skipped orgs), in GB\n")
+	metrics.WriteString("# TYPE cf_total_billable_disk_allocated_gb gauge\n")
+	metrics.WriteString(fmt.Sprintf("cf_total_billable_disk_allocated_gb %.2f\n", result.TotalBillableDiskGB))
+
+	metrics.WriteString("# HELP cf_unknown_plan_service_instances Number of service instances whose plan or offering is missing from the catalog (counted as not billable)\n")
+	metrics.WriteString("# TYPE cf_unknown_plan_service_instances gauge\n")
+	metrics.WriteString(fmt.Sprintf("cf_unknown_plan_service_instances %d\n", result.TotalUnknownPlanSIs))
+
+	metrics.WriteString("# HELP cf_service_instances_by_type Number of service instances by type, each counted once in its owning organization\n")
+	metrics.WriteString("# TYPE cf_service_instances_by_type gauge\n")
+	metrics.WriteString(fmt.Sprintf("cf_service_instances_by_type{type=\"managed\"} %d\n", result.TotalManagedSIs))
+	metrics.WriteString(fmt.Sprintf("cf_service_instances_by_type{type=\"user-provided\"} %d\n", result.TotalUserProvidedSIs))
+
+	metrics.WriteString("# HELP cf_shared_service_instances Number of managed service instances shared into other organizations\n")
+	metrics.WriteString("# TYPE cf_shared_service_instances gauge\n")
+	metrics.WriteString(fmt.Sprintf("cf_shared_service_instances %d\n", result.TotalSharedSIs))
+
 	metrics.WriteString("# HELP cf_monthly_max_billable_application_instances Maximum billable application instances this month\n")
 	metrics.WriteString("# TYPE cf_monthly_max_billable_application_instances gauge\n")
 	metrics.WriteString(fmt.Sprintf("cf_monthly_max_billable_application_instances %d\n", result.MonthlyMaxBillableAIs))
-	
+
 	metrics.WriteString("# HELP cf_yearly_max_billable_application_instances Maximum billable application instances this year\n")
 	metrics.WriteString("# TYPE cf_yearly_max_billable_application_instances gauge\n")
 	metrics.WriteString(fmt.Sprintf("cf_yearly_max_billable_application_instances %d\n", result.YearlyMaxBillableAIs))
-	
+
 	// Per-organization metrics
 	metrics.WriteString("# HELP cf_org_application_instances Number of application instances per organization\n")
 	metrics.WriteString("# TYPE cf_org_application_instances gauge\n")
 	for _, org := range result.Organizations {
 		metrics.WriteString(fmt.Sprintf("cf_org_application_instances{org=\"%s\"} %d\n", org.Name, org.AIs))
 	}
-	
+
+	metrics.WriteString("# HELP cf_org_memory_allocated_gb Memory allocated to started application instances per organization, in GB\n")
+	metrics.WriteString("# TYPE cf_org_memory_allocated_gb gauge\n")
+	for _, org := range result.Organizations {
+		metrics.WriteString(fmt.Sprintf("cf_org_memory_allocated_gb{org=\"%s\"} %.2f\n", org.Name, org.MemoryGB))
+	}
+
+	metrics.WriteString("# HELP cf_org_disk_allocated_gb Disk allocated to running application instances per organization, in GB\n")
+	metrics.WriteString("# TYPE cf_org_disk_allocated_gb gauge\n")
+	for _, org := range result.Organizations {
+		metrics.WriteString(fmt.Sprintf("cf_org_disk_allocated_gb{org=\"%s\"} %.2f\n", org.Name, org.DiskGB))
+	}
+
+	metrics.WriteString("# HELP cf_space_memory_allocated_gb Memory allocated to running application instances per space, in GB\n")
+	metrics.WriteString("# TYPE cf_space_memory_allocated_gb gauge\n")
+	for _, org := range result.Organizations {
+		for _, space := range org.Spaces {
+			metrics.WriteString(fmt.Sprintf("cf_space_memory_allocated_gb{org=\"%s\",space=\"%s\"} %.2f\n", org.Name, space.Name, space.MemoryGB))
+		}
+	}
+
+	metrics.WriteString("# HELP cf_space_disk_allocated_gb Disk allocated to running application instances per space, in GB\n")
+	metrics.WriteString("# TYPE cf_space_disk_allocated_gb gauge\n")
+	for _, org := range result.Organizations {
+		for _, space := range org.Spaces {
+			metrics.WriteString(fmt.Sprintf("cf_space_disk_allocated_gb{org=\"%s\",space=\"%s\"} %.2f\n", org.Name, space.Name, space.DiskGB))
+		}
+	}
+
 	metrics.WriteString("# HELP cf_org_service_instances Number of service instances per organization\n")
 	metrics.WriteString("# TYPE cf_org_service_instances gauge\n")
 	for _, org := range result.Organizations {
 		metrics.WriteString(fmt.Sprintf("cf_org_service_instances{org=\"%s\"} %d\n", org.Name, org.SIs))
 	}
-	
+
 	metrics.WriteString("# HELP cf_org_billable_service_instances Number of billable service instances per organization\n")
 	metrics.WriteString("# TYPE cf_org_billable_service_instances gauge\n")
 	for _, org := range result.Organizations {
 		metrics.WriteString(fmt.Sprintf("cf_org_billable_service_instances{org=\"%s\"} %d\n", org.Name, org.BillableSIs))
 	}
-	
+
+	metrics.WriteString("# HELP cf_org_unknown_plan_service_instances Number of service instances per organization whose plan or offering is missing from the catalog\n")
+	metrics.WriteString("# TYPE cf_org_unknown_plan_service_instances gauge\n")
+	for _, org := range result.Organizations {
+		metrics.WriteString(fmt.Sprintf("cf_org_unknown_plan_service_instances{org=\"%s\"} %d\n", org.Name, org.UnknownPlanSIs))
+	}
+
+	metrics.WriteString("# HELP cf_org_service_instances_by_type Number of service instances owned by each organization by type\n")
+	metrics.WriteString("# TYPE cf_org_service_instances_by_type gauge\n")
+	for _, org := range result.Organizations {
+		metrics.WriteString(fmt.Sprintf("cf_org_service_instances_by_type{org=\"%s\",type=\"managed\"} %d\n", org.Name, org.ManagedSIs))
+		metrics.WriteString(fmt.Sprintf("cf_org_service_instances_by_type{org=\"%s\",type=\"user-provided\"} %d\n", org.Name, org.UserProvidedSIs))
+	}
+
+	metrics.WriteString("# HELP cf_org_shared_service_instances Number of service instances owned by each organization and shared into others\n")
+	metrics.WriteString("# TYPE cf_org_shared_service_instances gauge\n")
+	for _, org := range result.Organizations {
+		metrics.WriteString(fmt.Sprintf("cf_org_shared_service_instances{org=\"%s\"} %d\n", org.Name, org.SharedSIs))
+	}
+
+	metrics.WriteString("# HELP cf_org_shared_in_service_instances Number of service instances shared into each organization from others (not counted in its service instances)\n")
+	metrics.WriteString("# TYPE cf_org_shared_in_service_instances gauge\n")
+	for _, org := range result.Organizations {
+		metrics.WriteString(fmt.Sprintf("cf_org_shared_in_service_instances{org=\"%s\"} %d\n", org.Name, org.SharedInSIs))
+	}
+
+	billableOrphans := 0
+	for _, orphan := range result.OrphanedServiceInstances {
+		if orphan.Billable {
+			billableOrphans++
+		}
+	}
+	metrics.WriteString("# HELP cf_orphaned_service_instances Number of managed service instances without app bindings or service keys (excludes skipped orgs)\n")
+	metrics.WriteString("# TYPE cf_orphaned_service_instances gauge\n")
+	metrics.WriteString(fmt.Sprintf("cf_orphaned_service_instances %d\n", len(result.OrphanedServiceInstances)))
+
+	metrics.WriteString("# HELP cf_billable_orphaned_service_instances Number of billable service instances without app bindings or service keys\n")
+	metrics.WriteString("# TYPE cf_billable_orphaned_service_instances gauge\n")
+	metrics.WriteString(fmt.Sprintf("cf_billable_orphaned_service_instances %d\n", billableOrphans))
+
+	metrics.WriteString("# HELP cf_org_orphaned_service_instances Number of managed service instances per organization without app bindings or service keys\n")
+	metrics.WriteString("# TYPE cf_org_orphaned_service_instances gauge\n")
+	for _, org := range result.Organizations {
+		metrics.WriteString(fmt.Sprintf("cf_org_orphaned_service_instances{org=\"%s\"} %d\n", org.Name, org.OrphanedSIs))
+	}
+
+	metrics.WriteString("# HELP cf_service_instances_by_offering Number of managed service instances per broker and offering (excludes skipped orgs)\n")
+	metrics.WriteString("# TYPE cf_service_instances_by_offering gauge\n")
+	for _, offering := range result.ServiceOfferings {
+		metrics.WriteString(fmt.Sprintf("cf_service_instances_by_offering{broker=\"%s\",offering=\"%s\",space_scoped=\"%t\",billable=\"%t\"} %d\n",
+			offering.Broker, offering.Offering, offering.SpaceScoped, offering.Billable, offering.Instances))
+	}
+
+	if result.Tasks != nil {
+		metrics.WriteString("# HELP cf_running_tasks Number of tasks running across all organizations (not included in application instances)\n")
+		metrics.WriteString("# TYPE cf_running_tasks gauge\n")
+		metrics.WriteString(fmt.Sprintf("cf_running_tasks %d\n", result.Tasks.Running))
+
+		metrics.WriteString("# HELP cf_running_tasks_memory_gb Memory allocated to running tasks, in GB\n")
+		metrics.WriteString("# TYPE cf_running_tasks_memory_gb gauge\n")
+		metrics.WriteString(fmt.Sprintf("cf_running_tasks_memory_gb %.2f\n", result.Tasks.MemoryGB))
+
+		metrics.WriteString("# HELP cf_running_tasks_hours Run time of the running tasks so far, in hours\n")
+		metrics.WriteString("# TYPE cf_running_tasks_hours gauge\n")
+		metrics.WriteString(fmt.Sprintf("cf_running_tasks_hours %.2f\n", result.Tasks.Hours))
+
+		metrics.WriteString("# HELP cf_running_tasks_longest_hours Run time of the longest-running task, in hours\n")
+		metrics.WriteString("# TYPE cf_running_tasks_longest_hours gauge\n")
+		metrics.WriteString(fmt.Sprintf("cf_running_tasks_longest_hours %.2f\n", result.Tasks.LongestHours))
+
+		metrics.WriteString("# HELP cf_org_running_tasks Number of tasks running per organization\n")
+		metrics.WriteString("# TYPE cf_org_running_tasks gauge\n")
+		for _, org := range result.Organizations {
+			running := 0
+			if org.Tasks != nil {
+				running = org.Tasks.Running
+			}
+			metrics.WriteString(fmt.Sprintf("cf_org_running_tasks{org=\"%s\"} %d\n", org.Name, running))
+		}
+
+		metrics.WriteString("# HELP cf_org_running_tasks_memory_gb Memory allocated to running tasks per organization, in GB\n")
+		metrics.WriteString("# TYPE cf_org_running_tasks_memory_gb gauge\n")
+		for _, org := range result.Organizations {
+			memory := 0.0
+			if org.Tasks != nil {
+				memory = org.Tasks.MemoryGB
+			}
+			metrics.WriteString(fmt.Sprintf("cf_org_running_tasks_memory_gb{org=\"%s\"} %.2f\n", org.Name, memory))
+		}
+
+		metrics.WriteString("# HELP cf_org_running_tasks_hours Run time of the running tasks per organization so far, in hours\n")
+		metrics.WriteString("# TYPE cf_org_running_tasks_hours gauge\n")
+		for _, org := range result.Organizations {
+			hours := 0.0
+			if org.Tasks != nil {
+				hours = org.Tasks.Hours
+			}
+			metrics.WriteString(fmt.Sprintf("cf_org_running_tasks_hours{org=\"%s\"} %.2f\n", org.Name, hours))
+		}
+	}
+
+	if len(result.IdleApps) > 0 {
+		idleByReason := map[string]int{idleStopped: 0, idleScaledToZero: 0, idleNoRunningInstances: 0, idleCrashing: 0}
+		orgIdle := make(map[string]map[string]int)
+		stoppedWithBillable := 0
+		for _, app := range result.IdleApps {
+			idleByReason[app.Reason]++
+			if orgIdle[app.Org] == nil {
+				orgIdle[app.Org] = make(map[string]int)
+			}
+			orgIdle[app.Org][app.Reason]++
+			if app.Reason == idleStopped && app.billableServiceInstances() > 0 {
+				stoppedWithBillable++
+			}
+		}
+
+		metrics.WriteString("# HELP cf_idle_apps Number of stopped apps and started apps without healthy instances by reason (excludes skipped orgs)\n")
+		metrics.WriteString("# TYPE cf_idle_apps gauge\n")
+		for _, reason := range []string{idleStopped, idleScaledToZero, idleNoRunningInstances, idleCrashing} {
+			metrics.WriteString(fmt.Sprintf("cf_idle_apps{reason=\"%s\"} %d\n", reason, idleByReason[reason]))
+		}
+
+		metrics.WriteString("# HELP cf_stopped_apps_with_billable_service_instances Number of stopped apps with billable service instances bound\n")
+		metrics.WriteString("# TYPE cf_stopped_apps_with_billable_service_instances gauge\n")
+		metrics.WriteString(fmt.Sprintf("cf_stopped_apps_with_billable_service_instances %d\n", stoppedWithBillable))
+
+		metrics.WriteString("# HELP cf_org_idle_apps Number of idle apps per organization and reason\n")
+		metrics.WriteString("# TYPE cf_org_idle_apps gauge\n")
+		for _, org := range result.Organizations {
+			for _, reason := range []string{idleStopped, idleScaledToZero, idleNoRunningInstances, idleCrashing} {
+				if n := orgIdle[org.Name][reason]; n > 0 {
+					metrics.WriteString(fmt.Sprintf("cf_org_idle_apps{org=\"%s\",reason=\"%s\"} %d\n", org.Name, reason, n))
+				}
+			}
+		}
+	}
+
+	if result.TotalSidecarInstances > 0 {
+		metrics.WriteString("# HELP cf_sidecar_instances Number of sidecar processes running alongside application instances (not included in application instances)\n")
+		metrics.WriteString("# TYPE cf_sidecar_instances gauge\n")
+		metrics.WriteString(fmt.Sprintf("cf_sidecar_instances %d\n", result.TotalSidecarInstances))
+
+		metrics.WriteString("# HELP cf_org_sidecar_instances Number of sidecar processes running per organization\n")
+		metrics.WriteString("# TYPE cf_org_sidecar_instances gauge\n")
+		for _, org := range result.Organizations {
+			metrics.WriteString(fmt.Sprintf("cf_org_sidecar_instances{org=\"%s\"} %d\n", org.Name, org.SidecarInstances))
+		}
+	}
+
+	if len(result.Quotas) > 0 {
+		metrics.WriteString("# HELP cf_quota_used Resources counted against the quota of an organization, or of a space when space is set\n")
+		metrics.WriteString("# TYPE cf_quota_used gauge\n")
+		for _, quota := range result.Quotas {
+			for _, resource := range quota.Resources {
+				metrics.WriteString(fmt.Sprintf("cf_quota_used{org=\"%s\",space=\"%s\",quota=\"%s\",resource=\"%s\"} %d\n",
+					quota.Org, quota.Space, quota.Quota, resource.Resource, resource.Used))
+			}
+		}
+
+		metrics.WriteString("# HELP cf_quota_limit Quota limits of organizations and spaces (unlimited resources are left out)\n")
+		metrics.WriteString("# TYPE cf_quota_limit gauge\n")
+		for _, quota := range result.Quotas {
+			for _, resource := range quota.Resources {
+				if resource.Limit != nil {
+					metrics.WriteString(fmt.Sprintf("cf_quota_limit{org=\"%s\",space=\"%s\",quota=\"%s\",resource=\"%s\"} %d\n",
+						quota.Org, quota.Space, quota.Quota, resource.Resource, *resource.Limit))
+				}
+			}
+		}
+
+		metrics.WriteString("# HELP cf_quota_utilization_percent Percentage of quota limits in use (unlimited resources are left out)\n")
+		metrics.WriteString("# TYPE cf_quota_utilization_percent gauge\n")
+		for _, quota := range result.Quotas {
+			for _, resource := range quota.Resources {
+				if resource.Limit != nil {
+					metrics.WriteString(fmt.Sprintf("cf_quota_utilization_percent{org=\"%s\",space=\"%s\",quota=\"%s\",resource=\"%s\"} %.2f\n",
+						quota.Org, quota.Space, quota.Quota, resource.Resource, resource.Utilization))
+				}
+			}
+		}
+	}
+
+	if len(result.Stacks) > 0 {
+		metrics.WriteString("# HELP cf_application_instances_by_stack Number of application instances of started apps per stack and lifecycle type\n")
+		metrics.WriteString("# TYPE cf_application_instances_by_stack gauge\n")
+		for _, stack := range result.Stacks {
+			metrics.WriteString(fmt.Sprintf("cf_application_instances_by_stack{stack=\"%s\",lifecycle=\"%s\"} %d\n", stack.Stack, stack.Lifecycle, stack.AIs))
+		}
+
+		metrics.WriteString("# HELP cf_billable_application_instances_by_stack Number of billable application instances per stack and lifecycle type (excludes skipped orgs)\n")
+		metrics.WriteString("# TYPE cf_billable_application_instances_by_stack gauge\n")
+		for _, stack := range result.Stacks {
+			metrics.WriteString(fmt.Sprintf("cf_billable_application_instances_by_stack{stack=\"%s\",lifecycle=\"%s\"} %d\n", stack.Stack, stack.Lifecycle, stack.BillableAIs))
+		}
+
+		metrics.WriteString("# HELP cf_org_application_instances_by_stack Number of application instances per organization, stack and lifecycle type\n")
+		metrics.WriteString("# TYPE cf_org_application_instances_by_stack gauge\n")
+		for _, org := range result.Organizations {
+			for _, stack := range org.Stacks {
+				metrics.WriteString(fmt.Sprintf("cf_org_application_instances_by_stack{org=\"%s\",stack=\"%s\",lifecycle=\"%s\"} %d\n", org.Name, stack.Stack, stack.Lifecycle, stack.AIs))
+			}
+		}
+	}
+
+	if len(result.IsolationSegments) > 0 {
+		metrics.WriteString("# HELP cf_isolation_segment_application_instances Number of application instances of started apps per isolation segment\n")
+		metrics.WriteString("# TYPE cf_isolation_segment_application_instances gauge\n")
+		for _, segment := range result.IsolationSegments {
+			metrics.WriteString(fmt.Sprintf("cf_isolation_segment_application_instances{segment=\"%s\"} %d\n", segment.Name, segment.AIs))
+		}
+
+		metrics.WriteString("# HELP cf_isolation_segment_billable_application_instances Number of billable application instances per isolation segment (excludes skipped orgs)\n")
+		metrics.WriteString("# TYPE cf_isolation_segment_billable_application_instances gauge\n")
+		for _, segment := range result.IsolationSegments {
+			metrics.WriteString(fmt.Sprintf("cf_isolation_segment_billable_application_instances{segment=\"%s\"} %d\n", segment.Name, segment.BillableAIs))
+		}
+	}
+
+	if result.AppUsageService != nil {
+		writeAppUsageServiceMetrics(&metrics, result.AppUsageService)
+	}
+	if result.AppUsageEvents != nil {
+		writeEventUsageMetrics(&metrics, result.AppUsageEvents)
+	}
+	if result.ServiceUsageEvents != nil {
+		writeServiceEventUsageMetrics(&metrics, result.ServiceUsageEvents)
+	}
+
 	return metrics.String()
-}
\ No newline at end of file
+}
+
+// writeEventUsageMetrics formats the AI-hours and peaks reconstructed from app
+// usage events. Totals and orgs cover every tracked period, spaces only the current one.
+func writeEventUsageMetrics(metrics *strings.Builder, usage *EventUsage) {
+	metrics.WriteString("# HELP cf_app_instance_hours Application instance hours per billing period from app usage events\n")
+	metrics.WriteString("# TYPE cf_app_instance_hours gauge\n")
+	for _, period := range usage.Periods {
+		metrics.WriteString(fmt.Sprintf("cf_app_instance_hours{period=\"%s\"} %g\n", period.Period, period.AIHours))
+	}
+
+	metrics.WriteString("# HELP cf_billable_app_instance_hours Billable application instance hours per billing period from app usage events (excludes skipped orgs)\n")
+	metrics.WriteString("# TYPE cf_billable_app_instance_hours gauge\n")
+	for _, period := range usage.Periods {
+		metrics.WriteString(fmt.Sprintf("cf_billable_app_instance_hours{period=\"%s\"} %g\n", period.Period, period.BillableAIHours))
+	}
+
+	metrics.WriteString("# HELP cf_peak_application_instances Peak concurrent application instances per billing period from app usage events\n")
+	metrics.WriteString("# TYPE cf_peak_application_instances gauge\n")
+	for _, period := range usage.Periods {
+		metrics.WriteString(fmt.Sprintf("cf_peak_application_instances{period=\"%s\"} %d\n", period.Period, period.PeakAIs))
+	}
+
+	metrics.WriteString("# HELP cf_billable_peak_application_instances Peak concurrent billable application instances per billing period from app usage events\n")
+	metrics.WriteString("# TYPE cf_billable_peak_application_instances gauge\n")
+	for _, period := range usage.Periods {
+		metrics.WriteString(fmt.Sprintf("cf_billable_peak_application_instances{period=\"%s\"} %d\n", period.Period, period.BillablePeakAIs))
+	}
+
+	metrics.WriteString("# HELP cf_org_app_instance_hours Application instance hours per organization and billing period\n")
+	metrics.WriteString("# TYPE cf_org_app_instance_hours gauge\n")
+	for _, period := range usage.Periods {
+		for _, org := range period.Organizations {
+			metrics.WriteString(fmt.Sprintf("cf_org_app_instance_hours{org=\"%s\",period=\"%s\"} %g\n", org.Name, period.Period, org.AIHours))
+		}
+	}
+
+	metrics.WriteString("# HELP cf_org_peak_application_instances Peak concurrent application instances per organization and billing period\n")
+	metrics.WriteString("# TYPE cf_org_peak_application_instances gauge\n")
+	for _, period := range usage.Periods {
+		for _, org := range period.Organizations {
+			metrics.WriteString(fmt.Sprintf("cf_org_peak_application_instances{org=\"%s\",period=\"%s\"} %d\n", org.Name, period.Period, org.PeakAIs))
+		}
+	}
+
+	if len(usage.Periods) == 0 {
+		return
+	}
+	current := usage.Periods[len(usage.Periods)-1]
+
+	metrics.WriteString("# HELP cf_space_app_instance_hours Application instance hours per space in the current billing period\n")
+	metrics.WriteString("# TYPE cf_space_app_instance_hours gauge\n")
+	for _, space := range current.Spaces {
+		metrics.WriteString(fmt.Sprintf("cf_space_app_instance_hours{org=\"%s\",space=\"%s\",period=\"%s\"} %g\n", space.Org, space.Name, current.Period, space.AIHours))
+	}
+
+	metrics.WriteString("# HELP cf_space_peak_application_instances Peak concurrent application instances per space in the current billing period\n")
+	metrics.WriteString("# TYPE cf_space_peak_application_instances gauge\n")
+	for _, space := range current.Spaces {
+		metrics.WriteString(fmt.Sprintf("cf_space_peak_application_instances{org=\"%s\",space=\"%s\",period=\"%s\"} %d\n", space.Org, space.Name, current.Period, space.PeakAIs))
+	}
+}
+
+// writeServiceEventUsageMetrics formats the SI-days and peaks reconstructed from service usage events
+func writeServiceEventUsageMetrics(metrics *strings.Builder, usage *ServiceEventUsage) {
+	metrics.WriteString("# HELP cf_service_instance_days Managed service instance days per billing period from service usage events\n")
+	metrics.WriteString("# TYPE cf_service_instance_days gauge\n")
+	for _, period := range usage.Periods {
+		metrics.WriteString(fmt.Sprintf("cf_service_instance_days{period=\"%s\"} %g\n", period.Period, period.SIDays))
+	}
+
+	metrics.WriteString("# HELP cf_billable_service_instance_days Billable service instance days per billing period from service usage events\n")
+	metrics.WriteString("# TYPE cf_billable_service_instance_days gauge\n")
+	for _, period := range usage.Periods {
+		metrics.WriteString(fmt.Sprintf("cf_billable_service_instance_days{period=\"%s\"} %g\n", period.Period, period.BillableSIDays))
+	}
+
+	metrics.WriteString("# HELP cf_peak_billable_service_instances Peak billable service instances per billing period from service usage events\n")
+	metrics.WriteString("# TYPE cf_peak_billable_service_instances gauge\n")
+	for _, period := range usage.Periods {
+		metrics.WriteString(fmt.Sprintf("cf_peak_billable_service_instances{period=\"%s\"} %d\n", period.Period, period.BillablePeakSIs))
+	}
+
+	metrics.WriteString("# HELP cf_org_service_instance_days Managed service instance days per organization and billing period\n")
+	metrics.WriteString("# TYPE cf_org_service_instance_days gauge\n")
+	for _, period := range usage.Periods {
+		for _, org := range period.Organizations {
+			metrics.WriteString(fmt.Sprintf("cf_org_service_instance_days{org=\"%s\",period=\"%s\"} %g\n", org.Name, period.Period, org.SIDays))
+		}
+	}
+
+	metrics.WriteString("# HELP cf_org_billable_service_instance_days Billable service instance days per organization and billing period\n")
+	metrics.WriteString("# TYPE cf_org_billable_service_instance_days gauge\n")
+	for _, period := range usage.Periods {
+		for _, org := range period.Organizations {
+			metrics.WriteString(fmt.Sprintf("cf_org_billable_service_instance_days{org=\"%s\",period=\"%s\"} %g\n", org.Name, period.Period, org.BillableSIDays))
+		}
+	}
+
+	metrics.WriteString("# HELP cf_org_peak_billable_service_instances Peak billable service instances per organization and billing period\n")
+	metrics.WriteString("# TYPE cf_org_peak_billable_service_instances gauge\n")
+	for _, period := range usage.Periods {
+		for _, org := range period.Organizations {
+			metrics.WriteString(fmt.Sprintf("cf_org_peak_billable_service_instances{org=\"%s\",period=\"%s\"} %d\n", org.Name, period.Period, org.BillablePeakSIs))
+		}
+	}
+}
+
+// writeAppUsageServiceMetrics formats the monthly and yearly history from the app-usage service
+func writeAppUsageServiceMetrics(metrics *strings.Builder, report *AppUsageServiceReport) {
+	metrics.WriteString("# HELP cf_app_usage_monthly_average_instances Average application instances per month from the app-usage service\n")
+	metrics.WriteString("# TYPE cf_app_usage_monthly_average_instances gauge\n")
+	for _, month := range report.Monthly {
+		metrics.WriteString(fmt.Sprintf("cf_app_usage_monthly_average_instances{year=\"%d\",month=\"%d\"} %g\n", month.Year, month.Month, month.AverageAppInstances))
+	}
+
+	metrics.WriteString("# HELP cf_app_usage_monthly_maximum_instances Maximum application instances per month from the app-usage service\n")
+	metrics.WriteString("# TYPE cf_app_usage_monthly_maximum_instances gauge\n")
+	for _, month := range report.Monthly {
+		metrics.WriteString(fmt.Sprintf("cf_app_usage_monthly_maximum_instances{year=\"%d\",month=\"%d\"} %d\n", month.Year, month.Month, month.MaximumAppInstances))
+	}
+
+	metrics.WriteString("# HELP cf_app_usage_monthly_instance_hours Application instance hours per month from the app-usage service\n")
+	metrics.WriteString("# TYPE cf_app_usage_monthly_instance_hours gauge\n")
+	for _, month := range report.Monthly {
+		metrics.WriteString(fmt.Sprintf("cf_app_usage_monthly_instance_hours{year=\"%d\",month=\"%d\"} %g\n", month.Year, month.Month, month.AppInstanceHours))
+	}
+
+	metrics.WriteString("# HELP cf_app_usage_yearly_average_instances Average application instances per year from the app-usage service\n")
+	metrics.WriteString("# TYPE cf_app_usage_yearly_average_instances gauge\n")
+	for _, year := range report.Yearly {
+		metrics.WriteString(fmt.Sprintf("cf_app_usage_yearly_average_instances{year=\"%d\"} %g\n", year.Year, year.AverageAppInstances))
+	}
+
+	metrics.WriteString("# HELP cf_app_usage_yearly_maximum_instances Maximum application instances per year from the app-usage service\n")
+	metrics.WriteString("# TYPE cf_app_usage_yearly_maximum_instances gauge\n")
+	for _, year := range report.Yearly {
+		metrics.WriteString(fmt.Sprintf("cf_app_usage_yearly_maximum_instances{year=\"%d\"} %d\n", year.Year, year.MaximumAppInstances))
+	}
+
+	metrics.WriteString("# HELP cf_app_usage_yearly_instance_hours Application instance hours per year from the app-usage service\n")
+	metrics.WriteString("# TYPE cf_app_usage_yearly_instance_hours gauge\n")
+	for _, year := range report.Yearly {
+		metrics.WriteString(fmt.Sprintf("cf_app_usage_yearly_instance_hours{year=\"%d\"} %g\n", year.Year, year.AppInstanceHours))
+	}
+
+	if services := report.Services; services != nil {
+		metrics.WriteString("# HELP cf_service_usage_monthly_average_instances Average service instances per offering and month from the app-usage service\n")
+		metrics.WriteString("# TYPE cf_service_usage_monthly_average_instances gauge\n")
+		for _, service := range services.MonthlyServiceReports {
+			for _, usage := range service.Usages {
+				metrics.WriteString(fmt.Sprintf("cf_service_usage_monthly_average_instances{service=\"%s\",year=\"%d\",month=\"%d\"} %g\n", service.ServiceName, usage.Year, usage.Month, usage.AverageInstances))
+			}
+		}
+
+		metrics.WriteString("# HELP cf_service_usage_monthly_maximum_instances Maximum service instances per offering and month from the app-usage service\n")
+		metrics.WriteString("# TYPE cf_service_usage_monthly_maximum_instances gauge\n")
+		for _, service := range services.MonthlyServiceReports {
+			for _, usage := range service.Usages {
+				metrics.WriteString(fmt.Sprintf("cf_service_usage_monthly_maximum_instances{service=\"%s\",year=\"%d\",month=\"%d\"} %d\n", service.ServiceName, usage.Year, usage.Month, usage.MaximumInstances))
+			}
+		}
+
+		metrics.WriteString("# HELP cf_service_usage_monthly_instance_hours Service instance hours per offering and month from the app-usage service\n")
+		metrics.WriteString("# TYPE cf_service_usage_monthly_instance_hours gauge\n")
+		for _, service := range services.MonthlyServiceReports {
+			for _, usage := range service.Usages {
+				metrics.WriteString(fmt.Sprintf("cf_service_usage_monthly_instance_hours{service=\"%s\",year=\"%d\",month=\"%d\"} %g\n", service.ServiceName, usage.Year, usage.Month, usage.DurationInHours))
+			}
+		}
+
+		metrics.WriteString("# HELP cf_service_usage_yearly_maximum_instances Maximum service instances per offering and year from the app-usage service\n")
+		metrics.WriteString("# TYPE cf_service_usage_yearly_maximum_instances gauge\n")
+		for _, service := range services.YearlyServiceReports {
+			metrics.WriteString(fmt.Sprintf("cf_service_usage_yearly_maximum_instances{service=\"%s\",year=\"%d\"} %d\n", service.ServiceName, service.Year, service.MaximumInstances))
+		}
+
+		metrics.WriteString("# HELP cf_service_usage_yearly_instance_hours Service instance hours per offering and year from the app-usage service\n")
+		metrics.WriteString("# TYPE cf_service_usage_yearly_instance_hours gauge\n")
+		for _, service := range services.YearlyServiceReports {
+			metrics.WriteString(fmt.Sprintf("cf_service_usage_yearly_instance_hours{service=\"%s\",year=\"%d\"} %g\n", service.ServiceName, service.Year, service.DurationInHours))
+		}
+	}
+
+	if len(report.Organizations) > 0 {
+		metrics.WriteString("# HELP cf_org_app_usage_instance_hours Application instance hours per organization this month from the app-usage service\n")
+		metrics.WriteString("# TYPE cf_org_app_usage_instance_hours gauge\n")
+		for _, org := range report.Organizations {
+			metrics.WriteString(fmt.Sprintf("cf_org_app_usage_instance_hours{org=\"%s\",year=\"%d\",month=\"%d\"} %g\n", org.Name, org.Year, org.Month, org.AppInstanceHours))
+		}
+
+		metrics.WriteString("# HELP cf_org_service_usage_instance_hours Service instance hours per organization this month from the app-usage service\n")
+		metrics.WriteString("# TYPE cf_org_service_usage_instance_hours gauge\n")
+		for _, org := range report.Organizations {
+			metrics.WriteString(fmt.Sprintf("cf_org_service_usage_instance_hours{org=\"%s\",year=\"%d\",month=\"%d\"} %g\n", org.Name, org.Year, org.Month, org.ServiceInstanceHours))
+		}
+	}
+}
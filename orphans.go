@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"text/tabwriter"
+	"time"
+)
+
+func (c *CFClient) getServiceCredentialBindings(ctx context.Context) ([]ServiceCredentialBinding, error) {
+	bindings, err := collectResources(listResources[ServiceCredentialBinding](ctx, c, "/v3/service_credential_bindings?per_page=5000"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load service credential bindings: %w", err)
+	}
+	return bindings, nil
+}
+
+// findOrphanedServiceInstances returns the managed instances of listing that
+// have neither app bindings nor service keys, oldest first. Instances in
+// skipped orgs are left out. Age is measured at now.
+func findOrphanedServiceInstances(listing *serviceInstanceListing, bindings []ServiceCredentialBinding, catalog *serviceCatalog, orgNames map[string]string, skipOrgs map[string]bool, now time.Time) []OrphanedServiceInstance {
+	bound := make(map[string]bool)
+	for _, binding := range bindings {
+		bound[binding.Relationships.ServiceInstance.Data.GUID] = true
+	}
+
+	orphans := []OrphanedServiceInstance{}
+	for _, instance := range listing.Instances {
+		orgGUID := listing.orgOf(instance)
+		if instance.Type != "managed" || bound[instance.GUID] || skipOrgs[orgGUID] {
+			continue
+		}
+
+		planGUID := instance.Relationships.ServicePlan.Data.GUID
+		offering := catalog.serviceOffering(planGUID)
+		billable, _ := catalog.isServiceInstanceBillable(instance)
+		orphan := OrphanedServiceInstance{
+			GUID:      instance.GUID,
+			Name:      instance.Name,
+			Org:       orgNames[orgGUID],
+			Space:     listing.spaceNames[instance.Relationships.Space.Data.GUID],
+			Broker:    catalog.serviceBroker(offering).Name,
+			Offering:  offering.Name,
+			Plan:      catalog.servicePlans[planGUID].Name,
+			Billable:  billable,
+			CreatedAt: instance.CreatedAt,
+		}
+		if !instance.CreatedAt.IsZero() {
+			orphan.AgeDays = int(now.Sub(instance.CreatedAt).Hours() / 24)
+		}
+		orphans = append(orphans, orphan)
+	}
+
+	sort.Slice(orphans, func(i, j int) bool {
+		if !orphans[i].CreatedAt.Equal(orphans[j].CreatedAt) {
+			return orphans[i].CreatedAt.Before(orphans[j].CreatedAt)
+		}
+		return orphans[i].Name < orphans[j].Name
+	})
+	return orphans
+}
+
+// filterOrphans returns the orphans at least minAgeDays old
+func filterOrphans(orphans []OrphanedServiceInstance, minAgeDays int) []OrphanedServiceInstance {
+	filtered := []OrphanedServiceInstance{}
+	for _, orphan := range orphans {
+		if orphan.AgeDays >= minAgeDays {
+			filtered = append(filtered, orphan)
+		}
+	}
+	return filtered
+}
+
+// printOrphans writes orphaned service instances as a table
+func printOrphans(w io.Writer, orphans []OrphanedServiceInstance) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ORG\tSPACE\tINSTANCE\tOFFERING\tPLAN\tBILLABLE\tAGE (DAYS)")
+	for _, orphan := range orphans {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%t\t%d\n",
+			orphan.Org, orphan.Space, orphan.Name, orphan.Offering, orphan.Plan, orphan.Billable, orphan.AgeDays)
+	}
+	tw.Flush()
+	fmt.Fprintf(w, "\n%d orphaned service instances\n", len(orphans))
+}
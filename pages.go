@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"iter"
+	"net/url"
+	"strings"
+)
+
+// listPages iterates over the pages of a v3 list endpoint, fetching each one
+// only when the caller asks for it. Iteration ends after the first error,
+// including the cancellation of ctx.
+func listPages(ctx context.Context, c *CFClient, endpoint string) iter.Seq2[*CFResponse, error] {
+	return func(yield func(*CFResponse, error) bool) {
+		for endpoint != "" {
+			if err := ctx.Err(); err != nil {
+				yield(nil, err)
+				return
+			}
+
+			data, err := c.apiCall(ctx, endpoint)
+			if err != nil {
+				yield(nil, err)
+				return
+			}
+			var page CFResponse
+			if err := json.Unmarshal(data, &page); err != nil {
+				yield(nil, fmt.Errorf("failed to parse response: %w", err))
+				return
+			}
+			if !yield(&page, nil) {
+				return
+			}
+
+			if endpoint, err = c.nextPage(page.Pagination.Next.Href); err != nil {
+				yield(nil, err)
+				return
+			}
+		}
+	}
+}
+
+// listResources iterates over the resources of a v3 list endpoint. Pages are
+// fetched lazily as the caller consumes them, so breaking out of the loop
+// never requests the remaining pages.
+func listResources[T any](ctx context.Context, c *CFClient, endpoint string) iter.Seq2[T, error] {
+	return func(yield func(T, error) bool) {
+		var zero T
+		for page, err := range listPages(ctx, c, endpoint) {
+			if err != nil {
+				yield(zero, err)
+				return
+			}
+			for _, raw := range page.Resources {
+				var resource T
+				if err := json.Unmarshal(raw, &resource); err != nil {
+					yield(zero, fmt.Errorf("failed to parse %s: %w", resourceName(endpoint), err))
+					return
+				}
+				if !yield(resource, nil) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// collectResources drains a resource iterator into a slice
+func collectResources[T any](seq iter.Seq2[T, error]) ([]T, error) {
+	var resources []T
+	for resource, err := range seq {
+		if err != nil {
+			return nil, err
+		}
+		resources = append(resources, resource)
+	}
+	return resources, nil
+}
+
+// nextPage turns a pagination next link into an endpoint relative to the API.
+// Links to any other host are rejected so the access token is never sent there.
+func (c *CFClient) nextPage(href string) (string, error) {
+	if href == "" {
+		return "", nil
+	}
+	next, err := url.Parse(href)
+	if err != nil {
+		return "", fmt.Errorf("invalid pagination link %q: %w", href, err)
+	}
+	api, err := url.Parse(c.apiEndpoint)
+	if err != nil {
+		return "", err
+	}
+	if next.Host != "" && (next.Scheme != api.Scheme || next.Host != api.Host) {
+		return "", fmt.Errorf("pagination link %q leaves the API endpoint %s", href, c.apiEndpoint)
+	}
+
+	// The API endpoint may carry a path prefix that apiCall adds again
+	endpoint := next.RequestURI()
+	if api.Path != "" && api.Path != "/" {
+		endpoint = strings.TrimPrefix(endpoint, strings.TrimSuffix(api.Path, "/"))
+	}
+	return endpoint, nil
+}
+
+// resourceName describes the resources of an endpoint for error messages,
+// e.g. "/v3/service_instances?type=managed" -> "service_instances"
+func resourceName(endpoint string) string {
+	path, _, _ := strings.Cut(endpoint, "?")
+	return path[strings.LastIndex(path, "/")+1:]
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNextPage(t *testing.T) {
+	tests := []struct {
+		name    string
+		api     string
+		href    string
+		want    string
+		wantErr string
+	}{
+		{name: "last page", api: "https://api.example.com", href: "", want: ""},
+		{name: "absolute link", api: "https://api.example.com", href: "https://api.example.com/v3/apps?page=2&per_page=50", want: "/v3/apps?page=2&per_page=50"},
+		{name: "relative link", api: "https://api.example.com", href: "/v3/apps?page=2", want: "/v3/apps?page=2"},
+		{name: "path prefix", api: "https://example.com/cf/", href: "https://example.com/cf/v3/apps?page=3", want: "/v3/apps?page=3"},
+		{name: "foreign host", api: "https://api.example.com", href: "https://evil.example.net/v3/apps?page=2", wantErr: "leaves the API endpoint"},
+		{name: "other port", api: "https://api.example.com", href: "https://api.example.com:8443/v3/apps?page=2", wantErr: "leaves the API endpoint"},
+		{name: "scheme downgrade", api: "https://api.example.com", href: "http://api.example.com/v3/apps?page=2", wantErr: "leaves the API endpoint"},
+		{name: "invalid link", api: "https://api.example.com", href: "https://api.example.com/%zz", wantErr: "invalid pagination link"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &CFClient{apiEndpoint: tt.api}
+			got, err := client.nextPage(tt.href)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("nextPage(%q) = %q, %v; want error %q", tt.href, got, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("nextPage(%q) = %q, %v; want %q", tt.href, got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestListResourcesCancellation(t *testing.T) {
+	tests := []struct {
+		name    string
+		timeout time.Duration // collection timeout; 0 cancels the context instead
+		want    error
+	}{
+		{name: "collection timeout", timeout: 100 * time.Millisecond, want: context.DeadlineExceeded},
+		{name: "cancelled", want: context.Canceled},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := startFakeFoundation(t)
+			// The second page of organizations never arrives
+			server.Stalls = map[string]int{"/v3/organizations": 1}
+			client, config := newFakeClient(t, server)
+			config.CollectionTimeout = tt.timeout
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if tt.timeout == 0 {
+				time.AfterFunc(100*time.Millisecond, cancel)
+			}
+
+			start := time.Now()
+			_, err := collectUsageData(ctx, client, config)
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("collectUsageData error %v, want %v", err, tt.want)
+			}
+			if elapsed := time.Since(start); elapsed > 5*time.Second {
+				t.Errorf("collection returned after %s", elapsed)
+			}
+			if hits := server.Hits("/v3/organizations"); hits != 2 {
+				t.Errorf("%d organization page requests, want 2 (the stalled one ends pagination)", hits)
+			}
+		})
+	}
+}
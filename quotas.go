@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"text/tabwriter"
+)
+
+// defaultQuotaThreshold is the utilization percentage from which the quotas
+// command and the report flag a quota
+const defaultQuotaThreshold = 80
+
+// Quota resources, in the order they are reported
+const (
+	quotaAppInstances     = "app_instances"
+	quotaMemoryMB         = "memory_mb"
+	quotaServiceInstances = "service_instances"
+	quotaRoutes           = "routes"
+)
+
+func (c *CFClient) getOrganizationQuotas(ctx context.Context) ([]OrganizationQuota, error) {
+	return collectResources(listResources[OrganizationQuota](ctx, c, "/v3/organization_quotas?per_page=5000"))
+}
+
+func (c *CFClient) getSpaceQuotas(ctx context.Context) ([]SpaceQuota, error) {
+	return collectResources(listResources[SpaceQuota](ctx, c, "/v3/space_quotas?per_page=5000"))
+}
+
+func (c *CFClient) getRoutes(ctx context.Context) ([]Route, error) {
+	return collectResources(listResources[Route](ctx, c, "/v3/routes?per_page=5000"))
+}
+
+// quotaUsed is what counts against a quota, the way the CC counts it:
+// instances and memory of started processes, managed service instances
+// and routes
+type quotaUsed struct {
+	instances int
+	memory    int // MB
+	services  int
+	routes    int
+}
+
+// collectQuotaUsage measures the use of every org quota and of every space
+// quota that is assigned to a space, from the running processes, the managed
+// service instances and a listing of routes. Skipped orgs are left out.
+func collectQuotaUsage(ctx context.Context, source UsageSource, listings *foundationListings, running []runningProcess, config *Config) ([]QuotaUsage, error) {
+	orgQuotas, err := source.getOrganizationQuotas(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get organization quotas: %w", err)
+	}
+	spaceQuotas, err := source.getSpaceQuotas(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get space quotas: %w", err)
+	}
+	routes, err := source.getRoutes(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get routes: %w", err)
+	}
+
+	spacesByGUID := listings.spacesByGUID()
+	orgUsed := make(map[string]*quotaUsed)
+	spaceUsed := make(map[string]*quotaUsed)
+	used := func(spaceGUID string) (*quotaUsed, *quotaUsed) {
+		org := spacesByGUID[spaceGUID].Relationships.Organization.Data.GUID
+		if orgUsed[org] == nil {
+			orgUsed[org] = &quotaUsed{}
+		}
+		if spaceUsed[spaceGUID] == nil {
+			spaceUsed[spaceGUID] = &quotaUsed{}
+		}
+		return orgUsed[org], spaceUsed[spaceGUID]
+	}
+	for _, process := range running {
+		org, space := used(process.SpaceGUID)
+		memory := process.Process.Instances * process.Process.MemoryInMB
+		org.instances += process.Process.Instances
+		space.instances += process.Process.Instances
+		org.memory += memory
+		space.memory += memory
+	}
+	for _, instance := range listings.instances.Instances {
+		if instance.Type != "managed" {
+			continue
+		}
+		org, space := used(instance.Relationships.Space.Data.GUID)
+		org.services++
+		space.services++
+	}
+	for _, route := range routes {
+		org, space := used(route.Relationships.Space.Data.GUID)
+		org.routes++
+		space.routes++
+	}
+
+	orgNames := make(map[string]string)
+	for _, org := range listings.orgs {
+		orgNames[org.GUID] = org.Name
+	}
+	report := []QuotaUsage{}
+	for _, quota := range orgQuotas {
+		for _, assigned := range quota.Relationships.Organizations.Data {
+			name, ok := orgNames[assigned.GUID]
+			if !ok || shouldSkipOrg(name, config.SkipOrgs) {
+				continue
+			}
+			report = append(report, newQuotaUsage(name, "", quota.Name, quota.QuotaLimits, orgUsed[assigned.GUID]))
+		}
+	}
+	for _, quota := range spaceQuotas {
+		for _, assigned := range quota.Relationships.Spaces.Data {
+			space, ok := spacesByGUID[assigned.GUID]
+			name, known := orgNames[space.Relationships.Organization.Data.GUID]
+			if !ok || !known || shouldSkipOrg(name, config.SkipOrgs) {
+				continue
+			}
+			report = append(report, newQuotaUsage(name, space.Name, quota.Name, quota.QuotaLimits, spaceUsed[assigned.GUID]))
+		}
+	}
+
+	sort.Slice(report, func(i, j int) bool {
+		if report[i].Org != report[j].Org {
+			return report[i].Org < report[j].Org
+		}
+		return report[i].Space < report[j].Space
+	})
+	return report, nil
+}
+
+// newQuotaUsage measures used against the limits of a quota
+func newQuotaUsage(org, space, quota string, limits QuotaLimits, used *quotaUsed) QuotaUsage {
+	if used == nil {
+		used = &quotaUsed{}
+	}
+	usage := QuotaUsage{Org: org, Space: space, Quota: quota}
+	for _, resource := range []QuotaResourceUsage{
+		{Resource: quotaAppInstances, Used: used.instances, Limit: limits.Apps.TotalInstances},
+		{Resource: quotaMemoryMB, Used: used.memory, Limit: limits.Apps.TotalMemoryInMB},
+		{Resource: quotaServiceInstances, Used: used.services, Limit: limits.Services.TotalServiceInstances},
+		{Resource: quotaRoutes, Used: used.routes, Limit: limits.Routes.TotalRoutes},
+	} {
+		resource.Utilization = utilization(resource.Used, resource.Limit)
+		usage.MaxUtilization = max(usage.MaxUtilization, resource.Utilization)
+		usage.Resources = append(usage.Resources, resource)
+	}
+	return usage
+}
+
+// utilization returns used as a percentage of limit, 0 when unlimited. A zero
+// limit counts as exhausted.
+func utilization(used int, limit *int) float64 {
+	switch {
+	case limit == nil:
+		return 0
+	case *limit <= 0:
+		return 100
+	}
+	return math.Round(float64(used)/float64(*limit)*10000) / 100
+}
+
+// filterQuotas returns the quota usages with a resource at or above threshold percent
+func filterQuotas(quotas []QuotaUsage, threshold float64) []QuotaUsage {
+	filtered := []QuotaUsage{}
+	for _, quota := range quotas {
+		if quota.MaxUtilization >= threshold {
+			filtered = append(filtered, quota)
+		}
+	}
+	return filtered
+}
+
+// printQuotas writes quota usage as a table, one row per limited resource
+func printQuotas(w io.Writer, quotas []QuotaUsage) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ORG\tSPACE\tQUOTA\tRESOURCE\tUSED\tLIMIT\tUTILIZATION")
+	for _, quota := range quotas {
+		for _, resource := range quota.Resources {
+			if resource.Limit == nil {
+				continue
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\t%d\t%.1f%%\n",
+				quota.Org, quota.Space, quota.Quota, resource.Resource, resource.Used, *resource.Limit, resource.Utilization)
+		}
+	}
+	tw.Flush()
+	fmt.Fprintf(w, "\n%d quotas\n", len(quotas))
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	bundleFile        = "bundle.json"
+	bundleRequestsDir = "requests"
+)
+
+// bundle describes a directory of recorded CF API and app-usage responses
+type bundle struct {
+	RecordedAt       time.Time `json:"recorded_at"`
+	APIEndpoint      string    `json:"api_endpoint"`
+	AppUsageEndpoint string    `json:"app_usage_endpoint"`
+	Version          string    `json:"version"`
+}
+
+// exchange is the metadata of one recorded response; the body is stored
+// next to it so it is replayed byte for byte
+type exchange struct {
+	Service     string `json:"service"` // "api" or "app-usage"
+	Path        string `json:"path"`    // path and query relative to the service
+	Status      int    `json:"status"`
+	ContentType string `json:"content_type,omitempty"`
+	BodyFile    string `json:"body_file"`
+}
+
+// tokenFields matches token values that must never end up in a bundle
+var tokenFields = regexp.MustCompile(`"(access_token|refresh_token|id_token)"\s*:\s*"[^"]*"`)
+
+// recorder captures every response fetched through authorizedGet
+type recorder struct {
+	dir string
+	mu  sync.Mutex
+	seq int
+}
+
+// newRecorder creates the bundle directory and writes its description
+func newRecorder(dir string, b bundle) (*recorder, error) {
+	if err := os.MkdirAll(filepath.Join(dir, bundleRequestsDir), 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create record directory: %w", err)
+	}
+	data, err := json.MarshalIndent(b, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(filepath.Join(dir, bundleFile), append(data, '\n'), 0o644); err != nil {
+		return nil, fmt.Errorf("failed to write bundle description: %w", err)
+	}
+	log.Printf("Recording CF API responses to %s", dir)
+	return &recorder{dir: dir}, nil
+}
+
+// record stores resp and returns an equivalent response with the body
+// still readable. token is scrubbed from the stored body.
+func (r *recorder) record(service, path, token string, resp *http.Response) (*http.Response, error) {
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+
+	scrubbed := tokenFields.ReplaceAll(body, []byte(`"$1":"`+redacted+`"`))
+	if token != "" {
+		scrubbed = bytes.ReplaceAll(scrubbed, []byte(token), []byte(redacted))
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.seq++
+	name := fmt.Sprintf("%04d", r.seq)
+	ex := exchange{
+		Service:     service,
+		Path:        path,
+		Status:      resp.StatusCode,
+		ContentType: resp.Header.Get("Content-Type"),
+		BodyFile:    name + ".body",
+	}
+	meta, err := json.MarshalIndent(ex, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	dir := filepath.Join(r.dir, bundleRequestsDir)
+	if err := os.WriteFile(filepath.Join(dir, ex.BodyFile), scrubbed, 0o644); err != nil {
+		return nil, fmt.Errorf("failed to record response: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, name+".json"), append(meta, '\n'), 0o644); err != nil {
+		return nil, fmt.Errorf("failed to record response: %w", err)
+	}
+	return resp, nil
+}
+
+// replayer serves recorded responses in place of the CF API. Repeated
+// requests for the same path are answered in recording order, the last
+// response repeating once they are used up.
+type replayer struct {
+	bundle    bundle
+	mu        sync.Mutex
+	exchanges map[string][]exchange
+	served    map[string]int
+	dir       string
+}
+
+// loadReplayer reads a bundle written by --record
+func loadReplayer(dir string) (*replayer, error) {
+	data, err := os.ReadFile(filepath.Join(dir, bundleFile))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read replay bundle: %w", err)
+	}
+	r := &replayer{
+		exchanges: make(map[string][]exchange),
+		served:    make(map[string]int),
+		dir:       filepath.Join(dir, bundleRequestsDir),
+	}
+	if err := json.Unmarshal(data, &r.bundle); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", bundleFile, err)
+	}
+
+	// Sequence-numbered names sort in recording order
+	files, err := filepath.Glob(filepath.Join(r.dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read recorded response: %w", err)
+		}
+		var ex exchange
+		if err := json.Unmarshal(data, &ex); err != nil {
+			return nil, fmt.Errorf("failed to parse recorded response %s: %w", filepath.Base(file), err)
+		}
+		key := ex.Service + " " + ex.Path
+		r.exchanges[key] = append(r.exchanges[key], ex)
+	}
+	if len(r.exchanges) == 0 {
+		return nil, fmt.Errorf("replay bundle %s contains no recorded responses", dir)
+	}
+	return r, nil
+}
+
+// response returns the recorded response for a request
+func (r *replayer) response(service, path string) (*http.Response, error) {
+	key := service + " " + path
+	r.mu.Lock()
+	recorded := r.exchanges[key]
+	if len(recorded) == 0 {
+		r.mu.Unlock()
+		return nil, fmt.Errorf("no recorded response for %s %s", service, path)
+	}
+	i := min(r.served[key], len(recorded)-1)
+	r.served[key]++
+	r.mu.Unlock()
+
+	ex := recorded[i]
+	body, err := os.ReadFile(filepath.Join(r.dir, ex.BodyFile))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read recorded response: %w", err)
+	}
+	header := make(http.Header)
+	if ex.ContentType != "" {
+		header.Set("Content-Type", ex.ContentType)
+	}
+	return &http.Response{
+		Status:     fmt.Sprintf("%d %s", ex.Status, http.StatusText(ex.Status)),
+		StatusCode: ex.Status,
+		Header:     header,
+		Body:       io.NopCloser(bytes.NewReader(body)),
+	}, nil
+}
+
+// splitServiceURL names the service a URL belongs to and returns the path
+// relative to it
+func (c *CFClient) splitServiceURL(url string) (string, string, error) {
+	if path, ok := strings.CutPrefix(url, c.appUsageEndpoint()); ok && c.appUsageEndpoint() != c.apiEndpoint {
+		return "app-usage", path, nil
+	}
+	if path, ok := strings.CutPrefix(url, c.apiEndpoint); ok {
+		return "api", path, nil
+	}
+	return "", "", errors.New("request outside the API and app-usage endpoints: " + url)
+}
+
+// setupReplay points the client at a recorded bundle instead of a foundation
+func (c *CFClient) setupReplay(dir string) error {
+	r, err := loadReplayer(dir)
+	if err != nil {
+		return err
+	}
+	c.replay = r
+	c.apiEndpoint = r.bundle.APIEndpoint
+	c.appUsageURL = r.bundle.AppUsageEndpoint
+	c.appUsageSource = "recorded"
+	c.now = func() time.Time { return r.bundle.RecordedAt }
+	log.Printf("Replaying responses recorded from %s at %s", r.bundle.APIEndpoint, r.bundle.RecordedAt.Format(time.RFC3339))
+	return nil
+}
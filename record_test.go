@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRecordAndReplay(t *testing.T) {
+	server := startFakeFoundation(t)
+	dir := t.TempDir()
+
+	_, config := newFakeClient(t, server)
+	config.IdleApps = true
+	config.Sidecars = true
+	config.AppUsageEvents = true
+	config.ServiceUsageEvents = true
+	config.RecordDir = dir
+	recording, err := NewCFClient(context.Background(), config)
+	if err != nil {
+		t.Fatalf("failed to start recording: %v", err)
+	}
+	recordedAt := recording.now()
+	time.Sleep(10 * time.Millisecond)
+	if now := recording.now(); !now.Equal(recordedAt) {
+		t.Errorf("recording clock moved from %s to %s", recordedAt, now)
+	}
+	recorded, err := collectUsageData(context.Background(), recording, config)
+	if err != nil {
+		t.Fatalf("recorded collection: %v", err)
+	}
+
+	replayConfig := *config
+	replayConfig.RecordDir = ""
+	replayConfig.ReplayDir = dir
+	replaying, err := NewCFClient(context.Background(), &replayConfig)
+	if err != nil {
+		t.Fatalf("failed to load the recording: %v", err)
+	}
+	if !replaying.now().Equal(recordedAt) {
+		t.Errorf("replay time %s, want the recording time %s", replaying.now(), recordedAt)
+	}
+	replayed, err := collectUsageData(context.Background(), replaying, &replayConfig)
+	if err != nil {
+		t.Fatalf("replayed collection: %v", err)
+	}
+
+	// The JSON report of the replay is the report of the recorded run, byte for byte
+	var recordedJSON, replayedJSON bytes.Buffer
+	if err := writeJSON(&recordedJSON, recorded); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeJSON(&replayedJSON, replayed); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(recordedJSON.Bytes(), replayedJSON.Bytes()) {
+		t.Errorf("replayed report differs from the recorded one\nrecorded:\n%s\nreplayed:\n%s", recordedJSON.Bytes(), replayedJSON.Bytes())
+	}
+}
+
+func TestRecordInServerMode(t *testing.T) {
+	_, config := newFakeFoundation(t)
+	config.RecordDir = t.TempDir()
+	config.ServerMode = true
+	if _, err := NewCFClient(context.Background(), config); err == nil {
+		t.Fatal("recording accepted in server mode")
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// configReloader re-reads the configuration on demand and hands valid
+// updates to the running refresh loop
+type configReloader struct {
+	load    func() (*Config, error)
+	updates chan *Config
+	mu      sync.Mutex
+	current *Config
+}
+
+func newConfigReloader(config *Config, load func() (*Config, error)) *configReloader {
+	return &configReloader{
+		load:    load,
+		updates: make(chan *Config, 1),
+		current: config,
+	}
+}
+
+// Current returns the configuration currently in effect
+func (r *configReloader) Current() *Config {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.current
+}
+
+// Reload loads and validates the configuration again. If the new configuration
+// is invalid the old one stays in effect and the error is returned. Changed
+// settings that need a restart keep their old value and are returned as ignored.
+func (r *configReloader) Reload() (*Config, []string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	config, err := r.load()
+	if err != nil {
+		return nil, nil, err
+	}
+	config.ServerMode = true
+
+	// Connection settings are bound to the running client and listener
+	old := r.current
+	restart := restartRequired(old, config)
+	if len(restart) > 0 {
+		log.Printf("Configuration reload: changes to %s require a restart and are ignored", strings.Join(restart, ", "))
+		config.APIEndpoint = old.APIEndpoint
+		config.AppUsageEndpoint = old.AppUsageEndpoint
+		config.Username = old.Username
+		config.Password = old.Password
+		config.ClientID = old.ClientID
+		config.ClientSecret = old.ClientSecret
+		config.UsernameFile = old.UsernameFile
+		config.PasswordFile = old.PasswordFile
+		config.ClientSecretFile = old.ClientSecretFile
+		config.CredentialsService = old.CredentialsService
+		config.AllowGuessedAuthEndpoints = old.AllowGuessedAuthEndpoints
+		config.SkipSSLValidation = old.SkipSSLValidation
+		config.CACert = old.CACert
+		config.ClientCert = old.ClientCert
+		config.ClientKey = old.ClientKey
+		config.MinTLSVersion = old.MinTLSVersion
+		config.Port = old.Port
+		config.RecordDir = old.RecordDir
+		config.ReplayDir = old.ReplayDir
+	}
+	r.current = config
+
+	// Replace any update the refresh loop has not picked up yet
+	select {
+	case <-r.updates:
+	default:
+	}
+	r.updates <- config
+
+	return config, restart, nil
+}
+
+// restartRequired lists the settings that differ but cannot be applied live
+func restartRequired(old, config *Config) []string {
+	var changed []string
+	if old.APIEndpoint != config.APIEndpoint {
+		changed = append(changed, "api endpoint")
+	}
+	if old.AppUsageEndpoint != config.AppUsageEndpoint {
+		changed = append(changed, "app-usage endpoint")
+	}
+	if old.Username != config.Username || old.Password != config.Password ||
+		old.ClientID != config.ClientID || old.ClientSecret != config.ClientSecret ||
+		old.UsernameFile != config.UsernameFile || old.PasswordFile != config.PasswordFile ||
+		old.ClientSecretFile != config.ClientSecretFile || old.CredentialsService != config.CredentialsService ||
+		old.AllowGuessedAuthEndpoints != config.AllowGuessedAuthEndpoints {
+		changed = append(changed, "credentials")
+	}
+	if old.SkipSSLValidation != config.SkipSSLValidation || old.CACert != config.CACert ||
+		old.ClientCert != config.ClientCert || old.ClientKey != config.ClientKey ||
+		old.MinTLSVersion != config.MinTLSVersion {
+		changed = append(changed, "TLS settings")
+	}
+	if old.Port != config.Port {
+		changed = append(changed, "port")
+	}
+	if old.RecordDir != config.RecordDir || old.ReplayDir != config.ReplayDir {
+		changed = append(changed, "record/replay directory")
+	}
+	return changed
+}
+
+// logReload describes what a successful reload changed
+func logReload(old, config *Config) {
+	if !slices.Equal(old.SkipOrgs, config.SkipOrgs) {
+		log.Printf("Configuration reload: skip orgs %v -> %v", old.SkipOrgs, config.SkipOrgs)
+	}
+	if !slices.Equal(old.BillableOfferings, config.BillableOfferings) {
+		log.Printf("Configuration reload: billable offerings %v -> %v", old.BillableOfferings, config.BillableOfferings)
+	}
+	if old.RefreshInterval != config.RefreshInterval {
+		log.Printf("Configuration reload: refresh interval %v -> %v", old.RefreshInterval, config.RefreshInterval)
+	}
+	if old.CollectionTimeout != config.CollectionTimeout {
+		log.Printf("Configuration reload: collection timeout %v -> %v", old.CollectionTimeout, config.CollectionTimeout)
+	}
+}
+
+// reloadHandler handles the /admin/reload endpoint. It is only enabled when an
+// admin token is configured and requires it as a Bearer token.
+func reloadHandler(reloader *configReloader) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		token := reloader.Current().AdminToken
+		if token == "" {
+			http.Error(w, "Admin endpoint disabled (no admin token configured)", http.StatusNotFound)
+			return
+		}
+		given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		log.Printf("Configuration reload requested from %s", r.RemoteAddr)
+		_, ignored, err := reloader.Reload()
+		if err != nil {
+			log.Printf("Configuration reload failed, keeping previous configuration: %v", err)
+			http.Error(w, fmt.Sprintf("Reload failed, previous configuration kept: %v", err), http.StatusUnprocessableEntity)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		if len(ignored) > 0 {
+			fmt.Fprintf(w, "Configuration reloaded\nWarning: changes to %s require a restart and were ignored\n", strings.Join(ignored, ", "))
+			return
+		}
+		w.Write([]byte("Configuration reloaded\n"))
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestReloadRestartOnlySettings(t *testing.T) {
+	tests := []struct {
+		name    string
+		edit    func(*Config)
+		warning string
+	}{
+		{"live settings", func(c *Config) { c.SkipOrgs = []string{"system", "sandbox"} }, ""},
+		{"api endpoint", func(c *Config) { c.APIEndpoint = "https://api.other.example.com" }, "api endpoint"},
+		{"credentials", func(c *Config) { c.Password = "rotated" }, "credentials"},
+		{"tls", func(c *Config) { c.SkipSSLValidation = true }, "TLS settings"},
+		{"record dir", func(c *Config) { c.RecordDir = "/tmp/bundle" }, "record/replay directory"},
+		{"replay dir", func(c *Config) { c.ReplayDir = "/tmp/bundle" }, "record/replay directory"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			current := defaultConfig()
+			current.APIEndpoint = "https://api.example.com"
+			current.Username = "admin"
+			current.Password = "secret"
+			current.AdminToken = "token"
+			reloader := newConfigReloader(current, func() (*Config, error) {
+				next := *current
+				tt.edit(&next)
+				return &next, nil
+			})
+
+			req := httptest.NewRequest(http.MethodPost, "/admin/reload", nil)
+			req.Header.Set("Authorization", "Bearer token")
+			rec := httptest.NewRecorder()
+			reloadHandler(reloader)(rec, req)
+			body, _ := io.ReadAll(rec.Body)
+
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status %d: %s", rec.Code, body)
+			}
+			hasWarning := strings.Contains(string(body), "Warning:")
+			if tt.warning == "" && hasWarning || tt.warning != "" && !strings.Contains(string(body), tt.warning) {
+				t.Errorf("response %q, want warning %q", body, tt.warning)
+			}
+
+			// Restart-only settings keep their running value, the rest applies
+			reloaded := reloader.Current()
+			if reloaded.APIEndpoint != current.APIEndpoint || reloaded.Password != current.Password ||
+				reloaded.SkipSSLValidation != current.SkipSSLValidation ||
+				reloaded.RecordDir != current.RecordDir || reloaded.ReplayDir != current.ReplayDir {
+				t.Errorf("restart-only settings changed on reload: %+v", reloaded)
+			}
+			if tt.name == "live settings" && !slices.Equal(reloaded.SkipOrgs, []string{"system", "sandbox"}) {
+				t.Errorf("skip orgs %v, want the reloaded ones", reloaded.SkipOrgs)
+			}
+		})
+	}
+}
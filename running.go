@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"fmt"
+)
+
+// foundationListings are the foundation-wide listings of one collection,
+// fetched once and shared by the breakdowns built from them
+type foundationListings struct {
+	orgs        []Organization
+	instances   *serviceInstanceListing
+	bindings    []ServiceCredentialBinding
+	bindingsErr error // why bindings are missing
+	spaces      []Space
+	apps        []App // in any state
+	processes   []Process
+}
+
+// listFoundation fetches every listing, for the commands that do not take a
+// usage snapshot. The plans, offerings and brokers returned with the service
+// instances are added to the catalog of source.
+func listFoundation(ctx context.Context, source UsageSource) (*foundationListings, error) {
+	orgs, err := source.getOrganizations(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get organizations: %w", err)
+	}
+	listing, err := source.listServiceInstances(ctx, "")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get service instances: %w", err)
+	}
+	catalog := source.catalog()
+	catalog.add(listing.Plans, listing.Offerings)
+	catalog.addBrokers(listing.Brokers)
+
+	listings := &foundationListings{orgs: orgs, instances: listing}
+	if listings.bindings, err = source.getServiceCredentialBindings(ctx); err != nil {
+		return nil, err
+	}
+	if err := listings.loadWorkloads(ctx, source); err != nil {
+		return nil, err
+	}
+	return listings, nil
+}
+
+// loadWorkloads fetches the spaces, apps and processes
+func (l *foundationListings) loadWorkloads(ctx context.Context, source UsageSource) error {
+	var err error
+	if l.spaces, err = source.getSpaces(ctx); err != nil {
+		return fmt.Errorf("failed to get spaces: %w", err)
+	}
+	if l.apps, err = source.getApps(ctx, ""); err != nil {
+		return fmt.Errorf("failed to get apps: %w", err)
+	}
+	if l.processes, err = source.getProcesses(ctx); err != nil {
+		return fmt.Errorf("failed to get processes: %w", err)
+	}
+	return nil
+}
+
+// spacesByGUID indexes the spaces by GUID
+func (l *foundationListings) spacesByGUID() map[string]Space {
+	spaces := make(map[string]Space, len(l.spaces))
+	for _, space := range l.spaces {
+		spaces[space.GUID] = space
+	}
+	return spaces
+}
+
+// runningProcess is a process of a started app that has instances, with the
+// space and org the app belongs to
+type runningProcess struct {
+	App       App
+	Process   Process
+	SpaceGUID string
+	SpaceName string
+	OrgGUID   string
+}
+
+// runningProcesses returns the processes of all started apps with at least
+// one instance. What usage_summary cannot provide (AIs by isolation segment
+// and by stack, disk and per-space allocation) is built from it.
+func (l *foundationListings) runningProcesses() []runningProcess {
+	spacesByGUID := l.spacesByGUID()
+	started := make(map[string]App)
+	for _, app := range l.apps {
+		if app.State == "STARTED" {
+			started[app.GUID] = app
+		}
+	}
+
+	var running []runningProcess
+	for _, process := range l.processes {
+		app, ok := started[guidFromHref(process.Links.App.Href)]
+		if !ok || process.Instances == 0 {
+			continue
+		}
+		space := spacesByGUID[app.Relationships.Space.Data.GUID]
+		running = append(running, runningProcess{
+			App:       app,
+			Process:   process,
+			SpaceGUID: app.Relationships.Space.Data.GUID,
+			SpaceName: space.Name,
+			OrgGUID:   space.Relationships.Organization.Data.GUID,
+		})
+	}
+	return running
+}
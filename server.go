@@ -15,14 +15,14 @@ import (
 func metricsHandler(cachedData *CachedData) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		log.Printf("Metrics request from %s", r.RemoteAddr)
-		
+
 		result := cachedData.Get()
 		if result == nil {
 			log.Printf("No cached data available")
 			http.Error(w, "No data available", http.StatusServiceUnavailable)
 			return
 		}
-		
+
 		metrics := formatPrometheusMetrics(result)
 		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 		w.WriteHeader(http.StatusOK)
@@ -30,85 +30,204 @@ func metricsHandler(cachedData *CachedData) http.HandlerFunc {
 	}
 }
 
-// refreshDataPeriodically runs in a goroutine to refresh data periodically
-func refreshDataPeriodically(client *CFClient, config *Config, cachedData *CachedData, stopChan <-chan struct{}) {
+// orphansHandler handles the /orphans endpoint, listing the orphaned service
+// instances of the cached data. ?min_age_days=N drops younger instances.
+func orphansHandler(cachedData *CachedData) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		result := cachedData.Get()
+		if result == nil {
+			http.Error(w, "No data available", http.StatusServiceUnavailable)
+			return
+		}
+		// The list is missing when the credential bindings could not be listed
+		if result.OrphanedServiceInstances == nil {
+			http.Error(w, "Orphaned service instances not available (service credential bindings could not be listed)", http.StatusServiceUnavailable)
+			return
+		}
+
+		minAgeDays := 0
+		if v := r.URL.Query().Get("min_age_days"); v != "" {
+			days, err := strconv.Atoi(v)
+			if err != nil {
+				http.Error(w, "Invalid min_age_days", http.StatusBadRequest)
+				return
+			}
+			minAgeDays = days
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		writeJSON(w, filterOrphans(result.OrphanedServiceInstances, minAgeDays))
+	}
+}
+
+// quotasHandler handles the /quotas endpoint, listing the quota use of the
+// cached data. ?threshold=P keeps only quotas with a resource at P percent or more.
+func quotasHandler(cachedData *CachedData) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		result := cachedData.Get()
+		if result == nil {
+			http.Error(w, "No data available", http.StatusServiceUnavailable)
+			return
+		}
+
+		threshold := 0.0
+		if v := r.URL.Query().Get("threshold"); v != "" {
+			t, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				http.Error(w, "Invalid threshold", http.StatusBadRequest)
+				return
+			}
+			threshold = t
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		writeJSON(w, filterQuotas(result.Quotas, threshold))
+	}
+}
+
+// idleAppsHandler handles the /idle-apps endpoint, listing the idle apps of
+// the cached data. ?min_age_days=N drops apps updated more recently.
+func idleAppsHandler(cachedData *CachedData) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		result := cachedData.Get()
+		if result == nil {
+			http.Error(w, "No data available", http.StatusServiceUnavailable)
+			return
+		}
+
+		minAgeDays := 0
+		if v := r.URL.Query().Get("min_age_days"); v != "" {
+			days, err := strconv.Atoi(v)
+			if err != nil {
+				http.Error(w, "Invalid min_age_days", http.StatusBadRequest)
+				return
+			}
+			minAgeDays = days
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		writeJSON(w, filterIdleApps(result.IdleApps, minAgeDays))
+	}
+}
+
+// refreshData collects usage data once and stores it in the cache
+func refreshData(ctx context.Context, client *CFClient, config *Config, cachedData *CachedData) {
+	if result, err := collectUsageData(ctx, client, config); err != nil {
+		log.Printf("Data refresh failed: %v", err)
+	} else {
+		cachedData.Set(result)
+		if config.Verbose {
+			log.Printf("Data refreshed successfully - Total AIs: %d (Billable: %d), Total SIs: %d (Billable: %d)",
+				result.TotalAIs, result.TotalBillableAIs, result.TotalSIs, result.TotalBillableSIs)
+		} else {
+			log.Printf("Data refreshed successfully")
+		}
+	}
+}
+
+// refreshDataPeriodically runs in a goroutine to refresh data periodically.
+// Reloaded configurations received on updates take effect immediately.
+// It returns when ctx is cancelled, aborting any collection in flight.
+func refreshDataPeriodically(ctx context.Context, client *CFClient, config *Config, cachedData *CachedData, updates <-chan *Config) {
 	ticker := time.NewTicker(config.RefreshInterval)
 	defer ticker.Stop()
-	
+
 	// Initial data fetch
 	log.Printf("Performing initial data fetch...")
-	if result, err := collectUsageData(client, config); err != nil {
+	if result, err := collectUsageData(ctx, client, config); err != nil {
 		log.Printf("Initial data fetch failed: %v", err)
 	} else {
 		cachedData.Set(result)
 		log.Printf("Initial data fetch completed successfully")
 	}
-	
+
 	for {
 		select {
 		case <-ticker.C:
 			log.Printf("Refreshing data...")
-			if result, err := collectUsageData(client, config); err != nil {
-				log.Printf("Data refresh failed: %v", err)
-			} else {
-				cachedData.Set(result)
-				if config.Verbose {
-					log.Printf("Data refreshed successfully - Total AIs: %d (Billable: %d), Total SIs: %d (Billable: %d)", 
-						result.TotalAIs, result.TotalBillableAIs, result.TotalSIs, result.TotalBillableSIs)
-				} else {
-					log.Printf("Data refreshed successfully")
-				}
-			}
-		case <-stopChan:
+			refreshData(ctx, client, config, cachedData)
+		case newConfig := <-updates:
+			logReload(config, newConfig)
+			config = newConfig
+			client.setBillableOfferings(config.BillableOfferings)
+			ticker.Reset(config.RefreshInterval)
+
+			// Cached data stays in place until the refresh with the new rules completes
+			log.Printf("Configuration reloaded, refreshing data...")
+			refreshData(ctx, client, config, cachedData)
+		case <-ctx.Done():
 			log.Printf("Stopping data refresh...")
 			return
 		}
 	}
 }
 
-// runServer starts the HTTP server with metrics and health endpoints
-func runServer(client *CFClient, config *Config) {
+// runServer starts the HTTP server with metrics and health endpoints.
+// load re-reads the configuration on SIGHUP or POST /admin/reload.
+// The server shuts down when ctx is cancelled (SIGINT or SIGTERM).
+func runServer(ctx context.Context, client *CFClient, config *Config, load func() (*Config, error)) {
 	cachedData := &CachedData{}
-	stopChan := make(chan struct{})
-	
+	reloader := newConfigReloader(config, load)
+
 	// Start background data refresh
-	go refreshDataPeriodically(client, config, cachedData, stopChan)
-	
+	go refreshDataPeriodically(ctx, client, config, cachedData, reloader.updates)
+
 	mux := http.NewServeMux()
 	mux.HandleFunc("/metrics", metricsHandler(cachedData))
+	mux.HandleFunc("/orphans", orphansHandler(cachedData))
+	mux.HandleFunc("/quotas", quotasHandler(cachedData))
+	mux.HandleFunc("/idle-apps", idleAppsHandler(cachedData))
 	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte("OK"))
 	})
-	
+	mux.HandleFunc("/admin/reload", reloadHandler(reloader))
+
 	server := &http.Server{
 		Addr:    ":" + strconv.Itoa(config.Port),
 		Handler: mux,
 	}
-	
+
+	// Configuration reload handling
+	go func() {
+		hupChan := make(chan os.Signal, 1)
+		signal.Notify(hupChan, syscall.SIGHUP)
+		for range hupChan {
+			log.Println("Received SIGHUP, reloading configuration...")
+			if _, _, err := reloader.Reload(); err != nil {
+				log.Printf("Configuration reload failed, keeping previous configuration: %v", err)
+			}
+		}
+	}()
+
 	// Graceful shutdown handling
 	go func() {
-		sigChan := make(chan os.Signal, 1)
-		signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
-		<-sigChan
-		
+		<-ctx.Done()
+
 		log.Println("Shutting down server...")
-		close(stopChan) // Stop data refresh
-		
-		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 		defer cancel()
-		
-		if err := server.Shutdown(ctx); err != nil {
+
+		if err := server.Shutdown(shutdownCtx); err != nil {
 			log.Printf("Server shutdown error: %v", err)
 		}
 	}()
-	
+
 	log.Printf("Starting server on port %d", config.Port)
 	log.Printf("Data refresh interval: %v", config.RefreshInterval)
 	log.Printf("Metrics endpoint: http://localhost:%d/metrics", config.Port)
 	log.Printf("Health endpoint: http://localhost:%d/health", config.Port)
-	
+	log.Printf("Orphaned service instances: http://localhost:%d/orphans", config.Port)
+	log.Printf("Quota utilization: http://localhost:%d/quotas", config.Port)
+	if config.IdleApps {
+		log.Printf("Idle apps: http://localhost:%d/idle-apps", config.Port)
+	}
+	if config.AdminToken != "" {
+		log.Printf("Reload endpoint: POST http://localhost:%d/admin/reload", config.Port)
+	}
+
 	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 		log.Fatalf("Server failed to start: %v", err)
 	}
-}
\ No newline at end of file
+}
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+const serviceUsageStateFile = "service_usage_events.json"
+
+// serviceUsageTracker follows the lifetime of managed service instances from
+// /v3/service_usage_events and accrues SI-days and peak billable instance
+// counts per org and billing period (calendar month, UTC).
+type serviceUsageTracker struct {
+	TrackingSince time.Time                          `json:"tracking_since"`
+	LastEventGUID string                             `json:"last_event_guid"`
+	Instances     map[string]*trackedServiceInstance `json:"instances"` // live managed instances by GUID
+	Periods       map[string]*servicePeriodTotals    `json:"periods"`   // by YYYY-MM
+
+	// Live instance counts, derived from Instances
+	totalCurrent       int
+	billableCurrent    int
+	orgBillableCurrent map[string]int
+	isBillable         func(*trackedServiceInstance) bool
+}
+
+type trackedServiceInstance struct {
+	OrgGUID  string    `json:"org_guid"`
+	Broker   string    `json:"broker,omitempty"`
+	Offering string    `json:"offering"`
+	Plan     string    `json:"plan"`
+	Since    time.Time `json:"since"` // SI-days are accrued up to this time
+}
+
+type servicePeriodTotals struct {
+	SIDays            float64            `json:"si_days"`
+	BillableSIDays    float64            `json:"billable_si_days"`
+	PeakSIs           int                `json:"peak_sis"`
+	BillablePeakSIs   int                `json:"billable_peak_sis"`
+	OrgSIDays         map[string]float64 `json:"org_si_days"`
+	OrgBillableSIDays map[string]float64 `json:"org_billable_si_days"`
+	OrgBillablePeaks  map[string]int     `json:"org_billable_peaks"`
+}
+
+func newServiceUsageTracker(since time.Time) *serviceUsageTracker {
+	t := &serviceUsageTracker{
+		TrackingSince: since,
+		Instances:     make(map[string]*trackedServiceInstance),
+		Periods:       make(map[string]*servicePeriodTotals),
+	}
+	t.recount(func(*trackedServiceInstance) bool { return false })
+	return t
+}
+
+// loadServiceUsageTracker reads the tracker state from dir. It returns nil if
+// no state has been saved yet.
+func loadServiceUsageTracker(dir string) (*serviceUsageTracker, error) {
+	data, err := os.ReadFile(filepath.Join(dir, serviceUsageStateFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read service usage event state: %w", err)
+	}
+
+	t := newServiceUsageTracker(time.Time{})
+	if err := json.Unmarshal(data, t); err != nil {
+		return nil, fmt.Errorf("failed to parse service usage event state: %w", err)
+	}
+	return t, nil
+}
+
+// save writes the tracker state to dir atomically
+func (t *serviceUsageTracker) save(dir string) error {
+	return writeStateFile(dir, serviceUsageStateFile, t)
+}
+
+// recount rebuilds the live instance counts with the current billable rules
+func (t *serviceUsageTracker) recount(isBillable func(*trackedServiceInstance) bool) {
+	t.isBillable = isBillable
+	t.totalCurrent = len(t.Instances)
+	t.billableCurrent = 0
+	t.orgBillableCurrent = make(map[string]int)
+	for _, si := range t.Instances {
+		if isBillable(si) {
+			t.billableCurrent++
+			t.orgBillableCurrent[si.OrgGUID]++
+		}
+	}
+}
+
+// add starts tracking a managed service instance at time at
+func (t *serviceUsageTracker) add(guid string, si *trackedServiceInstance, at time.Time) {
+	if existing, ok := t.Instances[guid]; ok {
+		// Already known, e.g. created between baseline and the newest event
+		t.update(existing, si.Offering, si.Plan, at)
+		return
+	}
+	si.Since = at
+	t.Instances[guid] = si
+	t.adjust(si, 1, at)
+}
+
+// remove stops tracking a service instance deleted at time at
+func (t *serviceUsageTracker) remove(guid string, at time.Time) {
+	si, ok := t.Instances[guid]
+	if !ok {
+		return
+	}
+	t.accrue(si, at)
+	delete(t.Instances, guid)
+	t.adjust(si, -1, at)
+}
+
+// update records a plan change; billability may change with the offering
+func (t *serviceUsageTracker) update(si *trackedServiceInstance, offering, plan string, at time.Time) {
+	t.accrue(si, at)
+	t.adjust(si, -1, at)
+	if offering != "" {
+		si.Offering = offering
+	}
+	if plan != "" {
+		si.Plan = plan
+	}
+	t.adjust(si, 1, at)
+}
+
+// adjust applies a change of delta instances and raises the period peaks
+func (t *serviceUsageTracker) adjust(si *trackedServiceInstance, delta int, at time.Time) {
+	t.totalCurrent += delta
+	billable := t.isBillable(si)
+	if billable {
+		t.billableCurrent += delta
+		t.orgBillableCurrent[si.OrgGUID] += delta
+	}
+	if delta <= 0 {
+		return
+	}
+
+	totals := t.period(periodKey(at))
+	totals.PeakSIs = max(totals.PeakSIs, t.totalCurrent)
+	if billable {
+		totals.BillablePeakSIs = max(totals.BillablePeakSIs, t.billableCurrent)
+		totals.OrgBillablePeaks[si.OrgGUID] = max(totals.OrgBillablePeaks[si.OrgGUID], t.orgBillableCurrent[si.OrgGUID])
+	}
+}
+
+// accrue adds the SI-days of si up to until, split across billing periods
+func (t *serviceUsageTracker) accrue(si *trackedServiceInstance, until time.Time) {
+	from := si.Since
+	if !until.After(from) {
+		return
+	}
+	billable := t.isBillable(si)
+	for from.Before(until) {
+		end := periodStart(from).AddDate(0, 1, 0)
+		if end.After(until) {
+			end = until
+		}
+		days := end.Sub(from).Hours() / 24
+		totals := t.period(periodKey(from))
+		totals.SIDays += days
+		totals.OrgSIDays[si.OrgGUID] += days
+		if billable {
+			totals.BillableSIDays += days
+			totals.OrgBillableSIDays[si.OrgGUID] += days
+		}
+		from = end
+	}
+	si.Since = until
+}
+
+// period returns the totals for key, creating them with peaks seeded from the
+// instances already live when the period starts
+func (t *serviceUsageTracker) period(key string) *servicePeriodTotals {
+	totals, ok := t.Periods[key]
+	if ok {
+		return totals
+	}
+	totals = &servicePeriodTotals{
+		PeakSIs:           t.totalCurrent,
+		BillablePeakSIs:   t.billableCurrent,
+		OrgSIDays:         make(map[string]float64),
+		OrgBillableSIDays: make(map[string]float64),
+		OrgBillablePeaks:  make(map[string]int),
+	}
+	for guid, n := range t.orgBillableCurrent {
+		if n > 0 {
+			totals.OrgBillablePeaks[guid] = n
+		}
+	}
+	t.Periods[key] = totals
+	return totals
+}
+
+// apply updates the instance lifetimes with a single event
+func (t *serviceUsageTracker) apply(event ServiceUsageEvent) {
+	t.LastEventGUID = event.GUID
+	if event.ServiceInstance.Type != "" && event.ServiceInstance.Type != "managed_service_instance" {
+		return
+	}
+
+	at := event.CreatedAt.UTC()
+	guid := event.ServiceInstance.GUID
+	switch event.State {
+	case "CREATED":
+		t.add(guid, &trackedServiceInstance{
+			OrgGUID:  event.Organization.GUID,
+			Broker:   event.ServiceBroker.Name,
+			Offering: event.ServiceOffering.Name,
+			Plan:     event.ServicePlan.Name,
+		}, at)
+	case "UPDATED":
+		if si, ok := t.Instances[guid]; ok {
+			t.update(si, event.ServiceOffering.Name, event.ServicePlan.Name, at)
+		}
+	case "DELETED":
+		t.remove(guid, at)
+	}
+}
+
+// advance accrues all live instances up to now and drops old periods
+func (t *serviceUsageTracker) advance(now time.Time) {
+	for _, si := range t.Instances {
+		t.accrue(si, now)
+	}
+	t.period(periodKey(now))
+
+	oldest := periodKey(periodStart(now).AddDate(0, 1-retainedPeriods, 0))
+	for key := range t.Periods {
+		if key < oldest {
+			delete(t.Periods, key)
+		}
+	}
+}
+
+// report summarizes the tracked periods. orgNames maps org GUIDs to names.
+func (t *serviceUsageTracker) report(orgNames map[string]string) *ServiceEventUsage {
+	usage := &ServiceEventUsage{
+		TrackingSince: t.TrackingSince,
+		LastEventGUID: t.LastEventGUID,
+		Periods:       []ServicePeriodUsage{},
+	}
+
+	for key, totals := range t.Periods {
+		period := ServicePeriodUsage{
+			Period:          key,
+			SIDays:          roundHours(totals.SIDays),
+			BillableSIDays:  roundHours(totals.BillableSIDays),
+			PeakSIs:         totals.PeakSIs,
+			BillablePeakSIs: totals.BillablePeakSIs,
+			Organizations:   []OrgServiceUsage{},
+		}
+		for _, guid := range unionKeys(totals.OrgSIDays, totals.OrgBillablePeaks) {
+			name, ok := orgNames[guid]
+			if !ok {
+				name = guid
+			}
+			period.Organizations = append(period.Organizations, OrgServiceUsage{
+				Name:            name,
+				SIDays:          roundHours(totals.OrgSIDays[guid]),
+				BillableSIDays:  roundHours(totals.OrgBillableSIDays[guid]),
+				BillablePeakSIs: totals.OrgBillablePeaks[guid],
+			})
+		}
+		sort.Slice(period.Organizations, func(i, j int) bool {
+			return period.Organizations[i].Name < period.Organizations[j].Name
+		})
+		usage.Periods = append(usage.Periods, period)
+	}
+
+	sort.Slice(usage.Periods, func(i, j int) bool {
+		return usage.Periods[i].Period < usage.Periods[j].Period
+	})
+	return usage
+}
+
+// collectServiceUsageEvents ingests new service usage events and returns the
+// SI accounting per billing period. The first run baselines from the managed
+// instances that exist now; later runs resume after the last processed event.
+// When that event is gone the tracker baselines again, keeping the accrued
+// periods.
+func collectServiceUsageEvents(ctx context.Context, source UsageSource, orgs []Organization, config *Config) (*ServiceEventUsage, error) {
+	now := source.currentTime().UTC()
+	catalog := source.catalog()
+
+	orgNames := make(map[string]string)
+	skipOrgs := make(map[string]bool)
+	for _, org := range orgs {
+		orgNames[org.GUID] = org.Name
+		if shouldSkipOrg(org.Name, config.SkipOrgs) {
+			skipOrgs[org.GUID] = true
+		}
+	}
+	isBillable := func(si *trackedServiceInstance) bool {
+		return !skipOrgs[si.OrgGUID] && catalog.isOfferingBillable(si.Broker, si.Offering)
+	}
+
+	t := source.trackers().service
+	if t == nil && config.StateDir != "" {
+		loaded, err := loadServiceUsageTracker(config.StateDir)
+		if err != nil {
+			return nil, err
+		}
+		t = loaded
+	}
+
+	rebaseline := t == nil
+	if t != nil {
+		t.recount(isBillable)
+		events, err := source.getServiceUsageEvents(ctx, t.LastEventGUID)
+		switch {
+		case isEventGap(err):
+			log.Printf("Service usage events after %s are no longer available, re-baselining; usage since the last collection is not accounted: %v", t.LastEventGUID, err)
+			t.Instances = make(map[string]*trackedServiceInstance)
+			rebaseline = true
+		case err != nil:
+			return nil, err
+		default:
+			for _, event := range events {
+				t.apply(event)
+			}
+			if config.Verbose {
+				log.Printf("Service usage events: processed %d new events", len(events))
+			}
+		}
+	}
+
+	if rebaseline {
+		// Take the newest event first so nothing between it and the instance listing is missed
+		latest, err := source.getLatestEventGUID(ctx, "/v3/service_usage_events")
+		if err != nil {
+			return nil, err
+		}
+		listing, err := source.listServiceInstances(ctx, "type=managed")
+		if err != nil {
+			return nil, err
+		}
+		catalog.add(listing.Plans, listing.Offerings)
+		catalog.addBrokers(listing.Brokers)
+
+		if t == nil {
+			t = newServiceUsageTracker(now)
+		}
+		t.recount(isBillable)
+		for _, instance := range listing.Instances {
+			planGUID := instance.Relationships.ServicePlan.Data.GUID
+			offering := catalog.serviceOffering(planGUID)
+			t.add(instance.GUID, &trackedServiceInstance{
+				OrgGUID:  listing.orgOf(instance),
+				Broker:   catalog.serviceBroker(offering).Name,
+				Offering: offering.Name,
+				Plan:     catalog.servicePlans[planGUID].Name,
+			}, now)
+		}
+		t.LastEventGUID = latest
+		log.Printf("Service usage events: baselined %d managed service instances", len(t.Instances))
+	}
+
+	t.advance(now)
+	source.trackers().service = t
+
+	if config.StateDir != "" {
+		if err := t.save(config.StateDir); err != nil {
+			log.Printf("Failed to save service usage event state: %v", err)
+		}
+	}
+
+	return t.report(orgNames), nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// serviceEvent builds a service usage event for instance guid of org "org-a"
+func serviceEvent(guid, state, offering string, at time.Time) ServiceUsageEvent {
+	var event ServiceUsageEvent
+	event.GUID = guid + "-" + state
+	event.CreatedAt = at
+	event.State = state
+	event.ServiceInstance.GUID = guid
+	event.ServiceInstance.Type = "managed_service_instance"
+	event.ServiceOffering.Name = offering
+	event.ServicePlan.Name = "small"
+	event.Organization.GUID = "org-a"
+	return event
+}
+
+// newMySQLTracker returns a tracker that bills p.mysql instances only
+func newMySQLTracker(since time.Time) *serviceUsageTracker {
+	tr := newServiceUsageTracker(since)
+	tr.recount(func(si *trackedServiceInstance) bool { return si.Offering == "p.mysql" })
+	return tr
+}
+
+func TestServiceUsageTrackerApply(t *testing.T) {
+	day := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	tr := newMySQLTracker(day)
+
+	tr.apply(serviceEvent("db", "CREATED", "p.mysql", day))
+	tr.apply(serviceEvent("config", "CREATED", "p.config-server", day))
+	tr.apply(serviceEvent("db", "DELETED", "p.mysql", day.Add(48*time.Hour)))
+	ups := serviceEvent("ups", "CREATED", "", day)
+	ups.ServiceInstance.Type = "user_provided_service_instance"
+	tr.apply(ups)
+	tr.advance(day.Add(96 * time.Hour))
+
+	if len(tr.Instances) != 1 {
+		t.Errorf("%d instances tracked, want 1 (config)", len(tr.Instances))
+	}
+	totals := tr.Periods["2025-01"]
+	if totals.SIDays != 6 || totals.BillableSIDays != 2 {
+		t.Errorf("SI-days %.2f (billable %.2f), want 6 (billable 2)", totals.SIDays, totals.BillableSIDays)
+	}
+	if totals.PeakSIs != 2 || totals.BillablePeakSIs != 1 || totals.OrgBillablePeaks["org-a"] != 1 {
+		t.Errorf("peak %d, billable peak %d, org billable peak %d; want 2, 1, 1",
+			totals.PeakSIs, totals.BillablePeakSIs, totals.OrgBillablePeaks["org-a"])
+	}
+}
+
+func TestServiceUsageTrackerPeriodSplit(t *testing.T) {
+	start := time.Date(2025, 1, 31, 12, 0, 0, 0, time.UTC)
+	tr := newMySQLTracker(start)
+	tr.apply(serviceEvent("db", "CREATED", "p.mysql", start))
+	tr.advance(start.Add(24 * time.Hour))
+
+	for period, want := range map[string]float64{"2025-01": 0.5, "2025-02": 0.5} {
+		if got := tr.Periods[period].BillableSIDays; got != want {
+			t.Errorf("%s billable SI-days %.2f, want %.2f", period, got, want)
+		}
+	}
+
+	// The instance live when February starts seeds its peaks
+	february := tr.Periods["2025-02"]
+	if february.PeakSIs != 1 || february.BillablePeakSIs != 1 || february.OrgBillablePeaks["org-a"] != 1 {
+		t.Errorf("February peaks %d, billable %d, org %d; want 1", february.PeakSIs, february.BillablePeakSIs, february.OrgBillablePeaks["org-a"])
+	}
+}
+
+func TestServiceUsageTrackerDeleteUnknown(t *testing.T) {
+	day := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	tr := newMySQLTracker(day)
+
+	// Deleting an instance created before tracking started changes nothing
+	tr.apply(serviceEvent("old", "DELETED", "p.mysql", day))
+	tr.advance(day.Add(time.Hour))
+	if tr.totalCurrent != 0 || tr.Periods["2025-01"].PeakSIs != 0 {
+		t.Errorf("current %d, peak %d after deleting an untracked instance", tr.totalCurrent, tr.Periods["2025-01"].PeakSIs)
+	}
+	if tr.LastEventGUID != "old-DELETED" {
+		t.Errorf("last event %q, want old-DELETED", tr.LastEventGUID)
+	}
+}
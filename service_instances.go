@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"slices"
+)
+
+// serviceInstanceFields asks the CC to return the space, org, plan and
+// offering of every instance in the included section of each page, so a
+// single listing resolves everything the usage counts need
+var serviceInstanceFields = url.Values{
+	"fields[space]":                                        {"guid,name,relationships.organization"},
+	"fields[space.organization]":                           {"guid,name"},
+	"fields[service_plan]":                                 {"guid,name,relationships.service_offering"},
+	"fields[service_plan.service_offering]":                {"guid,name,relationships.service_broker"},
+	"fields[service_plan.service_offering.service_broker]": {"guid,name"},
+}.Encode()
+
+// serviceInstanceListing is a foundation-wide list of service instances with
+// the related resources the CC returned alongside them
+type serviceInstanceListing struct {
+	Instances  []ServiceInstance
+	Plans      []ServicePlan
+	Offerings  []ServiceOffering
+	Brokers    []ServiceBroker
+	spaceOrgs  map[string]string   // space GUID -> org GUID
+	spaceNames map[string]string   // space GUID -> name
+	sharedInto map[string][]string // instance GUID -> other orgs it is shared into
+}
+
+// orgOf returns the GUID of the org owning instance
+func (l *serviceInstanceListing) orgOf(instance ServiceInstance) string {
+	return l.spaceOrgs[instance.Relationships.Space.Data.GUID]
+}
+
+// byOrg groups the instances by org GUID
+func (l *serviceInstanceListing) byOrg() map[string][]ServiceInstance {
+	grouped := make(map[string][]ServiceInstance)
+	for _, instance := range l.Instances {
+		org := l.orgOf(instance)
+		grouped[org] = append(grouped[org], instance)
+	}
+	return grouped
+}
+
+// listServiceInstances fetches all service instances matching filter (a
+// query such as "type=managed", or "" for all) in as few pages as the API
+// allows, instead of one listing per org
+func (c *CFClient) listServiceInstances(ctx context.Context, filter string) (*serviceInstanceListing, error) {
+	endpoint := "/v3/service_instances?per_page=5000&" + serviceInstanceFields
+	if filter != "" {
+		endpoint += "&" + filter
+	}
+
+	listing := &serviceInstanceListing{
+		spaceOrgs:  make(map[string]string),
+		spaceNames: make(map[string]string),
+	}
+	for page, err := range listPages(ctx, c, endpoint) {
+		if err != nil {
+			return nil, fmt.Errorf("failed to load service instances: %w", err)
+		}
+		for _, raw := range page.Resources {
+			var instance ServiceInstance
+			if err := json.Unmarshal(raw, &instance); err != nil {
+				return nil, fmt.Errorf("failed to parse service_instances: %w", err)
+			}
+			listing.Instances = append(listing.Instances, instance)
+		}
+		if len(page.Included) == 0 {
+			continue
+		}
+
+		var included ServiceInstanceIncluded
+		if err := json.Unmarshal(page.Included, &included); err != nil {
+			return nil, fmt.Errorf("failed to parse included resources of service_instances: %w", err)
+		}
+		for _, space := range included.Spaces {
+			listing.spaceOrgs[space.GUID] = space.Relationships.Organization.Data.GUID
+			listing.spaceNames[space.GUID] = space.Name
+		}
+		listing.Plans = append(listing.Plans, included.ServicePlans...)
+		listing.Offerings = append(listing.Offerings, included.ServiceOfferings...)
+		listing.Brokers = append(listing.Brokers, included.ServiceBrokers...)
+	}
+	return listing, nil
+}
+
+// sharedSpaceFields asks for the org of every space an instance is shared into
+var sharedSpaceFields = url.Values{
+	"fields[space]": {"guid,name,relationships.organization"},
+}.Encode()
+
+// getSharedSpaces returns the spaces a service instance is shared into
+func (c *CFClient) getSharedSpaces(ctx context.Context, guid string) ([]Space, error) {
+	data, err := c.apiCall(ctx, "/v3/service_instances/"+url.PathEscape(guid)+"/relationships/shared_spaces?"+sharedSpaceFields)
+	if err != nil {
+		return nil, err
+	}
+	var shared SharedSpaces
+	if err := json.Unmarshal(data, &shared); err != nil {
+		return nil, fmt.Errorf("failed to parse shared spaces: %w", err)
+	}
+	return shared.Included.Spaces, nil
+}
+
+// resolveSharing finds the other orgs that managed instances are shared into.
+// Only offerings marked shareable can be shared, so only their instances cost
+// a request, one at a time. The CC has no bulk listing of shared spaces. A
+// failed lookup fails the whole resolution: treating the instance as not
+// shared would silently count it in the wrong orgs.
+func (l *serviceInstanceListing) resolveSharing(ctx context.Context, source UsageSource, catalog *serviceCatalog) error {
+	l.sharedInto = make(map[string][]string)
+	for _, instance := range l.Instances {
+		if instance.Type != "managed" || !catalog.isShareable(instance) {
+			continue
+		}
+		spaces, err := source.getSharedSpaces(ctx, instance.GUID)
+		if err != nil {
+			return fmt.Errorf("failed to get shared spaces of service instance %s: %w", instance.Name, err)
+		}
+
+		owner := l.orgOf(instance)
+		for _, space := range spaces {
+			org := space.Relationships.Organization.Data.GUID
+			if org != owner && !slices.Contains(l.sharedInto[instance.GUID], org) {
+				l.sharedInto[instance.GUID] = append(l.sharedInto[instance.GUID], org)
+			}
+		}
+	}
+	return nil
+}
+
+// serviceInstanceCounts are the service instances of one org by category
+type serviceInstanceCounts struct {
+	managed      int
+	userProvided int
+	shared       int // owned and shared into other orgs
+	sharedIn     int // owned by another org and shared into this one
+}
+
+// countByOrg classifies the instances of every org. Each instance counts
+// once, in the org of the space that owns it.
+func (l *serviceInstanceListing) countByOrg() map[string]*serviceInstanceCounts {
+	counts := make(map[string]*serviceInstanceCounts)
+	get := func(org string) *serviceInstanceCounts {
+		if counts[org] == nil {
+			counts[org] = &serviceInstanceCounts{}
+		}
+		return counts[org]
+	}
+
+	for _, instance := range l.Instances {
+		owner := get(l.orgOf(instance))
+		if instance.Type == "user-provided" {
+			owner.userProvided++
+			continue
+		}
+		owner.managed++
+		if orgs := l.sharedInto[instance.GUID]; len(orgs) > 0 {
+			owner.shared++
+			for _, org := range orgs {
+				get(org).sharedIn++
+			}
+		}
+	}
+	return counts
+}
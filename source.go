@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// UsageSource is the foundation data the usage collection reads. CFClient
+// implements it against the CF API; the fake Cloud Controller in
+// internal/fakecc serves the same data from fixture files.
+type UsageSource interface {
+	// Orgs, spaces, apps and their processes
+	getOrganizations(ctx context.Context) ([]Organization, error)
+	getSpaces(ctx context.Context) ([]Space, error)
+	getApps(ctx context.Context, states string) ([]App, error)
+	getProcesses(ctx context.Context) ([]Process, error)
+	getProcessStats(ctx context.Context, guid string) (*ProcessStats, error)
+	getSidecars(ctx context.Context, appGUID string) ([]Sidecar, error)
+	getRunningTasks(ctx context.Context) ([]Task, error)
+	getUsageSummary(ctx context.Context, orgGUID string) (*UsageSummary, error)
+
+	// Services
+	listServiceInstances(ctx context.Context, filter string) (*serviceInstanceListing, error)
+	getServicePlans(ctx context.Context) ([]ServicePlan, error)
+	getServiceOfferings(ctx context.Context) ([]ServiceOffering, error)
+	getServiceBrokers(ctx context.Context) ([]ServiceBroker, error)
+	getServicePlan(ctx context.Context, guid string) (*ServicePlan, error)
+	getServiceOffering(ctx context.Context, guid string) (*ServiceOffering, error)
+	getSharedSpaces(ctx context.Context, guid string) ([]Space, error)
+	getServiceCredentialBindings(ctx context.Context) ([]ServiceCredentialBinding, error)
+
+	// Isolation segments, quotas and routes
+	getIsolationSegments(ctx context.Context) ([]IsolationSegment, error)
+	getIsolationSegmentSpaces(ctx context.Context, guid string) ([]string, error)
+	getIsolationSegmentOrganizations(ctx context.Context, guid string) ([]string, error)
+	getDefaultIsolationSegment(ctx context.Context, orgGUID string) (string, error)
+	getOrganizationQuotas(ctx context.Context) ([]OrganizationQuota, error)
+	getSpaceQuotas(ctx context.Context) ([]SpaceQuota, error)
+	getRoutes(ctx context.Context) ([]Route, error)
+
+	// App-usage service and usage events
+	getAppUsageReport(ctx context.Context) (*AppUsageReport, error)
+	getServiceUsageReport(ctx context.Context) (*ServiceUsageReport, error)
+	getOrgAppUsages(ctx context.Context, orgGUID string, start, end time.Time) (*OrgAppUsages, error)
+	getOrgServiceUsages(ctx context.Context, orgGUID string, start, end time.Time) (*OrgServiceUsages, error)
+	getLatestEventGUID(ctx context.Context, endpoint string) (string, error)
+	getAppUsageEvents(ctx context.Context, afterGUID string) ([]AppUsageEvent, error)
+	getServiceUsageEvents(ctx context.Context, afterGUID string) ([]ServiceUsageEvent, error)
+
+	// State kept between collections
+	catalog() *serviceCatalog
+	trackers() *eventTrackers
+	currentTime() time.Time // the recording time when replaying
+}
+
+// eventTrackers hold the usage event state between collections
+type eventTrackers struct {
+	app     *appUsageTracker
+	service *serviceUsageTracker
+}
+
+func (c *CFClient) catalog() *serviceCatalog {
+	return &c.serviceCatalog
+}
+
+func (c *CFClient) trackers() *eventTrackers {
+	return &c.events
+}
+
+func (c *CFClient) currentTime() time.Time {
+	return c.now()
+}
+
+var _ UsageSource = (*CFClient)(nil)
@@ -0,0 +1,77 @@
+package main
+
+import "sort"
+
+// noStack labels the AIs of apps without a stack, such as docker apps
+const noStack = "none"
+
+// stackKey identifies a stack and lifecycle combination
+type stackKey struct {
+	stack     string
+	lifecycle string
+}
+
+// stackOf returns the stack and lifecycle type of app
+func stackOf(app App) stackKey {
+	key := stackKey{stack: app.Lifecycle.Data.Stack, lifecycle: app.Lifecycle.Type}
+	if key.stack == "" {
+		key.stack = noStack
+	}
+	return key
+}
+
+// collectStackUsage breaks the AIs of running processes down by stack and
+// lifecycle type, in total and per org GUID. Windows cells are sized and
+// licensed apart from Linux ones, which a single AI count hides.
+func collectStackUsage(running []runningProcess, orgs []Organization, config *Config) ([]StackUsage, map[string][]StackUsage) {
+	skipOrgs := make(map[string]bool)
+	for _, org := range orgs {
+		skipOrgs[org.GUID] = shouldSkipOrg(org.Name, config.SkipOrgs)
+	}
+
+	totals := make(map[stackKey]*StackUsage)
+	orgTotals := make(map[string]map[stackKey]*StackUsage)
+	for _, process := range running {
+		key := stackOf(process.App)
+		total := totals[key]
+		if total == nil {
+			total = &StackUsage{Stack: key.stack, Lifecycle: key.lifecycle}
+			totals[key] = total
+		}
+		total.AIs += process.Process.Instances
+		if skipOrgs[process.OrgGUID] {
+			continue
+		}
+		total.BillableAIs += process.Process.Instances
+
+		if orgTotals[process.OrgGUID] == nil {
+			orgTotals[process.OrgGUID] = make(map[stackKey]*StackUsage)
+		}
+		org := orgTotals[process.OrgGUID][key]
+		if org == nil {
+			org = &StackUsage{Stack: key.stack, Lifecycle: key.lifecycle}
+			orgTotals[process.OrgGUID][key] = org
+		}
+		org.AIs += process.Process.Instances
+	}
+
+	byOrg := make(map[string][]StackUsage)
+	for guid, usage := range orgTotals {
+		byOrg[guid] = sortedStackUsage(usage)
+	}
+	return sortedStackUsage(totals), byOrg
+}
+
+func sortedStackUsage(usage map[stackKey]*StackUsage) []StackUsage {
+	var sorted []StackUsage
+	for _, u := range usage {
+		sorted = append(sorted, *u)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Stack != sorted[j].Stack {
+			return sorted[i].Stack < sorted[j].Stack
+		}
+		return sorted[i].Lifecycle < sorted[j].Lifecycle
+	})
+	return sorted
+}
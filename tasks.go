@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"slices"
+	"time"
+)
+
+func (c *CFClient) getRunningTasks(ctx context.Context) ([]Task, error) {
+	return collectResources(listResources[Task](ctx, c, "/v3/tasks?states=RUNNING&per_page=5000"))
+}
+
+func (c *CFClient) getSidecars(ctx context.Context, appGUID string) ([]Sidecar, error) {
+	return collectResources(listResources[Sidecar](ctx, c, "/v3/apps/"+url.PathEscape(appGUID)+"/sidecars?per_page=5000"))
+}
+
+// taskTotals accumulates running tasks before rounding
+type taskTotals struct {
+	running int
+	memory  int // MB
+	seconds float64
+	longest float64
+}
+
+func (t *taskTotals) add(task Task, now time.Time) {
+	seconds := max(now.Sub(task.CreatedAt).Seconds(), 0)
+	t.running++
+	t.memory += task.MemoryInMB
+	t.seconds += seconds
+	t.longest = max(t.longest, seconds)
+}
+
+func (t *taskTotals) usage() *TaskUsage {
+	return &TaskUsage{
+		Running:      t.running,
+		MemoryGB:     mbToGB(t.memory),
+		Hours:        roundHours(t.seconds / 3600),
+		LongestHours: roundHours(t.longest / 3600),
+	}
+}
+
+// collectTaskUsage summarizes the tasks running at now, in total and per org
+// GUID. Run time is measured from task creation. Tasks can run for stopped
+// apps too, so the org is resolved from the listing of apps in any state.
+func collectTaskUsage(ctx context.Context, source UsageSource, listings *foundationListings, now time.Time) (*TaskUsage, map[string]*TaskUsage, error) {
+	tasks, err := source.getRunningTasks(ctx)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get running tasks: %w", err)
+	}
+
+	spacesByGUID := listings.spacesByGUID()
+	appOrgs := make(map[string]string)
+	for _, app := range listings.apps {
+		appOrgs[app.GUID] = spacesByGUID[app.Relationships.Space.Data.GUID].Relationships.Organization.Data.GUID
+	}
+
+	total := &taskTotals{}
+	byOrg := make(map[string]*TaskUsage)
+	orgTotals := make(map[string]*taskTotals)
+	for _, task := range tasks {
+		org := appOrgs[task.Relationships.App.Data.GUID]
+		if orgTotals[org] == nil {
+			orgTotals[org] = &taskTotals{}
+		}
+		total.add(task, now)
+		orgTotals[org].add(task, now)
+	}
+	for guid, totals := range orgTotals {
+		byOrg[guid] = totals.usage()
+	}
+	return total.usage(), byOrg, nil
+}
+
+// collectSidecarInstances counts the sidecar processes running alongside the
+// running processes, in total and per org GUID. A sidecar runs in every
+// instance of the process types it is attached to. The CC has no
+// foundation-wide sidecar listing, so this costs one request per started app.
+func collectSidecarInstances(ctx context.Context, source UsageSource, running []runningProcess) (int, map[string]int, error) {
+	byApp := make(map[string][]runningProcess)
+	var appGUIDs []string
+	for _, process := range running {
+		if byApp[process.App.GUID] == nil {
+			appGUIDs = append(appGUIDs, process.App.GUID)
+		}
+		byApp[process.App.GUID] = append(byApp[process.App.GUID], process)
+	}
+
+	total := 0
+	byOrg := make(map[string]int)
+	for _, guid := range appGUIDs {
+		sidecars, err := source.getSidecars(ctx, guid)
+		if err != nil {
+			return 0, nil, fmt.Errorf("failed to get sidecars of app %s: %w", byApp[guid][0].App.Name, err)
+		}
+		for _, sidecar := range sidecars {
+			for _, process := range byApp[guid] {
+				if slices.Contains(sidecar.ProcessTypes, process.Process.Type) {
+					total += process.Process.Instances
+					byOrg[process.OrgGUID] += process.Process.Instances
+				}
+			}
+		}
+	}
+	return total, byOrg, nil
+}
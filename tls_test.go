@@ -0,0 +1,189 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCert is a test certificate with its key, parsed and in PEM form
+type testCert struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM string
+	keyPEM  string
+	keyPair tls.Certificate
+}
+
+// issueCert creates a certificate signed by parent, or a self-signed CA when parent is nil
+func issueCert(t *testing.T, name string, parent *testCert, usage x509.ExtKeyUsage) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+		template.ExtKeyUsage = nil
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &testCert{
+		cert:    cert,
+		key:     key,
+		certPEM: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		keyPEM:  string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})),
+	}
+	if c.keyPair, err = tls.X509KeyPair([]byte(c.certPEM), []byte(c.keyPEM)); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// writeFile writes data to a file in a test directory and returns its path
+func writeFile(t *testing.T, name, data string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestNewTLSConfig(t *testing.T) {
+	ca := issueCert(t, "test CA", nil, 0)
+	server := issueCert(t, "127.0.0.1", ca, x509.ExtKeyUsageServerAuth)
+	client := issueCert(t, "usage-service", ca, x509.ExtKeyUsageClientAuth)
+	other := issueCert(t, "other", ca, x509.ExtKeyUsageClientAuth)
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca.cert)
+
+	tests := []struct {
+		name      string
+		config    func(*Config)
+		mtls      bool   // the server requires a client certificate
+		maxTLS    uint16 // highest version the server offers
+		configErr string
+		wantErr   bool // the request fails
+	}{
+		{name: "unknown CA", config: func(*Config) {}, wantErr: true},
+		{name: "inline CA bundle", config: func(c *Config) { c.CACert = ca.certPEM }},
+		{name: "CA bundle file", config: func(c *Config) { c.CACert = writeFile(t, "ca.pem", ca.certPEM) }},
+		{name: "CA bundle without certificates", config: func(c *Config) { c.CACert = writeFile(t, "ca.pem", "not a certificate") }, configErr: "no certificates found"},
+		{name: "missing CA file", config: func(c *Config) { c.CACert = filepath.Join(t.TempDir(), "missing.pem") }, configErr: "failed to read CA certificate"},
+		{name: "skip validation", config: func(c *Config) { c.SkipSSLValidation = true }},
+		{name: "mTLS without client certificate", config: func(c *Config) { c.CACert = ca.certPEM }, mtls: true, wantErr: true},
+		{
+			name: "mTLS with client certificate files",
+			config: func(c *Config) {
+				c.CACert = ca.certPEM
+				c.ClientCert = writeFile(t, "client.pem", client.certPEM)
+				c.ClientKey = writeFile(t, "client.key", client.keyPEM)
+			},
+			mtls: true,
+		},
+		{
+			name: "mTLS with inline client certificate",
+			config: func(c *Config) {
+				c.CACert = ca.certPEM
+				c.ClientCert = client.certPEM
+				c.ClientKey = client.keyPEM
+			},
+			mtls: true,
+		},
+		{
+			name: "mismatched client certificate and key",
+			config: func(c *Config) {
+				c.ClientCert = client.certPEM
+				c.ClientKey = other.keyPEM
+			},
+			configErr: "failed to load client certificate",
+		},
+		{name: "minimum TLS 1.2", config: func(c *Config) { c.CACert = ca.certPEM; c.MinTLSVersion = "1.2" }, maxTLS: tls.VersionTLS12},
+		{name: "minimum TLS 1.3 against a TLS 1.2 server", config: func(c *Config) { c.CACert = ca.certPEM; c.MinTLSVersion = "1.3" }, maxTLS: tls.VersionTLS12, wantErr: true},
+		{name: "TLS 1.1 unsupported", config: func(c *Config) { c.MinTLSVersion = "1.1" }, configErr: "unsupported minimum TLS version"},
+		{name: "TLS 1.0 unsupported", config: func(c *Config) { c.MinTLSVersion = "1.0" }, configErr: "unsupported minimum TLS version"},
+		{name: "unknown version", config: func(c *Config) { c.MinTLSVersion = "TLS1.2" }, configErr: "unsupported minimum TLS version"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := defaultConfig()
+			tt.config(config)
+			tlsConfig, err := newTLSConfig(config)
+			if tt.configErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.configErr) {
+					t.Fatalf("error %v, want %q", err, tt.configErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("newTLSConfig: %v", err)
+			}
+
+			ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+			ts.TLS = &tls.Config{Certificates: []tls.Certificate{server.keyPair}, MaxVersion: tt.maxTLS}
+			if tt.mtls {
+				ts.TLS.ClientAuth = tls.RequireAndVerifyClientCert
+				ts.TLS.ClientCAs = clientCAs
+			}
+			ts.StartTLS()
+			defer ts.Close()
+
+			httpClient := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+			resp, err := httpClient.Get(ts.URL)
+			if err == nil {
+				resp.Body.Close()
+			}
+			if (err != nil) != tt.wantErr {
+				t.Errorf("request error %v, want error: %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateMinTLSVersion(t *testing.T) {
+	for version, valid := range map[string]bool{"": true, "1.2": true, "1.3": true, "1.0": false, "1.1": false} {
+		config := defaultConfig()
+		config.MinTLSVersion = version
+		if err := config.validate(); (err == nil) != valid {
+			t.Errorf("minimum TLS version %q: validate() = %v, want valid: %v", version, err, valid)
+		}
+	}
+}
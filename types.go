@@ -10,6 +10,7 @@ import (
 // CF API Response Types
 type CFResponse struct {
 	Resources  []json.RawMessage `json:"resources"`
+	Included   json.RawMessage   `json:"included"` // related resources requested with fields[...] or include=
 	Pagination struct {
 		Next struct {
 			Href string `json:"href"`
@@ -22,18 +23,268 @@ type Organization struct {
 	GUID string `json:"guid"`
 }
 
-type ServiceInstance struct {
+type Space struct {
 	GUID          string `json:"guid"`
 	Name          string `json:"name"`
+	Relationships struct {
+		Organization struct {
+			Data struct {
+				GUID string `json:"guid"`
+			} `json:"data"`
+		} `json:"organization"`
+	} `json:"relationships"`
+}
+
+type App struct {
+	GUID      string    `json:"guid"`
+	Name      string    `json:"name"`
+	State     string    `json:"state"`
+	UpdatedAt time.Time `json:"updated_at"`
+	Lifecycle struct {
+		Type string `json:"type"` // buildpack, docker or cnb
+		Data struct {
+			Stack string `json:"stack"` // empty for docker apps
+		} `json:"data"`
+	} `json:"lifecycle"`
+	Relationships struct {
+		Space struct {
+			Data struct {
+				GUID string `json:"guid"`
+			} `json:"data"`
+		} `json:"space"`
+	} `json:"relationships"`
+}
+
+type Process struct {
+	GUID       string `json:"guid"`
+	Type       string `json:"type"`
+	Instances  int    `json:"instances"`
+	MemoryInMB int    `json:"memory_in_mb"` // per instance
+	DiskInMB   int    `json:"disk_in_mb"`   // per instance
+	Links      struct {
+		App struct {
+			Href string `json:"href"`
+		} `json:"app"`
+	} `json:"links"`
+}
+
+// AppUsageEvent is an entry from /v3/app_usage_events
+type AppUsageEvent struct {
+	GUID      string    `json:"guid"`
+	CreatedAt time.Time `json:"created_at"`
+	State     struct {
+		Current  string `json:"current"`
+		Previous string `json:"previous"`
+	} `json:"state"`
+	App struct {
+		GUID string `json:"guid"`
+		Name string `json:"name"`
+	} `json:"app"`
+	Process struct {
+		GUID string `json:"guid"`
+		Type string `json:"type"`
+	} `json:"process"`
+	Space struct {
+		GUID string `json:"guid"`
+		Name string `json:"name"`
+	} `json:"space"`
+	Organization struct {
+		GUID string `json:"guid"`
+	} `json:"organization"`
+	InstanceCount struct {
+		Current  int `json:"current"`
+		Previous int `json:"previous"`
+	} `json:"instance_count"`
+}
+
+type ServiceInstance struct {
+	GUID          string    `json:"guid"`
+	Name          string    `json:"name"`
+	Type          string    `json:"type"` // managed or user-provided
+	CreatedAt     time.Time `json:"created_at"`
 	Relationships struct {
 		ServicePlan struct {
 			Data struct {
 				GUID string `json:"guid"`
 			} `json:"data"`
 		} `json:"service_plan"`
+		Space struct {
+			Data struct {
+				GUID string `json:"guid"`
+			} `json:"data"`
+		} `json:"space"`
+	} `json:"relationships"`
+}
+
+// ServiceInstanceIncluded holds the related resources returned with a
+// service instance listing that asks for them with fields[...]
+type ServiceInstanceIncluded struct {
+	Spaces           []Space           `json:"spaces"`
+	Organizations    []Organization    `json:"organizations"`
+	ServicePlans     []ServicePlan     `json:"service_plans"`
+	ServiceOfferings []ServiceOffering `json:"service_offerings"`
+	ServiceBrokers   []ServiceBroker   `json:"service_brokers"`
+}
+
+// ServiceCredentialBinding is an entry from /v3/service_credential_bindings:
+// an app binding or a service key of a service instance
+type ServiceCredentialBinding struct {
+	GUID          string `json:"guid"`
+	Type          string `json:"type"` // app or key
+	Relationships struct {
+		App struct {
+			Data struct {
+				GUID string `json:"guid"`
+			} `json:"data"`
+		} `json:"app"` // empty for keys
+		ServiceInstance struct {
+			Data struct {
+				GUID string `json:"guid"`
+			} `json:"data"`
+		} `json:"service_instance"`
+	} `json:"relationships"`
+}
+
+// SharedSpaces is the shared_spaces relationship of a service instance, with
+// the spaces requested through fields[space]
+type SharedSpaces struct {
+	Data []struct {
+		GUID string `json:"guid"`
+	} `json:"data"`
+	Included struct {
+		Spaces []Space `json:"spaces"`
+	} `json:"included"`
+}
+
+// IsolationSegment is an entry from /v3/isolation_segments
+type IsolationSegment struct {
+	GUID string `json:"guid"`
+	Name string `json:"name"`
+}
+
+// ToManyRelationship is a relationship endpoint listing related resources,
+// such as the spaces assigned to an isolation segment
+type ToManyRelationship struct {
+	Data []struct {
+		GUID string `json:"guid"`
+	} `json:"data"`
+}
+
+// ToOneRelationship is a relationship endpoint naming at most one related
+// resource, such as the default isolation segment of an org
+type ToOneRelationship struct {
+	Data *struct {
+		GUID string `json:"guid"`
+	} `json:"data"`
+}
+
+// Task is an entry from /v3/tasks
+type Task struct {
+	GUID          string    `json:"guid"`
+	Name          string    `json:"name"`
+	State         string    `json:"state"`
+	MemoryInMB    int       `json:"memory_in_mb"`
+	CreatedAt     time.Time `json:"created_at"`
+	Relationships struct {
+		App struct {
+			Data struct {
+				GUID string `json:"guid"`
+			} `json:"data"`
+		} `json:"app"`
+	} `json:"relationships"`
+}
+
+// ProcessStats is the response of /v3/processes/:guid/stats, one entry per
+// desired instance
+type ProcessStats struct {
+	Resources []struct {
+		Index int    `json:"index"`
+		State string `json:"state"` // RUNNING, CRASHED, STARTING or DOWN
+	} `json:"resources"`
+}
+
+// Sidecar is an entry from /v3/apps/:guid/sidecars
+type Sidecar struct {
+	GUID         string   `json:"guid"`
+	Name         string   `json:"name"`
+	ProcessTypes []string `json:"process_types"`
+	MemoryInMB   int      `json:"memory_in_mb"`
+}
+
+// QuotaLimits are the limits of an org or space quota that usage is
+// measured against; nil is unlimited
+type QuotaLimits struct {
+	Apps struct {
+		TotalMemoryInMB *int `json:"total_memory_in_mb"`
+		TotalInstances  *int `json:"total_instances"`
+	} `json:"apps"`
+	Services struct {
+		TotalServiceInstances *int `json:"total_service_instances"`
+	} `json:"services"`
+	Routes struct {
+		TotalRoutes *int `json:"total_routes"`
+	} `json:"routes"`
+}
+
+// OrganizationQuota is an entry from /v3/organization_quotas
+type OrganizationQuota struct {
+	GUID string `json:"guid"`
+	Name string `json:"name"`
+	QuotaLimits
+	Relationships struct {
+		Organizations ToManyRelationship `json:"organizations"`
 	} `json:"relationships"`
 }
 
+// SpaceQuota is an entry from /v3/space_quotas
+type SpaceQuota struct {
+	GUID string `json:"guid"`
+	Name string `json:"name"`
+	QuotaLimits
+	Relationships struct {
+		Spaces ToManyRelationship `json:"spaces"`
+	} `json:"relationships"`
+}
+
+// Route is an entry from /v3/routes
+type Route struct {
+	GUID          string `json:"guid"`
+	Relationships struct {
+		Space struct {
+			Data struct {
+				GUID string `json:"guid"`
+			} `json:"data"`
+		} `json:"space"`
+	} `json:"relationships"`
+}
+
+// ServiceUsageEvent is an entry from /v3/service_usage_events
+type ServiceUsageEvent struct {
+	GUID         string    `json:"guid"`
+	CreatedAt    time.Time `json:"created_at"`
+	State        string    `json:"state"` // CREATED, UPDATED or DELETED
+	Organization struct {
+		GUID string `json:"guid"`
+	} `json:"organization"`
+	ServiceInstance struct {
+		GUID string `json:"guid"`
+		Name string `json:"name"`
+		Type string `json:"type"`
+	} `json:"service_instance"`
+	ServicePlan struct {
+		GUID string `json:"guid"`
+		Name string `json:"name"`
+	} `json:"service_plan"`
+	ServiceOffering struct {
+		GUID string `json:"guid"`
+		Name string `json:"name"`
+	} `json:"service_offering"`
+	ServiceBroker struct {
+		GUID string `json:"guid"`
+		Name string `json:"name"`
+	} `json:"service_broker"`
+}
+
 type ServicePlan struct {
 	GUID          string `json:"guid"`
 	Name          string `json:"name"`
@@ -47,30 +298,58 @@ type ServicePlan struct {
 }
 
 type ServiceOffering struct {
-	GUID string `json:"guid"`
-	Name string `json:"name"`
+	GUID          string `json:"guid"`
+	Name          string `json:"name"`
+	Shareable     bool   `json:"shareable"` // instances can be shared into other spaces
+	Relationships struct {
+		ServiceBroker struct {
+			Data struct {
+				GUID string `json:"guid"`
+			} `json:"data"`
+		} `json:"service_broker"`
+	} `json:"relationships"`
+}
+
+// ServiceBroker is an entry from /v3/service_brokers. Space-scoped brokers
+// are registered by space developers and only serve their own space.
+type ServiceBroker struct {
+	GUID          string `json:"guid"`
+	Name          string `json:"name"`
+	Relationships struct {
+		Space struct {
+			Data *struct {
+				GUID string `json:"guid"`
+			} `json:"data"`
+		} `json:"space"`
+	} `json:"relationships"`
+}
+
+// spaceScoped reports whether the broker is registered for a single space
+func (b ServiceBroker) spaceScoped() bool {
+	return b.Relationships.Space.Data != nil && b.Relationships.Space.Data.GUID != ""
 }
 
 type UsageSummary struct {
 	UsageSummary struct {
-		StartedInstances  int `json:"started_instances"`
+		StartedInstances int `json:"started_instances"`
+		MemoryInMB       int `json:"memory_in_mb"` // allocated to started instances
 		ServiceInstances int `json:"service_instances"`
 	} `json:"usage_summary"`
 }
 
 // App Usage Report Types
 type AppUsageReport struct {
-	ReportTime      string          `json:"report_time"`
-	MonthlyReports  []MonthlyReport `json:"monthly_reports"`
-	YearlyReports   []YearlyReport  `json:"yearly_reports"`
+	ReportTime     string          `json:"report_time"`
+	MonthlyReports []MonthlyReport `json:"monthly_reports"`
+	YearlyReports  []YearlyReport  `json:"yearly_reports"`
 }
 
 type MonthlyReport struct {
-	Month                int     `json:"month"`
-	Year                 int     `json:"year"`
-	AverageAppInstances  float64 `json:"average_app_instances"`
-	MaximumAppInstances  int     `json:"maximum_app_instances"`
-	AppInstanceHours     float64 `json:"app_instance_hours"`
+	Month               int     `json:"month"`
+	Year                int     `json:"year"`
+	AverageAppInstances float64 `json:"average_app_instances"`
+	MaximumAppInstances int     `json:"maximum_app_instances"`
+	AppInstanceHours    float64 `json:"app_instance_hours"`
 }
 
 type YearlyReport struct {
@@ -80,41 +359,378 @@ type YearlyReport struct {
 	AppInstanceHours    float64 `json:"app_instance_hours"`
 }
 
+// ServiceUsageReport is the per-service history from /system_report/service_usages
+type ServiceUsageReport struct {
+	ReportTime            string                 `json:"report_time"`
+	MonthlyServiceReports []MonthlyServiceReport `json:"monthly_service_reports"`
+	YearlyServiceReports  []YearlyServiceReport  `json:"yearly_service_report"`
+}
+
+type MonthlyServiceReport struct {
+	ServiceName string                `json:"service_name"`
+	ServiceGUID string                `json:"service_guid"`
+	Usages      []MonthlyServiceUsage `json:"usages"`
+}
+
+type MonthlyServiceUsage struct {
+	Month            int     `json:"month"`
+	Year             int     `json:"year"`
+	DurationInHours  float64 `json:"duration_in_hours"`
+	AverageInstances float64 `json:"average_instances"`
+	MaximumInstances int     `json:"maximum_instances"`
+}
+
+type YearlyServiceReport struct {
+	ServiceName      string  `json:"service_name"`
+	ServiceGUID      string  `json:"service_guid"`
+	Year             int     `json:"year"`
+	DurationInHours  float64 `json:"duration_in_hours"`
+	AverageInstances float64 `json:"average_instances"`
+	MaximumInstances int     `json:"maximum_instances"`
+}
+
+// OrgAppUsages is the response of /organizations/:guid/app_usages
+type OrgAppUsages struct {
+	OrganizationGUID string `json:"organization_guid"`
+	PeriodStart      string `json:"period_start"`
+	PeriodEnd        string `json:"period_end"`
+	AppUsages        []struct {
+		AppGUID           string  `json:"app_guid"`
+		AppName           string  `json:"app_name"`
+		SpaceName         string  `json:"space_name"`
+		InstanceCount     int     `json:"instance_count"`
+		DurationInSeconds float64 `json:"duration_in_seconds"`
+	} `json:"app_usages"`
+}
+
+// OrgServiceUsages is the response of /organizations/:guid/service_usages
+type OrgServiceUsages struct {
+	OrganizationGUID string `json:"organization_guid"`
+	PeriodStart      string `json:"period_start"`
+	PeriodEnd        string `json:"period_end"`
+	ServiceUsages    []struct {
+		ServiceInstanceGUID string  `json:"service_instance_guid"`
+		ServiceInstanceName string  `json:"service_instance_name"`
+		ServiceName         string  `json:"service_name"`
+		ServicePlanName     string  `json:"service_plan_name"`
+		SpaceName           string  `json:"space_name"`
+		DurationInSeconds   float64 `json:"duration_in_seconds"`
+		Deleted             bool    `json:"deleted"`
+	} `json:"service_usages"`
+}
+
 // CF Client
 type CFClient struct {
-	httpClient       *http.Client
-	servicePlans     map[string]ServicePlan
-	serviceOfferings map[string]ServiceOffering
+	httpClient *http.Client
+	serviceCatalog
 	apiEndpoint      string
 	accessToken      string
+	clientID         string
+	clientSecret     string
+	credentials      *credentials
+	tokenURL         string // discovered OAuth token endpoint, reused across re-authentication
+	allowGuessedAuth bool
+	events           eventTrackers
+	appUsageURL      string
+	appUsageSource   string // how appUsageURL was determined
+	recorder         *recorder
+	replay           *replayer
+	now              func() time.Time // the recording time when replaying
+}
+
+// serviceCatalog resolves service plans to offerings and decides which
+// offerings are billable
+type serviceCatalog struct {
+	servicePlans      map[string]ServicePlan
+	serviceOfferings  map[string]ServiceOffering
+	serviceBrokers    map[string]ServiceBroker
+	billableOfferings map[string]bool // offering names and "broker:offering" pairs
+	mu                sync.RWMutex    // guards billableOfferings
 }
 
 // Configuration
 type Config struct {
-	SkipOrgs        []string
-	Verbose         bool
-	JSONOutput      bool
+	// Cloud Foundry API and authentication
+	APIEndpoint       string
+	Username          string
+	Password          string
+	ClientID          string
+	ClientSecret      string
+	SkipSSLValidation bool
+
+	// AllowGuessedAuthEndpoints permits sending credentials to guessed UAA
+	// token endpoints when discovery fails
+	AllowGuessedAuthEndpoints bool
+
+	// TLS settings: extra trusted CAs, client certificate for mutual TLS
+	// (file paths or inline PEM) and minimum protocol version ("1.2", "1.3")
+	CACert        string
+	ClientCert    string
+	ClientKey     string
+	MinTLSVersion string
+
+	// File-backed secrets, re-read on every authentication
+	UsernameFile     string
+	PasswordFile     string
+	ClientSecretFile string
+
+	// CredentialsService names the VCAP_SERVICES binding holding credentials
+	CredentialsService string
+
+	// Billing rules
+	SkipOrgs          []string
+	BillableOfferings []string
+
+	// CollectionTimeout bounds a single collection run; 0 disables the deadline
+	CollectionTimeout time.Duration
+
+	// Server settings
 	ServerMode      bool
 	Port            int
 	RefreshInterval time.Duration
+	AdminToken      string
+
+	// App-usage service; the endpoint is discovered when not set
+	AppUsageEndpoint   string
+	AppUsageOrgReports bool // per-org reports (one request per org and report)
+
+	// Sidecars counts sidecar processes, one request per started app
+	Sidecars bool
+	// IdleApps reports stopped and unhealthy apps, one request per started process
+	IdleApps bool
+
+	// Usage event ingestion; state is persisted in StateDir when set
+	AppUsageEvents     bool
+	ServiceUsageEvents bool
+	StateDir           string
+
+	// Record responses to RecordDir, or serve them from ReplayDir instead of a foundation
+	RecordDir string
+	ReplayDir string
+
+	// Output settings
+	Verbose    bool
+	JSONOutput bool
+
+	// ConfigFile is the path the configuration was loaded from, if any
+	ConfigFile string
 }
 
 // Usage Results
 type UsageResult struct {
-	Organizations         []OrgUsage `json:"organizations,omitempty"`
-	TotalAIs              int        `json:"total_ais"`                 // Includes all orgs including system
-	TotalBillableAIs      int        `json:"total_billable_ais"`        // Excludes system org
-	TotalSIs              int        `json:"total_sis"`
-	TotalBillableSIs      int        `json:"total_billable_sis"`
-	MonthlyMaxBillableAIs int        `json:"monthly_max_billable_ais"`  // Maximum billable AIs this month
-	YearlyMaxBillableAIs  int        `json:"yearly_max_billable_ais"`   // Maximum billable AIs this year
+	Organizations            []OrgUsage                `json:"organizations,omitempty"`
+	TotalAIs                 int                       `json:"total_ais"`          // Includes all orgs including system
+	TotalBillableAIs         int                       `json:"total_billable_ais"` // Excludes system org
+	TotalSIs                 int                       `json:"total_sis"`
+	TotalBillableSIs         int                       `json:"total_billable_sis"`
+	TotalUnknownPlanSIs      int                       `json:"total_unknown_plan_sis"` // SIs whose plan or offering is not in the catalog (excludes skipped orgs)
+	TotalManagedSIs          int                       `json:"total_managed_sis"`
+	TotalUserProvidedSIs     int                       `json:"total_user_provided_sis"`
+	TotalSharedSIs           int                       `json:"total_shared_sis"`         // Managed SIs shared into other orgs, counted once in their owning org
+	TotalMemoryGB            float64                   `json:"total_memory_gb"`          // Memory allocated to started instances, all orgs
+	TotalBillableMemoryGB    float64                   `json:"total_billable_memory_gb"` // Excludes skipped orgs
+	TotalDiskGB              float64                   `json:"total_disk_gb,omitempty"`  // Disk allocated to running processes, all orgs
+	TotalBillableDiskGB      float64                   `json:"total_billable_disk_gb,omitempty"`
+	ServiceOfferings         []OfferingUsage           `json:"service_offerings,omitempty"`          // Managed SIs by broker and offering (excludes skipped orgs)
+	OrphanedServiceInstances []OrphanedServiceInstance `json:"orphaned_service_instances,omitempty"` // Managed SIs without bindings or keys (excludes skipped orgs)
+	IsolationSegments        []IsolationSegmentUsage   `json:"isolation_segments,omitempty"`         // AIs of started apps by isolation segment
+	Stacks                   []StackUsage              `json:"stacks,omitempty"`                     // AIs of started apps by stack and lifecycle
+	Quotas                   []QuotaUsage              `json:"quotas,omitempty"`                     // Use of org and space quotas (excludes skipped orgs)
+	Tasks                    *TaskUsage                `json:"tasks,omitempty"`                      // Running tasks, all orgs
+	TotalSidecarInstances    int                       `json:"total_sidecar_instances,omitempty"`    // Sidecars running alongside process instances, all orgs (when enabled)
+	IdleApps                 []IdleApp                 `json:"idle_apps,omitempty"`                  // Stopped apps and started apps without healthy instances (when enabled; excludes skipped orgs)
+	MonthlyMaxBillableAIs    int                       `json:"monthly_max_billable_ais"`             // Maximum billable AIs this month
+	YearlyMaxBillableAIs     int                       `json:"yearly_max_billable_ais"`              // Maximum billable AIs this year
+	AppUsageService          *AppUsageServiceReport    `json:"app_usage_service,omitempty"`          // History from the app-usage service
+	AppUsageEvents           *EventUsage               `json:"app_usage_events,omitempty"`           // AI-hours and peaks from app usage events
+	ServiceUsageEvents       *ServiceEventUsage        `json:"service_usage_events,omitempty"`       // SI-days and peaks from service usage events
+}
+
+// AppUsageServiceReport is the usage history reported by the app-usage service
+type AppUsageServiceReport struct {
+	ReportTime    string               `json:"report_time"`
+	Monthly       []MonthlyReport      `json:"monthly"`
+	Yearly        []YearlyReport       `json:"yearly"`
+	Services      *ServiceUsageReport  `json:"services,omitempty"`
+	Organizations []OrgAppUsageSummary `json:"organizations,omitempty"`
+}
+
+// OrgAppUsageSummary is an org's usage in the current month from the per-org reports
+type OrgAppUsageSummary struct {
+	Name                 string  `json:"name"`
+	Year                 int     `json:"year"`
+	Month                int     `json:"month"`
+	AppInstanceHours     float64 `json:"app_instance_hours"`
+	ServiceInstanceHours float64 `json:"service_instance_hours"`
+}
+
+// ServiceEventUsage is the managed service instance accounting reconstructed
+// from service usage events
+type ServiceEventUsage struct {
+	TrackingSince time.Time            `json:"tracking_since"`
+	LastEventGUID string               `json:"last_event_guid,omitempty"`
+	Periods       []ServicePeriodUsage `json:"periods"`
+}
+
+// ServicePeriodUsage is the SI accounting for one billing period (calendar month, UTC)
+type ServicePeriodUsage struct {
+	Period          string            `json:"period"` // YYYY-MM
+	SIDays          float64           `json:"si_days"`
+	BillableSIDays  float64           `json:"billable_si_days"`
+	PeakSIs         int               `json:"peak_sis"`
+	BillablePeakSIs int               `json:"billable_peak_sis"`
+	Organizations   []OrgServiceUsage `json:"organizations"`
+}
+
+type OrgServiceUsage struct {
+	Name            string  `json:"name"`
+	SIDays          float64 `json:"si_days"`
+	BillableSIDays  float64 `json:"billable_si_days"`
+	BillablePeakSIs int     `json:"billable_peak_sis"`
+}
+
+// EventUsage is the AI accounting reconstructed from app usage events
+type EventUsage struct {
+	TrackingSince time.Time     `json:"tracking_since"`
+	LastEventGUID string        `json:"last_event_guid,omitempty"`
+	Periods       []PeriodUsage `json:"periods"`
+}
+
+// PeriodUsage is the AI accounting for one billing period (calendar month, UTC)
+type PeriodUsage struct {
+	Period          string       `json:"period"` // YYYY-MM
+	AIHours         float64      `json:"ai_hours"`
+	BillableAIHours float64      `json:"billable_ai_hours"`
+	PeakAIs         int          `json:"peak_ais"`
+	BillablePeakAIs int          `json:"billable_peak_ais"`
+	Organizations   []ScopeUsage `json:"organizations"`
+	Spaces          []ScopeUsage `json:"spaces"`
+}
+
+type ScopeUsage struct {
+	Name    string  `json:"name"`
+	Org     string  `json:"org,omitempty"` // owning org for spaces
+	AIHours float64 `json:"ai_hours"`
+	PeakAIs int     `json:"peak_ais"`
 }
 
 type OrgUsage struct {
-	Name       string `json:"name"`
-	AIs        int    `json:"ais"`
-	SIs        int    `json:"sis"`
-	BillableSIs int   `json:"billable_sis"`
+	Name             string            `json:"name"`
+	AIs              int               `json:"ais"`
+	SIs              int               `json:"sis"`
+	BillableSIs      int               `json:"billable_sis"`
+	UnknownPlanSIs   int               `json:"unknown_plan_sis,omitempty"` // plan or offering missing from the catalog
+	ManagedSIs       int               `json:"managed_sis"`
+	UserProvidedSIs  int               `json:"user_provided_sis"`
+	OrphanedSIs      int               `json:"orphaned_sis"`      // managed SIs without app bindings or service keys
+	SharedSIs        int               `json:"shared_sis"`        // owned here and shared into other orgs
+	SharedInSIs      int               `json:"shared_in_sis"`     // owned by other orgs, not counted in SIs
+	Stacks           []StackUsage      `json:"stacks,omitempty"`  // AIs of started apps by stack and lifecycle
+	MemoryGB         float64           `json:"memory_gb"`         // allocated to started instances, from the usage summary
+	DiskGB           float64           `json:"disk_gb,omitempty"` // allocated to running processes
+	Spaces           []SpaceAllocation `json:"spaces,omitempty"`
+	Tasks            *TaskUsage        `json:"tasks,omitempty"`             // running tasks
+	SidecarInstances int               `json:"sidecar_instances,omitempty"` // sidecars running alongside process instances
+}
+
+// OfferingUsage counts the managed service instances of one offering of one broker
+type OfferingUsage struct {
+	Broker      string `json:"broker"`
+	Offering    string `json:"offering"`
+	SpaceScoped bool   `json:"space_scoped,omitempty"` // registered by a space-scoped broker
+	Billable    bool   `json:"billable"`
+	Instances   int    `json:"instances"`
+}
+
+// TaskUsage summarizes the tasks running at collection time. Tasks are not
+// in the started_instances of the usage summary.
+type TaskUsage struct {
+	Running      int     `json:"running"`
+	MemoryGB     float64 `json:"memory_gb"`
+	Hours        float64 `json:"hours"`         // run time of the running tasks so far
+	LongestHours float64 `json:"longest_hours"` // run time of the longest-running task
+}
+
+// QuotaUsage is the use of the quota of one org, or of one space when Space is set
+type QuotaUsage struct {
+	Org            string               `json:"org"`
+	Space          string               `json:"space,omitempty"`
+	Quota          string               `json:"quota"`
+	Resources      []QuotaResourceUsage `json:"resources"`
+	MaxUtilization float64              `json:"max_utilization"` // highest percentage of any limited resource
+}
+
+// QuotaResourceUsage is the use of one quota limit
+type QuotaResourceUsage struct {
+	Resource    string  `json:"resource"` // app_instances, memory_mb, service_instances or routes
+	Used        int     `json:"used"`
+	Limit       *int    `json:"limit"`                 // nil: unlimited
+	Utilization float64 `json:"utilization,omitempty"` // percentage of the limit
+}
+
+// SpaceAllocation is the memory and disk allocated to the running processes
+// of one space
+type SpaceAllocation struct {
+	Name     string  `json:"name"`
+	AIs      int     `json:"ais"`
+	MemoryGB float64 `json:"memory_gb"`
+	DiskGB   float64 `json:"disk_gb"`
+}
+
+// StackUsage counts the running instances of started apps with one stack and
+// lifecycle type
+type StackUsage struct {
+	Stack       string `json:"stack"`     // "none" for docker apps
+	Lifecycle   string `json:"lifecycle"` // buildpack, docker or cnb
+	AIs         int    `json:"ais"`
+	BillableAIs int    `json:"billable_ais,omitempty"` // totals only; excludes skipped orgs
+}
+
+// IsolationSegmentUsage counts the running instances of started apps placed
+// on one isolation segment
+type IsolationSegmentUsage struct {
+	Name        string `json:"name"`
+	AIs         int    `json:"ais"`
+	BillableAIs int    `json:"billable_ais"` // excludes skipped orgs
+}
+
+// IdleApp is a stopped app, or a started app none or only some of whose
+// instances run healthily, with the service instances bound to it
+type IdleApp struct {
+	GUID             string                 `json:"guid"`
+	Name             string                 `json:"name"`
+	Org              string                 `json:"org"`
+	Space            string                 `json:"space"`
+	State            string                 `json:"state"`  // STOPPED or STARTED
+	Reason           string                 `json:"reason"` // stopped, scaled_to_zero, no_running_instances or crashing
+	Instances        int                    `json:"instances"`
+	RunningInstances int                    `json:"running_instances"`
+	CrashedInstances int                    `json:"crashed_instances"`
+	ServiceInstances []BoundServiceInstance `json:"service_instances,omitempty"`
+	UpdatedAt        time.Time              `json:"updated_at"`
+	AgeDays          int                    `json:"age_days"` // days since the last update
+}
+
+// BoundServiceInstance is a service instance bound to an app
+type BoundServiceInstance struct {
+	Name     string `json:"name"`
+	Offering string `json:"offering,omitempty"`
+	Billable bool   `json:"billable"`
+}
+
+// OrphanedServiceInstance is a managed service instance with no app bindings
+// and no service keys
+type OrphanedServiceInstance struct {
+	GUID      string    `json:"guid"`
+	Name      string    `json:"name"`
+	Org       string    `json:"org"`
+	Space     string    `json:"space"`
+	Broker    string    `json:"broker,omitempty"`
+	Offering  string    `json:"offering"`
+	Plan      string    `json:"plan"`
+	Billable  bool      `json:"billable"`
+	CreatedAt time.Time `json:"created_at"`
+	AgeDays   int       `json:"age_days"`
 }
 
 // Server Types
@@ -141,4 +757,4 @@ func (cd *CachedData) IsStale(refreshInterval time.Duration) bool {
 	cd.mu.RLock()
 	defer cd.mu.RUnlock()
 	return cd.Result == nil || time.Since(cd.LastFetch) > refreshInterval
-}
\ No newline at end of file
+}